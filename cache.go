@@ -0,0 +1,281 @@
+package skingo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// componentCache stores the rendered HTML of a component for each key
+type componentCache struct {
+	ttl     time.Duration
+	keyFunc func(args []interface{}) string
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+// cacheEntry is a rendered component, together with the templates and the
+// dynamic CSS it used, so a cache hit includes the same assets in the page.
+type cacheEntry struct {
+	html    template.HTML
+	used    []string
+	css     map[string][]string
+	expires time.Time
+}
+
+func (e *cacheEntry) addUsed(name string) {
+	for _, used := range e.used {
+		if used == name {
+			return
+		}
+	}
+	e.used = append(e.used, name)
+}
+
+func (e *cacheEntry) addCSS(name, css string) {
+	for _, rendered := range e.css[name] {
+		if rendered == css {
+			return
+		}
+	}
+	e.css[name] = append(e.css[name], css)
+}
+
+// CacheComponent memoizes the rendered HTML of the named component for ttl,
+// which suits components that are expensive to render but change rarely, such
+// as a navigation menu loaded from a database. Every comp call of the component
+// with arguments that produce the same key reuses the cached HTML, and the
+// styles and scripts of the component and its nested components are still
+// included in the page.
+//
+// keyFunc receives the comp arguments and returns the cache key. When it is nil,
+// the key is the arguments formatted with fmt ("%v"), so different arguments
+// are cached separately. A ttl of 0 or less disables the cache of the
+// component and discards its entries. The cache is safe for concurrent use.
+func (ts *TemplateSet) CacheComponent(name string, ttl time.Duration, keyFunc func(args []interface{}) string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	name = strings.TrimSuffix(name, ".html")
+	if ttl <= 0 {
+		delete(ts.compCaches, name)
+		return
+	}
+	if keyFunc == nil {
+		keyFunc = func(args []interface{}) string { return fmt.Sprintf("%v", args) }
+	}
+	ts.compCaches[name] = &componentCache{
+		ttl:     ttl,
+		keyFunc: keyFunc,
+		entries: make(map[string]*cacheEntry),
+	}
+}
+
+// replay registers the templates and the CSS used by the render recorded in
+// entry as used by the current render.
+func (ts *TemplateSet) replay(entry *cacheEntry) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for _, used := range entry.used {
+		ts.markUsed(used)
+	}
+	for templateName, css := range entry.css {
+		for _, rendered := range css {
+			ts.addRenderedCSS(templateName, rendered)
+		}
+	}
+}
+
+// ClearComponentCache discards the cached HTML of all components, for example
+// after the data behind a cached component changed.
+func (ts *TemplateSet) ClearComponentCache() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	for _, cache := range ts.compCaches {
+		cache.mu.Lock()
+		cache.entries = make(map[string]*cacheEntry)
+		cache.mu.Unlock()
+	}
+}
+
+// renderCached returns the cached HTML of a component, rendering and storing it
+// when there is no valid entry for the key of args.
+func (ts *TemplateSet) renderCached(cache *componentCache, name string, args []interface{}) (template.HTML, error) {
+	key := cache.keyFunc(args)
+	now := time.Now()
+
+	cache.mu.Lock()
+	entry, ok := cache.entries[key]
+	cache.mu.Unlock()
+
+	if ok && now.Before(entry.expires) {
+		ts.replay(entry)
+		return entry.html, nil
+	}
+
+	entry = &cacheEntry{used: []string{name}, css: make(map[string][]string)}
+	ts.mu.Lock()
+	ts.recorders = append(ts.recorders, entry)
+	ts.mu.Unlock()
+
+	html, err := ts.executeComponent(name, args)
+
+	ts.mu.Lock()
+	ts.recorders = ts.recorders[:len(ts.recorders)-1]
+	ts.mu.Unlock()
+
+	if err != nil {
+		return "", err
+	}
+
+	entry.html = html
+	entry.expires = now.Add(cache.ttl)
+
+	cache.mu.Lock()
+	// Drop expired entries so keys that are no longer used do not accumulate
+	for k, e := range cache.entries {
+		if !now.Before(e.expires) {
+			delete(cache.entries, k)
+		}
+	}
+	cache.entries[key] = entry
+	cache.mu.Unlock()
+
+	return html, nil
+}
+
+// pageCache stores the rendered output of a page for each key
+type pageCache struct {
+	ttl      time.Duration
+	keyFunc  func(data interface{}) string
+	mu       sync.Mutex
+	entries  map[string]*pageEntry
+	inflight map[string]*pageRender
+}
+
+// pageEntry is the output of a page rendered with a layout
+type pageEntry struct {
+	output  []byte
+	expires time.Time
+}
+
+// pageRender is a render of a page in progress, which the concurrent misses
+// of the same key wait for instead of rendering the page again
+type pageRender struct {
+	done  chan struct{}
+	entry *pageEntry
+	err   error
+}
+
+// CachePage memoizes the whole output written by Execute for the named
+// template for ttl, which suits pages that are identical for many visitors,
+// such as a public landing page. A cache hit writes the cached bytes and skips
+// rendering entirely, so neither components nor the observer run.
+//
+// keyFunc receives the data passed to Execute and returns the cache key, for
+// example the locale of the visitor. When it is nil, every render of the page
+// shares a single entry. The layout is part of the key, so ExecuteWithLayout
+// caches each layout apart. A ttl of 0 or less disables the cache of the page
+// and discards its entries. The cache is safe for concurrent use, and concurrent
+// misses of the same key wait for a single render.
+func (ts *TemplateSet) CachePage(name string, keyFunc func(data interface{}) string, ttl time.Duration) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	name = strings.TrimSuffix(name, ".html")
+	if ttl <= 0 {
+		delete(ts.pageCaches, name)
+		return
+	}
+	if keyFunc == nil {
+		keyFunc = func(data interface{}) string { return "" }
+	}
+	if ts.pageCaches == nil {
+		ts.pageCaches = make(map[string]*pageCache)
+	}
+	ts.pageCaches[name] = &pageCache{
+		ttl:      ttl,
+		keyFunc:  keyFunc,
+		entries:  make(map[string]*pageEntry),
+		inflight: make(map[string]*pageRender),
+	}
+}
+
+// ClearPageCache discards the cached output of all pages, for example after
+// the content behind a cached page changed.
+func (ts *TemplateSet) ClearPageCache() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	for _, cache := range ts.pageCaches {
+		cache.mu.Lock()
+		cache.entries = make(map[string]*pageEntry)
+		cache.mu.Unlock()
+	}
+}
+
+// executeCachedPage writes the cached output of a page, rendering it with
+// execute and storing it when there is no valid entry for the key of data.
+// While a render of the key is in progress, other calls wait for its output.
+// When that render fails, they render the page themselves, since the error may
+// be specific to its context.
+func (ts *TemplateSet) executeCachedPage(ctx context.Context, w io.Writer, cache *pageCache, layoutName string, data interface{}, execute func(w io.Writer) error) error {
+	key := layoutName + "\x00" + cache.keyFunc(data)
+	now := time.Now()
+
+	cache.mu.Lock()
+	entry, ok := cache.entries[key]
+	if ok && now.Before(entry.expires) {
+		cache.mu.Unlock()
+		_, err := w.Write(entry.output)
+		return err
+	}
+	if call, waiting := cache.inflight[key]; waiting {
+		cache.mu.Unlock()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if call.err != nil {
+			return execute(w)
+		}
+		_, err := w.Write(call.entry.output)
+		return err
+	}
+	call := &pageRender{done: make(chan struct{})}
+	cache.inflight[key] = call
+	cache.mu.Unlock()
+
+	var buf bytes.Buffer
+	call.err = execute(&buf)
+	if call.err == nil {
+		call.entry = &pageEntry{output: buf.Bytes(), expires: now.Add(cache.ttl)}
+	}
+
+	cache.mu.Lock()
+	delete(cache.inflight, key)
+	if call.err == nil {
+		// Drop expired entries so keys that are no longer used do not accumulate
+		for k, e := range cache.entries {
+			if !now.Before(e.expires) {
+				delete(cache.entries, k)
+			}
+		}
+		cache.entries[key] = call.entry
+	}
+	cache.mu.Unlock()
+	close(call.done)
+
+	if call.err != nil {
+		return call.err
+	}
+	_, err := w.Write(call.entry.output)
+	return err
+}
@@ -1,3 +1,5 @@
 module github.com/messiashenrique/skingo
 
 go 1.24.1
+
+require golang.org/x/net v0.50.0
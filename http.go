@@ -0,0 +1,491 @@
+package skingo
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SetCompressionLevel sets the gzip level used by ExecuteHTTP, from
+// gzip.BestSpeed to gzip.BestCompression. The default is
+// gzip.DefaultCompression, and gzip.NoCompression disables compression.
+func (ts *TemplateSet) SetCompressionLevel(level int) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.compression = level
+}
+
+// ExecuteHTTP renders a template with the default layout as an HTTP response.
+// It sets the Content-Type header and, when the request accepts it, compresses
+// the response with gzip using the level configured with SetCompressionLevel.
+//
+// Nothing is written to w when the template fails before the layout is
+// executed, so the caller can still respond with an error page.
+func (ts *TemplateSet) ExecuteHTTP(w http.ResponseWriter, r *http.Request, name string, data interface{}) error {
+	return ts.serveHTML(w, r, func(w io.Writer) error {
+		return ts.Execute(w, name, data)
+	})
+}
+
+// serveHTML sets the Content-Type header and calls render with w, compressed
+// when the request accepts gzip
+func (ts *TemplateSet) serveHTML(w http.ResponseWriter, r *http.Request, render func(w io.Writer) error) error {
+	ts.mu.Lock()
+	level := ts.compression
+	ts.mu.Unlock()
+
+	header := w.Header()
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", "text/html; charset=utf-8")
+	}
+	header.Add("Vary", "Accept-Encoding")
+
+	if level == gzip.NoCompression || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+		return render(w)
+	}
+
+	gw := &gzipResponseWriter{w: w, level: level}
+	err := render(gw)
+	if closeErr := gw.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// ExecutePreload works like ExecuteHTTP, but first adds Link headers asking the
+// browser to preload the assets of the components used in the page: the fonts
+// referenced with url() by their CSS and, with ExternalStyles, the stylesheet
+// of the page. Browsers and HTTP/2 servers can then fetch them before the HTML
+// is parsed. Relative font URLs of the external stylesheet are resolved against
+// its path, since the browser resolves the Link URLs against the page.
+//
+// Since the used components are only known once the page is rendered, the page
+// is rendered into a buffer and written after the headers are set. Nothing is
+// written to w when the render fails.
+func (ts *TemplateSet) ExecutePreload(w http.ResponseWriter, r *http.Request, name string, data interface{}) error {
+	var page bytes.Buffer
+	used, err := ts.ExecuteWithUsed(&page, name, data)
+	if err != nil {
+		return err
+	}
+
+	for _, link := range ts.preloadLinks(used, page.String()) {
+		w.Header().Add("Link", link)
+	}
+	return ts.serveHTML(w, r, func(w io.Writer) error {
+		_, err := page.WriteTo(w)
+		return err
+	})
+}
+
+// fontExtensions are the file extensions of the URLs preloaded as fonts
+var fontExtensions = []string{".woff2", ".woff", ".ttf", ".otf"}
+
+// preloadLinks returns the values of the Link headers preloading the fonts of
+// the used templates and the external stylesheet linked from page, if any
+func (ts *TemplateSet) preloadLinks(used []string, page string) []string {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	var links []string
+	var stylesheet *url.URL
+	if ts.stylesPath != "" {
+		prefix := `href="` + ts.stylesPath
+		if i := strings.Index(page, prefix); i != -1 {
+			href := page[i+len(`href="`):]
+			if end := strings.IndexByte(href, '"'); end != -1 {
+				links = append(links, "<"+href[:end]+">; rel=preload; as=style")
+				stylesheet, _ = url.Parse(html.UnescapeString(href[:end]))
+			}
+		}
+	}
+
+	for _, name := range used {
+		t, ok := ts.templates[name]
+		if !ok {
+			continue
+		}
+		// URLs in the linked stylesheet are relative to it, not to the page
+		base := stylesheet
+		if t.critical || ts.critical[name] {
+			base = nil
+		}
+		for _, groups := range cssURLRegex.FindAllStringSubmatch(t.CSS, -1) {
+			font := groups[1] + groups[2] + groups[3]
+			path := strings.ToLower(font)
+			if i := strings.IndexAny(path, "?#"); i != -1 {
+				path = path[:i]
+			}
+			if strings.Contains(font, "{{") || !slices.ContainsFunc(fontExtensions, func(ext string) bool {
+				return strings.HasSuffix(path, ext)
+			}) {
+				continue
+			}
+			if base != nil {
+				ref, err := url.Parse(font)
+				if err != nil {
+					continue
+				}
+				font = base.ResolveReference(ref).String()
+			}
+			if link := "<" + font + ">; rel=preload; as=font; crossorigin"; !slices.Contains(links, link) {
+				links = append(links, link)
+			}
+		}
+	}
+	return links
+}
+
+// gzipResponseWriter compresses the response, starting only on the first write
+// so the headers are left untouched when nothing is written.
+type gzipResponseWriter struct {
+	w     http.ResponseWriter
+	level int
+	gz    *gzip.Writer
+}
+
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	if g.gz == nil {
+		gz, err := gzip.NewWriterLevel(g.w, g.level)
+		if err != nil {
+			return 0, err
+		}
+		g.w.Header().Set("Content-Encoding", "gzip")
+		g.w.Header().Del("Content-Length")
+		g.gz = gz
+	}
+	return g.gz.Write(p)
+}
+
+// Close flushes the compressed data, if any was written
+func (g *gzipResponseWriter) Close() error {
+	if g.gz == nil {
+		return nil
+	}
+	return g.gz.Close()
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip. An explicit
+// gzip entry takes precedence over the "*" wildcard.
+func acceptsGzip(acceptEncoding string) bool {
+	gzipQ, anyQ := -1.0, -1.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && strings.TrimSpace(key) == "q" {
+				if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if coding == "gzip" {
+			gzipQ = q
+		} else {
+			anyQ = q
+		}
+	}
+
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return anyQ > 0
+}
+
+// ExternalStyles makes Execute write the combined CSS of each page to an
+// in-memory asset store and reference it with a <link rel="stylesheet"> tag
+// instead of an inline <style> block, so sites with a strict Content Security
+// Policy can avoid inline styles. The stylesheets are named after the hash of
+// their content and linked under basePath (for example "/assets/"), which must
+// be served by AssetHandler. An empty basePath restores inline styles.
+//
+// Every distinct combination of CSS is kept in memory, which is bounded for
+// static CSS but may grow with DynamicCSS.
+func (ts *TemplateSet) ExternalStyles(basePath string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.stylesPath = ""
+	if basePath != "" {
+		ts.stylesPath = strings.TrimSuffix(basePath, "/") + "/"
+	}
+}
+
+// MarkCritical marks the CSS of the named templates as critical, like the
+// critical attribute of their <style> tag (<style critical>). With
+// ExternalStyles, the critical CSS of each page, typically that of the
+// components above the fold, is inlined in a <style> block, while the rest of
+// the CSS is loaded without blocking the first paint through a
+// <link media="print" onload="this.media='all'"> tag, with a <noscript>
+// fallback. Without ExternalStyles, all the CSS is inlined as usual.
+//
+// The inline block and the onload handler require a Content Security Policy
+// that allows them.
+func (ts *TemplateSet) MarkCritical(names ...string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.critical == nil {
+		ts.critical = make(map[string]bool)
+	}
+	for _, name := range names {
+		ts.critical[strings.TrimSuffix(name, ".html")] = true
+	}
+}
+
+// HeadAssets returns the tags with the combined CSS of the named components, as
+// written to the <head> of a page, so it can be sent before the body is
+// rendered, for example with 103 Early Hints or when streaming the response.
+// The CSS is an inline <style> block or, with ExternalStyles, a <link> tag to
+// the stored stylesheet, preceded by the critical CSS set with MarkCritical.
+//
+// As in Execute, the CSS of the templates set with AlwaysInclude and of the
+// components referenced by the default layout is included. The scoped CSS
+// computed while parsing is reused, so components with dynamic CSS, which
+// depends on the render data, are rejected, as are unknown names.
+func (ts *TemplateSet) HeadAssets(templateNames ...string) (template.HTML, error) {
+	ts.renderMu.Lock()
+	defer ts.renderMu.Unlock()
+
+	ts.mu.Lock()
+	split := ts.stylesPath != ""
+	always, err := ts.resetUsed(ts.layoutUses[ts.layoutName])
+	if err != nil {
+		ts.mu.Unlock()
+		return "", err
+	}
+	for _, t := range always {
+		if t.cssTmpl != nil {
+			ts.mu.Unlock()
+			return "", fmt.Errorf("template %s has dynamic CSS, which depends on the render data", t.Name)
+		}
+	}
+	for _, name := range templateNames {
+		name = strings.TrimSuffix(name, ".html")
+		t, ok := ts.templates[name]
+		if !ok {
+			ts.mu.Unlock()
+			return "", fmt.Errorf("template %s not found", name)
+		}
+		if t.cssTmpl != nil {
+			ts.mu.Unlock()
+			return "", fmt.Errorf("template %s has dynamic CSS, which depends on the render data", name)
+		}
+		ts.markUsed(name)
+	}
+	ts.mu.Unlock()
+
+	critical, css, _, err := ts.collectSplitAssets(nil, nil, split, "")
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	if critical != "" {
+		b.WriteString("<style>" + critical + "</style>\n")
+	}
+	if href := template.HTMLEscapeString(ts.storeStylesheet(css)); href != "" {
+		if critical != "" {
+			b.WriteString(`<link rel="stylesheet" href="` + href + `" media="print" onload="this.media='all'">`)
+			b.WriteString(`<noscript><link rel="stylesheet" href="` + href + `"></noscript>` + "\n")
+		} else {
+			b.WriteString(`<link rel="stylesheet" href="` + href + `">` + "\n")
+		}
+	} else if css != "" {
+		b.WriteString("<style>" + css + "</style>\n")
+	}
+	return template.HTML(b.String()), nil
+}
+
+// AssetHandler returns a handler that serves the stylesheets stored by
+// ExternalStyles by file name. Mount it under the same base path, removing the
+// prefix:
+//
+//	http.Handle("/assets/", http.StripPrefix("/assets/", ts.AssetHandler()))
+//
+// Since the names are derived from the content, the responses are cached as
+// immutable.
+func (ts *TemplateSet) AssetHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ts.mu.Lock()
+		content, ok := ts.assets[strings.TrimPrefix(r.URL.Path, "/")]
+		ts.mu.Unlock()
+
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/css; charset=utf-8")
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		w.Write(content)
+	})
+}
+
+// storeStylesheet stores css for AssetHandler and returns its URL, or an empty
+// string when external styles are disabled or there is no CSS.
+func (ts *TemplateSet) storeStylesheet(css string) string {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.stylesPath == "" || css == "" {
+		return ""
+	}
+	hash := sha256.Sum256([]byte(css))
+	name := fmt.Sprintf("%x.css", hash[:8])
+	if _, ok := ts.assets[name]; !ok {
+		ts.assets[name] = []byte(css)
+	}
+	return ts.stylesPath + name
+}
+
+// ExecuteAuto renders a template as an HTTP response, choosing the output from
+// the request: HTMX requests (with the "HX-Request: true" header) receive only
+// the fragment with its CSS and JS inlined, as written by ExecuteFragment, while
+// other requests receive the full page with the default layout through
+// ExecuteHTTP. Boosted requests ("HX-Boosted: true") swap the whole body and
+// therefore also receive the full page.
+func (ts *TemplateSet) ExecuteAuto(w http.ResponseWriter, r *http.Request, name string, data interface{}) error {
+	w.Header().Add("Vary", "HX-Request")
+
+	if r.Header.Get("HX-Request") != "true" || r.Header.Get("HX-Boosted") == "true" {
+		return ts.ExecuteHTTP(w, r, name, data)
+	}
+
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	}
+	return ts.ExecuteFragment(w, name, data, nil)
+}
+
+// debugComponent is a row of the page served by DebugHandler
+type debugComponent struct {
+	Name       string
+	Source     string
+	ScopeClass string
+	CSSBytes   int
+	JSBytes    int
+	Uses       []string
+	UsedBy     []string
+}
+
+var debugPage = template.Must(template.New("debug").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>skingo components</title>
+	<style>
+		body { font-family: sans-serif; margin: 2rem; }
+		table { border-collapse: collapse; }
+		th, td { border: 1px solid #ccc; padding: 0.25rem 0.5rem; text-align: left; vertical-align: top; }
+	</style>
+</head>
+<body>
+	<h1>Components</h1>
+	<p>{{ .Stats.Components }} components, {{ .Stats.Layouts }} layouts, {{ .Stats.CSSBytes }} bytes of CSS, {{ .Stats.JSBytes }} bytes of JS</p>
+	<table>
+		<tr><th>Name</th><th>Source</th><th>Scope class</th><th>CSS bytes</th><th>JS bytes</th><th>Uses</th><th>Used by</th></tr>
+		{{- range .Components }}
+		<tr><td>{{ .Name }}</td><td>{{ .Source }}</td><td>{{ .ScopeClass }}</td><td>{{ .CSSBytes }}</td><td>{{ .JSBytes }}</td>` +
+	`<td>{{ range $i, $name := .Uses }}{{ if $i }}, {{ end }}{{ $name }}{{ end }}</td>` +
+	`<td>{{ range $i, $name := .UsedBy }}{{ if $i }}, {{ end }}{{ $name }}{{ end }}</td></tr>
+		{{- end }}
+	</table>
+</body>
+</html>
+`))
+
+// DebugHandler returns a handler that serves a page listing the parsed
+// components with their source files, scope classes, CSS and JS sizes and the
+// templates and layouts that use them, which helps understanding a component
+// library while developing. The relationships come from the literal names
+// given to comp, compJoin and include, so names given by expressions are not
+// listed.
+//
+// The page is only served when the set was created with WithDevMode(true);
+// otherwise the handler responds with 404 Not Found, so it is not exposed in
+// production even when mounted.
+func (ts *TemplateSet) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ts.mu.Lock()
+		devMode := ts.devMode
+		ts.mu.Unlock()
+
+		if !devMode {
+			http.NotFound(w, r)
+			return
+		}
+
+		// The page is rendered apart, so a failure can still be answered with a 500
+		var page bytes.Buffer
+		err := debugPage.Execute(&page, map[string]interface{}{
+			"Stats":      ts.Stats(),
+			"Components": ts.debugComponents(),
+		})
+		if err != nil {
+			ts.log().Error("error rendering debug page", "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		page.WriteTo(w)
+	})
+}
+
+// debugComponents returns the rows of the page served by DebugHandler, sorted
+// by name.
+func (ts *TemplateSet) debugComponents() []debugComponent {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	sources := make(map[string]string, len(ts.templateHTML)+len(ts.layouts))
+	for name, html := range ts.templateHTML {
+		sources[name] = html
+	}
+	for name, layout := range ts.layouts {
+		sources[name] = layout.HTML
+	}
+
+	uses := make(map[string][]string)
+	usedBy := make(map[string][]string)
+	for name, source := range sources {
+		for _, ref := range ts.componentRefs(source) {
+			used := strings.TrimSuffix(ref.name, ".html")
+			if !slices.Contains(uses[name], used) {
+				uses[name] = append(uses[name], used)
+				usedBy[used] = append(usedBy[used], name)
+			}
+		}
+	}
+
+	components := make([]debugComponent, 0, len(ts.templates))
+	for name, t := range ts.templates {
+		sort.Strings(uses[name])
+		sort.Strings(usedBy[name])
+		components = append(components, debugComponent{
+			Name:       name,
+			Source:     ts.sources[name],
+			ScopeClass: t.scopeClass,
+			CSSBytes:   len(t.CSS),
+			JSBytes:    len(t.JS),
+			Uses:       uses[name],
+			UsedBy:     usedBy[name],
+		})
+	}
+	sort.Slice(components, func(i, j int) bool { return components[i].Name < components[j].Name })
+	return components
+}
@@ -0,0 +1,444 @@
+package skingo
+
+import (
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	cssCommentRegex = regexp.MustCompile(`(?s)/\*.*?\*/`)
+	tagRegex        = regexp.MustCompile(`(?s)<(/?)([a-zA-Z][a-zA-Z0-9-]*)((?:[^>"']|"[^"]*"|'[^']*')*)>`)
+	attrRegex       = regexp.MustCompile(`([^\s=/>]+)(?:\s*=\s*("[^"]*"|'[^']*'|[^\s>]+))?`)
+	compoundRegex   = regexp.MustCompile(`^(\*|[a-zA-Z][a-zA-Z0-9-]*)?((?:[.#][a-zA-Z0-9_-]+)*)$`)
+	simpleRegex     = regexp.MustCompile(`[.#][^.#]+`)
+	styleAttrRegex  = regexp.MustCompile(`(?i)\sstyle\s*=\s*("[^"]*"|'[^']*'|[^\s>]+)`)
+)
+
+// voidElements are the HTML elements that never have a closing tag
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true, "img": true,
+	"input": true, "link": true, "meta": true, "source": true, "track": true, "wbr": true,
+}
+
+// cssRule is a single style rule with one selector
+type cssRule struct {
+	selector     []compoundSelector
+	declarations []cssDeclaration
+	specificity  [3]int
+	order        int
+}
+
+// compoundSelector is a part of a selector such as "div.card#main", together
+// with the combinator that links it to the previous part (" " or ">").
+type compoundSelector struct {
+	combinator string
+	tag        string
+	id         string
+	classes    []string
+}
+
+type cssDeclaration struct {
+	property  string
+	value     string
+	important bool
+}
+
+// element is an open HTML element while inlining
+type element struct {
+	tag     string
+	id      string
+	classes []string
+}
+
+// ExecuteEmail renders a template like ExecuteStandalone, but applies the CSS
+// of the used components directly to the matching elements as inline style
+// attributes, as required by most email clients. No JS is included.
+//
+// The inliner is intentionally conservative. Only selectors made of type,
+// class, id and universal selectors combined with descendant or child (">")
+// combinators are inlined. Rules with pseudo-classes, pseudo-elements,
+// attribute selectors or sibling combinators (such as ":hover", "[href]",
+// "+" and "~"), as well as at-rules like @media, are kept in a <style> block
+// for the clients that support it.
+//
+// Declarations are applied in order of specificity and then source order.
+// Existing style attributes always win over the inlined rules, unless the rule
+// declaration is marked as !important.
+func (ts *TemplateSet) ExecuteEmail(w io.Writer, name string, data interface{}) error {
+	ts.renderMu.Lock()
+	defer ts.renderMu.Unlock()
+
+	content, err := ts.render(name, data, nil)
+	if err != nil {
+		return err
+	}
+	css, _, err := ts.collectAssets(nil)
+	if err != nil {
+		return err
+	}
+
+	inlined, remaining := inlineCSS(content, css)
+	return writePageAssets(ts.limit(w), inlined, remaining, "", "")
+}
+
+// inlineCSS applies the supported rules of css to the elements of content as
+// style attributes. It returns the new content and the CSS that could not be
+// inlined.
+func inlineCSS(content string, css string) (string, string) {
+	rules, remaining := parseInlineRules(css)
+	if len(rules) == 0 {
+		return content, remaining
+	}
+
+	var out strings.Builder
+	var stack []element
+	last := 0
+
+	for _, loc := range tagRegex.FindAllStringSubmatchIndex(content, -1) {
+		if loc[0] < last {
+			// Inside a raw text element that was skipped
+			continue
+		}
+
+		closing := content[loc[2]:loc[3]] == "/"
+		tag := strings.ToLower(content[loc[4]:loc[5]])
+		attrs := content[loc[6]:loc[7]]
+
+		if closing {
+			for i := len(stack) - 1; i >= 0; i-- {
+				if stack[i].tag == tag {
+					stack = stack[:i]
+					break
+				}
+			}
+			continue
+		}
+
+		el := element{tag: tag}
+		style := ""
+		hasStyle := false
+		for _, attr := range attrRegex.FindAllStringSubmatch(attrs, -1) {
+			value := strings.Trim(attr[2], `"'`)
+			switch strings.ToLower(attr[1]) {
+			case "id":
+				el.id = value
+			case "class":
+				el.classes = strings.Fields(value)
+			case "style":
+				style = value
+				hasStyle = true
+			}
+		}
+
+		var matched []cssRule
+		for _, rule := range rules {
+			if matchSelector(rule.selector, len(rule.selector)-1, el, stack) {
+				matched = append(matched, rule)
+			}
+		}
+
+		if len(matched) > 0 {
+			out.WriteString(content[last:loc[0]])
+			out.WriteString(rewriteStyleAttr(content[loc[0]:loc[1]], tag, attrs, hasStyle, mergeDeclarations(matched, style)))
+			last = loc[1]
+		}
+
+		selfClosing := strings.HasSuffix(strings.TrimSpace(attrs), "/")
+		if tag == "script" || tag == "style" {
+			// Skip raw text so its content is not treated as markup
+			if end := strings.Index(strings.ToLower(content[loc[1]:]), "</"+tag); end != -1 {
+				out.WriteString(content[last : loc[1]+end])
+				last = loc[1] + end
+			}
+		} else if !voidElements[tag] && !selfClosing {
+			stack = append(stack, el)
+		}
+	}
+	out.WriteString(content[last:])
+
+	return out.String(), remaining
+}
+
+// parseInlineRules splits css into rules that can be inlined and the CSS that
+// must be kept in a <style> block.
+func parseInlineRules(css string) ([]cssRule, string) {
+	css = cssCommentRegex.ReplaceAllString(css, "")
+
+	var rules []cssRule
+	var remaining strings.Builder
+
+	for len(strings.TrimSpace(css)) > 0 {
+		open := strings.Index(css, "{")
+		if open == -1 {
+			break
+		}
+		// Find the matching closing brace
+		depth := 0
+		end := -1
+		for i := open; i < len(css); i++ {
+			if css[i] == '{' {
+				depth++
+			} else if css[i] == '}' {
+				depth--
+				if depth == 0 {
+					end = i
+					break
+				}
+			}
+		}
+		if end == -1 {
+			break
+		}
+
+		prelude := strings.TrimSpace(css[:open])
+		body := css[open+1 : end]
+		css = css[end+1:]
+
+		if strings.HasPrefix(prelude, "@") {
+			remaining.WriteString(prelude + " {" + body + "}\n")
+			continue
+		}
+
+		declarations := parseDeclarations(body)
+		var unsupported []string
+		for _, selector := range strings.Split(prelude, ",") {
+			selector = strings.TrimSpace(selector)
+			if selector == "" {
+				continue
+			}
+			compounds, ok := parseSelector(selector)
+			if !ok {
+				unsupported = append(unsupported, selector)
+				continue
+			}
+			rules = append(rules, cssRule{
+				selector:     compounds,
+				declarations: declarations,
+				specificity:  selectorSpecificity(compounds),
+				order:        len(rules),
+			})
+		}
+		if len(unsupported) > 0 {
+			remaining.WriteString(strings.Join(unsupported, ", ") + " {" + body + "}\n")
+		}
+	}
+
+	return rules, remaining.String()
+}
+
+// parseSelector parses a selector supported by the inliner
+func parseSelector(selector string) ([]compoundSelector, bool) {
+	selector = strings.ReplaceAll(selector, ">", " > ")
+
+	var compounds []compoundSelector
+	combinator := " "
+	for _, part := range strings.Fields(selector) {
+		if part == ">" {
+			if len(compounds) == 0 || combinator == ">" {
+				return nil, false
+			}
+			combinator = ">"
+			continue
+		}
+
+		match := compoundRegex.FindStringSubmatch(part)
+		if match == nil {
+			return nil, false
+		}
+
+		compound := compoundSelector{combinator: combinator, tag: strings.ToLower(match[1])}
+		if compound.tag == "*" {
+			compound.tag = ""
+		}
+		for _, simple := range simpleRegex.FindAllString(match[2], -1) {
+			if simple[0] == '#' {
+				compound.id = simple[1:]
+			} else {
+				compound.classes = append(compound.classes, simple[1:])
+			}
+		}
+		compounds = append(compounds, compound)
+		combinator = " "
+	}
+
+	if len(compounds) == 0 || combinator == ">" {
+		return nil, false
+	}
+	return compounds, true
+}
+
+// selectorSpecificity returns the count of ids, classes and types
+func selectorSpecificity(compounds []compoundSelector) [3]int {
+	var specificity [3]int
+	for _, compound := range compounds {
+		if compound.id != "" {
+			specificity[0]++
+		}
+		specificity[1] += len(compound.classes)
+		if compound.tag != "" {
+			specificity[2]++
+		}
+	}
+	return specificity
+}
+
+// matchSelector reports whether compounds[:index+1] matches el, given its
+// open ancestors.
+func matchSelector(compounds []compoundSelector, index int, el element, ancestors []element) bool {
+	compound := compounds[index]
+	if !matchCompound(compound, el) {
+		return false
+	}
+	if index == 0 {
+		return true
+	}
+
+	if compound.combinator == ">" {
+		if len(ancestors) == 0 {
+			return false
+		}
+		parent := ancestors[len(ancestors)-1]
+		return matchSelector(compounds, index-1, parent, ancestors[:len(ancestors)-1])
+	}
+
+	for i := len(ancestors) - 1; i >= 0; i-- {
+		if matchSelector(compounds, index-1, ancestors[i], ancestors[:i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchCompound(compound compoundSelector, el element) bool {
+	if compound.tag != "" && compound.tag != el.tag {
+		return false
+	}
+	if compound.id != "" && compound.id != el.id {
+		return false
+	}
+	for _, class := range compound.classes {
+		found := false
+		for _, elClass := range el.classes {
+			if elClass == class {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// parseDeclarations splits a declaration block into its declarations
+func parseDeclarations(body string) []cssDeclaration {
+	var declarations []cssDeclaration
+	for _, part := range splitDeclarations(body) {
+		property, value, ok := strings.Cut(part, ":")
+		if !ok {
+			continue
+		}
+		property = strings.ToLower(strings.TrimSpace(property))
+		value = strings.TrimSpace(value)
+		if property == "" || value == "" {
+			continue
+		}
+
+		important := false
+		if i := strings.Index(strings.ToLower(value), "!important"); i != -1 {
+			important = true
+			value = strings.TrimSpace(value[:i])
+		}
+		declarations = append(declarations, cssDeclaration{property: property, value: value, important: important})
+	}
+	return declarations
+}
+
+// splitDeclarations splits body on the semicolons outside parentheses and
+// quotes, so values such as url(data:image/svg+xml;base64,...) stay whole.
+func splitDeclarations(body string) []string {
+	var parts []string
+	var quote byte
+	depth, start := 0, 0
+	for i := 0; i < len(body); i++ {
+		switch c := body[i]; {
+		case c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+		case c == ';' && depth == 0:
+			parts = append(parts, body[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, body[start:])
+}
+
+// mergeDeclarations computes the final inline style for the matched rules and
+// the style attribute already present on the element.
+func mergeDeclarations(matched []cssRule, existing string) string {
+	sort.SliceStable(matched, func(i, j int) bool {
+		a, b := matched[i].specificity, matched[j].specificity
+		if a != b {
+			return a[0] < b[0] || (a[0] == b[0] && (a[1] < b[1] || (a[1] == b[1] && a[2] < b[2])))
+		}
+		return matched[i].order < matched[j].order
+	})
+
+	var normal, important []cssDeclaration
+	for _, rule := range matched {
+		for _, declaration := range rule.declarations {
+			if declaration.important {
+				important = append(important, declaration)
+			} else {
+				normal = append(normal, declaration)
+			}
+		}
+	}
+
+	// Cascade order: rules, existing inline style, then !important rules
+	cascade := append(normal, parseDeclarations(existing)...)
+	cascade = append(cascade, important...)
+
+	values := make(map[string]string)
+	var properties []string
+	for _, declaration := range cascade {
+		if _, seen := values[declaration.property]; !seen {
+			properties = append(properties, declaration.property)
+		}
+		values[declaration.property] = declaration.value
+	}
+
+	parts := make([]string, 0, len(properties))
+	for _, property := range properties {
+		parts = append(parts, property+": "+values[property])
+	}
+	return strings.Join(parts, "; ")
+}
+
+// rewriteStyleAttr returns the start tag with its style attribute replaced
+func rewriteStyleAttr(tagHTML, tag, attrs string, hasStyle bool, style string) string {
+	style = strings.ReplaceAll(style, `"`, "&quot;")
+
+	if hasStyle {
+		attrs = styleAttrRegex.ReplaceAllString(attrs, "")
+	}
+
+	trimmed := strings.TrimRight(attrs, " \t\n/")
+	closing := ">"
+	if strings.HasSuffix(strings.TrimSpace(attrs), "/") {
+		closing = " />"
+	}
+	return "<" + tagHTML[1:1+len(tag)] + trimmed + ` style="` + style + `"` + closing
+}
@@ -0,0 +1,87 @@
+package skingo
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// LintWarning describes a likely mistake found in a component by Lint
+type LintWarning struct {
+	Template string // Name of the template
+	Selector string // Selector that caused the warning
+	Message  string // Description of the problem and how to fix it
+}
+
+// String formats the warning as "template: message"
+func (w LintWarning) String() string {
+	return w.Template + ": " + w.Message
+}
+
+// Lint checks the parsed templates for common mistakes and returns a warning
+// for each one, sorted by template name. It currently reports selectors of
+// scoped <style> blocks that target the page rather than the component, such
+// as body, html, :root or a lone *, which are scoped to the component and so
+// never match what they were meant to. Such rules belong in <style global>.
+func (ts *TemplateSet) Lint() []LintWarning {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	names := make([]string, 0, len(ts.templates))
+	for name := range ts.templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var warnings []LintWarning
+	for _, name := range names {
+		for _, selector := range ts.templates[name].leaks {
+			warnings = append(warnings, LintWarning{
+				Template: name,
+				Selector: selector,
+				Message:  fmt.Sprintf("selector %q is scoped to the component and does not match the page, use <style global> for global styles", selector),
+			})
+		}
+	}
+	return warnings
+}
+
+// leakingSelectors returns the selectors of css whose first compound targets
+// the page: the html and body elements, :root, or * on its own.
+func leakingSelectors(css string) []string {
+	var leaks []string
+	scopeRules(css, func(selectors, declarations string) string {
+		for _, selector := range strings.Split(selectors, ",") {
+			selector = strings.TrimSpace(selector)
+			if selector != "" && targetsPage(selector) {
+				leaks = append(leaks, selector)
+			}
+		}
+		return ""
+	})
+	return leaks
+}
+
+// targetsPage reports whether a selector starts with html, body or :root, or
+// is the universal selector, optionally followed by pseudo-elements
+func targetsPage(selector string) bool {
+	selector = strings.ToLower(selector)
+	if strings.HasPrefix(selector, ":root") {
+		return true
+	}
+	end := compoundEnd(selector)
+	for strings.HasPrefix(selector[end:], "::") {
+		end += 2 + compoundEnd(selector[end+2:])
+	}
+	tag := strings.TrimLeft(selector[:compoundEnd(selector)], " ")
+	if i := strings.IndexAny(tag, ".#["); i != -1 {
+		tag = tag[:i]
+	}
+	switch tag {
+	case "html", "body":
+		return true
+	case "*":
+		return end == len(selector)
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+package skingo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+var (
+	errIntOverflow    = errors.New("integer overflow")
+	errDivisionByZero = errors.New("integer division by zero")
+)
+
+// number is a numeric template argument, either an integer or a float
+type number struct {
+	i       int64
+	f       float64
+	isFloat bool
+}
+
+// toNumber converts a numeric value of any integer or float type, including
+// json.Number, to a number. Other values, nil included, are rejected.
+func toNumber(v interface{}) (number, error) {
+	if n, ok := v.(json.Number); ok {
+		if i, err := n.Int64(); err == nil {
+			return number{i: i}, nil
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return number{}, fmt.Errorf("expected a number, got %q", n)
+		}
+		return number{f: f, isFloat: true}, nil
+	}
+
+	value := reflect.ValueOf(v)
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return number{i: value.Int()}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := value.Uint()
+		if u > math.MaxInt64 {
+			return number{}, fmt.Errorf("number %d overflows int64", u)
+		}
+		return number{i: int64(u)}, nil
+	case reflect.Float32, reflect.Float64:
+		return number{f: value.Float(), isFloat: true}, nil
+	case reflect.Invalid:
+		return number{}, fmt.Errorf("expected a number, got nil")
+	}
+	return number{}, fmt.Errorf("expected a number, got %T", v)
+}
+
+func (n number) float() float64 {
+	if n.isFloat {
+		return n.f
+	}
+	return float64(n.i)
+}
+
+// arithmetic returns a template function operating on two numbers. When both
+// are integers, the result of intOp is returned as an int; otherwise both are
+// converted to float64 and floatOp is used.
+func arithmetic(name string, intOp func(a, b int64) (int64, error), floatOp func(a, b float64) float64) func(a, b interface{}) (interface{}, error) {
+	return func(a, b interface{}) (interface{}, error) {
+		x, err := toNumber(a)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		y, err := toNumber(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+
+		if x.isFloat || y.isFloat {
+			return floatOp(x.float(), y.float()), nil
+		}
+		result, err := intOp(x.i, y.i)
+		if err == nil && (result < math.MinInt || result > math.MaxInt) {
+			err = errIntOverflow
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s %d %d: %w", name, x.i, y.i, err)
+		}
+		return int(result), nil
+	}
+}
+
+// floatArithmetic returns a template function operating on two numbers of any
+// numeric type, converted to float64.
+func floatArithmetic(name string, op func(a, b float64) float64) func(a, b interface{}) (float64, error) {
+	return func(a, b interface{}) (float64, error) {
+		x, err := toNumber(a)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", name, err)
+		}
+		y, err := toNumber(b)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", name, err)
+		}
+		return op(x.float(), y.float()), nil
+	}
+}
+
+func addInt(a, b int64) (int64, error) {
+	if r := a + b; (r > a) == (b > 0) {
+		return r, nil
+	}
+	return 0, errIntOverflow
+}
+
+func subInt(a, b int64) (int64, error) {
+	if r := a - b; (r < a) == (b > 0) {
+		return r, nil
+	}
+	return 0, errIntOverflow
+}
+
+func mulInt(a, b int64) (int64, error) {
+	if a == 0 || b == 0 {
+		return 0, nil
+	}
+	if r := a * b; r/b == a && !(a == -1 && b == math.MinInt64) && !(b == -1 && a == math.MinInt64) {
+		return r, nil
+	}
+	return 0, errIntOverflow
+}
+
+func divInt(a, b int64) (int64, error) {
+	switch b {
+	case 0:
+		return 0, errDivisionByZero
+	case -1:
+		return subInt(0, a)
+	}
+	return a / b, nil
+}
+
+func modInt(a, b int64) (int64, error) {
+	switch b {
+	case 0:
+		return 0, errDivisionByZero
+	case -1:
+		return 0, nil
+	}
+	return a % b, nil
+}
@@ -0,0 +1,38 @@
+package skingo
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// RenderNode renders a parsed template like ExecuteFragment, without a layout
+// and with the CSS and JS of every used component, and parses the output into
+// an HTML node tree, so tests can assert on the structure of a component, such
+// as its elements and classes, instead of comparing strings.
+//
+// The returned node is a document node whose children are the nodes of the
+// fragment, parsed as the content of a <body> element: the <style> block, the
+// rendered template and the <script> block.
+func (ts *TemplateSet) RenderNode(name string, data interface{}) (*html.Node, error) {
+	var b strings.Builder
+	if err := ts.ExecuteFragment(&b, name, data, nil); err != nil {
+		return nil, err
+	}
+
+	nodes, err := html.ParseFragment(strings.NewReader(b.String()), &html.Node{
+		Type:     html.ElementNode,
+		Data:     "body",
+		DataAtom: atom.Body,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	root := &html.Node{Type: html.DocumentNode}
+	for _, node := range nodes {
+		root.AppendChild(node)
+	}
+	return root, nil
+}
@@ -0,0 +1,118 @@
+package skingo
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Option configures a TemplateSet created with NewTemplateSetWithOptions
+type Option func(*TemplateSet)
+
+// ScopeStrategy defines how the scope classes of the components are named
+type ScopeStrategy int
+
+const (
+	ScopeHashed   ScopeStrategy = iota // Classes derived from a hash of the template name (default)
+	ScopeReadable                      // Classes derived from the template name, as with ReadableScopes
+)
+
+// WithDelims sets the action delimiters of the templates and layouts, for
+// example "[[" and "]]" for markup that also contains the {{ }} of a client-side
+// framework. The default delimiters found in the markup are then written
+// literally, while the script blocks of the components keep being plain
+// JavaScript where only the ScopeClass action is replaced. The CSS is parsed
+// with the delimiters only when DynamicCSS is enabled. Empty delimiters keep
+// the default ones.
+func WithDelims(left, right string) Option {
+	return func(ts *TemplateSet) {
+		if left == "" || right == "" {
+			ts.leftDelim, ts.rightDelim = "", ""
+			return
+		}
+		ts.leftDelim, ts.rightDelim = left, right
+	}
+}
+
+// WithExtensions sets the file extensions parsed as templates by ParseDirs,
+// ParseFS and ParseSources, ".html" and ".tmpl" by default. Extensions are
+// given with their leading dot.
+func WithExtensions(extensions ...string) Option {
+	return func(ts *TemplateSet) {
+		ts.extensions = append([]string(nil), extensions...)
+	}
+}
+
+// WithScopeStrategy sets how the scope classes of the components are named
+func WithScopeStrategy(strategy ScopeStrategy) Option {
+	return func(ts *TemplateSet) {
+		ts.readable = strategy == ScopeReadable
+	}
+}
+
+// WithDevMode enables the options that help while developing: readable scope
+// classes, the data-component attributes of DebugAttributes and the page served
+// by DebugHandler. Since they expose the template names, it should be disabled
+// in production.
+func WithDevMode(enabled bool) Option {
+	return func(ts *TemplateSet) {
+		ts.readable = enabled
+		ts.debugAttrs = enabled
+		ts.devMode = enabled
+	}
+}
+
+// hasExtension reports whether files with the extension ext are parsed
+func (ts *TemplateSet) hasExtension(ext string) bool {
+	for _, extension := range ts.extensions {
+		if ext == extension {
+			return true
+		}
+	}
+	return false
+}
+
+// convertDelims rewrites the actions of s written with the delimiters set with
+// WithDelims to the default ones used internally. When escape is set, the
+// default delimiters found in the text are turned into actions printing them,
+// so they are written literally once parsed.
+func (ts *TemplateSet) convertDelims(s string, escape bool) string {
+	left, right := ts.leftDelim, ts.rightDelim
+	if left == "" {
+		return s
+	}
+
+	text := func(text string) string {
+		if !escape {
+			return text
+		}
+		return strings.ReplaceAll(text, "{{", `{{"{{"}}`)
+	}
+
+	var b strings.Builder
+	for {
+		start := strings.Index(s, left)
+		if start == -1 {
+			break
+		}
+		end := strings.Index(s[start+len(left):], right)
+		if end == -1 {
+			break
+		}
+		end += start + len(left)
+
+		b.WriteString(text(s[:start]))
+		b.WriteString("{{" + s[start+len(left):end] + "}}")
+		s = s[end+len(right):]
+	}
+	b.WriteString(text(s))
+	return b.String()
+}
+
+// scopeVarRegex returns the regex of the ScopeClass action in the component
+// scripts, written with the delimiters set with WithDelims.
+func (ts *TemplateSet) scopeVarRegex() *regexp.Regexp {
+	if ts.leftDelim == "" {
+		return scopeVarRegex
+	}
+	return regexp.MustCompile(regexp.QuoteMeta(ts.leftDelim) + `-?\s*\.ScopeClass\s*-?` + regexp.QuoteMeta(ts.rightDelim))
+}
@@ -0,0 +1,94 @@
+package skingo
+
+import (
+	"context"
+	"fmt"
+)
+
+// Plugin extends a TemplateSet with hooks into the parse and render stages,
+// registered with Use. A plugin is any value implementing ParsePlugin,
+// RenderPlugin or both, so it only provides the hooks it needs.
+type Plugin interface{}
+
+// ParsePlugin is implemented by plugins that inspect or change each template
+// once its file is processed, before it is stored. The exported fields of t can
+// be modified: HTML is the scoped markup, CSS the scoped CSS and JS the
+// combined JS of the component.
+type ParsePlugin interface {
+	OnParse(t *Template)
+}
+
+// RenderPlugin is implemented by plugins that inspect or change the HTML of
+// each render before the CSS and JS are added and the layout is applied.
+type RenderPlugin interface {
+	OnRender(rc *RenderContext)
+}
+
+// RenderContext describes a render in progress and is passed to OnRender.
+type RenderContext struct {
+	Context  context.Context // Context of the render, given to ExecuteContext
+	Template string          // Name of the rendered template
+	Data     interface{}     // Data given to the render
+	Used     []string        // Templates used in the render, in order of first use
+	HTML     string          // Rendered HTML, which the plugin may replace
+}
+
+// Use registers plugins, which are called in the order they were registered.
+// A nil plugin is ignored. It returns an error, and registers none of the
+// plugins, when one of them implements neither ParsePlugin nor RenderPlugin.
+//
+// Note: This method should be called before ParseDirs, ParseFS or ParseSources.
+func (ts *TemplateSet) Use(plugins ...Plugin) error {
+	for i, plugin := range plugins {
+		_, parse := plugin.(ParsePlugin)
+		_, render := plugin.(RenderPlugin)
+		if plugin != nil && !parse && !render {
+			return fmt.Errorf("plugin %d (%T) implements neither ParsePlugin nor RenderPlugin", i+1, plugin)
+		}
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for _, plugin := range plugins {
+		if plugin != nil {
+			ts.plugins = append(ts.plugins, plugin)
+		}
+	}
+	return nil
+}
+
+// onParse calls the parse plugins with t
+func (ts *TemplateSet) onParse(t *Template) {
+	for _, plugin := range ts.plugins {
+		if p, ok := plugin.(ParsePlugin); ok {
+			p.OnParse(t)
+		}
+	}
+}
+
+// onRender calls the render plugins with the rendered content and returns the
+// resulting HTML.
+func (ts *TemplateSet) onRender(name string, data interface{}, content string) string {
+	ts.mu.Lock()
+	plugins := ts.plugins
+	used := append([]string(nil), ts.usedOrder...)
+	ts.mu.Unlock()
+
+	if len(plugins) == 0 {
+		return content
+	}
+
+	rc := &RenderContext{
+		Context:  ts.renderContext(),
+		Template: name,
+		Data:     data,
+		Used:     used,
+		HTML:     content,
+	}
+	for _, plugin := range plugins {
+		if p, ok := plugin.(RenderPlugin); ok {
+			p.OnRender(rc)
+		}
+	}
+	return rc.HTML
+}
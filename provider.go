@@ -0,0 +1,294 @@
+package skingo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"strings"
+	"sync"
+)
+
+// DataProvider loads the data of a component registered with RegisterProvider.
+// It receives the arguments passed to comp, if any, and its result becomes the
+// component data.
+type DataProvider func(ctx context.Context, args []interface{}) (interface{}, error)
+
+// RegisterProvider makes the named component load its own data, so a widget
+// such as "recent posts" can be placed with a plain {{ comp "recentPosts" }}.
+// Each time the component is rendered, provider is called with the arguments
+// passed to comp (which it may use as parameters, such as the number of posts)
+// and its result is used as the component data: a map[string]interface{} is
+// accessed as {{ .key }} and any other value as in a typed component. An error
+// returned by provider fails the render.
+//
+// The context is the one given to ExecuteContext, or context.Background() for
+// the other renders, and is done once the timeout set with SetRenderTimeout
+// expires. A component cached with CacheComponent only calls its provider when
+// it is rendered again instead of served from the cache.
+func (ts *TemplateSet) RegisterProvider(name string, provider DataProvider) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.providers == nil {
+		ts.providers = make(map[string]DataProvider)
+	}
+	ts.providers[strings.TrimSuffix(name, ".html")] = provider
+}
+
+// provide returns the arguments of the named component, loaded by its provider
+// when one is registered. The returned bool reports whether they come from a
+// provider and must be used as-is.
+func (ts *TemplateSet) provide(name string, args []interface{}) ([]interface{}, bool, error) {
+	ts.mu.Lock()
+	provider := ts.providers[name]
+	ts.mu.Unlock()
+
+	if provider == nil {
+		return args, false, nil
+	}
+
+	// A region rendered by ExecuteParallel uses the data its provider loaded
+	ctx := ts.renderContext()
+	if loaded, ok := ctx.Value(regionsKey{}).(map[string]interface{}); ok && len(args) == 0 {
+		if data, ok := loaded[name]; ok {
+			return []interface{}{data}, true, nil
+		}
+	}
+
+	data, err := provider(ctx, args)
+	if err != nil {
+		ts.log().Error("data provider failed", "template", name, "error", err)
+		return nil, false, fmt.Errorf("data provider of component %s: %w", name, err)
+	}
+	return []interface{}{data}, true, nil
+}
+
+// regionsKey is the context key of the region data loaded by ExecuteParallel
+type regionsKey struct{}
+
+// renderedKey is the context key of the regions rendered by ExecuteParallel
+type renderedKey struct{}
+
+// renderedRegions holds the regions rendered ahead of the page by
+// ExecuteParallel, set once every region has rendered
+type renderedRegions struct {
+	entries map[string]*cacheEntry
+}
+
+// ExecuteParallel renders a template with the default layout, like
+// ExecuteContext, after rendering the named region components concurrently,
+// each in its own goroutine. It speeds up pages with several independent
+// regions whose data is slow to load, such as the widgets of a dashboard:
+//
+//	err := ts.ExecuteParallel(ctx, w, "dashboard", data, "sales", "orders", "activity")
+//
+// Each goroutine calls the data provider of its region and renders the region
+// with that data into a buffer of its own, using a copy of the parsed templates
+// with its own component stack. The page is rendered once every region is
+// done, and the regions called without arguments use the HTML already
+// rendered, so each provider runs and each region renders once per render. The
+// templates and CSS used by a region are registered where the region appears
+// in the page, so the output is the same as with ExecuteContext. Since regions
+// are rendered apart from the page, parentParam returns nil in their root.
+//
+// When a provider or a region render fails, the context given to the others is
+// canceled and the page is not rendered. The returned error joins the errors of
+// the failed regions, in the order the regions were named. A region without a
+// provider is an error. The render timeout set with SetRenderTimeout covers the
+// regions and the page.
+func (ts *TemplateSet) ExecuteParallel(ctx context.Context, w io.Writer, name string, data interface{}, regions ...string) error {
+	rendered := &renderedRegions{}
+	ctx = context.WithValue(ctx, renderedKey{}, rendered)
+
+	ts.mu.Lock()
+	layoutName := ts.layoutName
+	cache := ts.pageCaches[strings.TrimSuffix(name, ".html")]
+	ts.mu.Unlock()
+
+	execute := func(w io.Writer) error {
+		return ts.executeTimed(ctx, w, name, func(w io.Writer) error {
+			return ts.observe(w, layoutName, name, func(w io.Writer) error {
+				entries, err := ts.renderRegions(ts.renderContext(), regions)
+				if err != nil {
+					return err
+				}
+				rendered.entries = entries
+				return ts.executeLayout(w, layoutName, name, data, nil, "")
+			})
+		})
+	}
+	if cache != nil {
+		return ts.executeCachedPage(ctx, w, cache, layoutName, data, execute)
+	}
+	return execute(w)
+}
+
+// renderedRegion returns the region rendered ahead by ExecuteParallel for a
+// call of the named component, or nil when there is none. Only calls without
+// arguments use it.
+func (ts *TemplateSet) renderedRegion(name string, args []interface{}) *cacheEntry {
+	if len(args) > 0 {
+		return nil
+	}
+	rendered, ok := ts.renderContext().Value(renderedKey{}).(*renderedRegions)
+	if !ok {
+		return nil
+	}
+	return rendered.entries[name]
+}
+
+// renderRegions calls the providers of the named components concurrently and
+// renders each component with its data, returning the rendered regions by
+// component name
+func (ts *TemplateSet) renderRegions(ctx context.Context, regions []string) (map[string]*cacheEntry, error) {
+	names := make([]string, len(regions))
+	providers := make([]DataProvider, len(regions))
+	ts.mu.Lock()
+	for i, region := range regions {
+		names[i] = strings.TrimSuffix(region, ".html")
+		providers[i] = ts.providers[names[i]]
+	}
+	ts.mu.Unlock()
+
+	for i, provider := range providers {
+		if provider == nil {
+			return nil, fmt.Errorf("region %s has no data provider", names[i])
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]*cacheEntry, len(names))
+	errs := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i, provider := range providers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, err := provider(ctx, nil)
+			if err != nil {
+				if !errors.Is(err, context.Canceled) {
+					ts.log().Error("data provider failed", "template", names[i], "error", err)
+				}
+				errs[i] = fmt.Errorf("data provider of component %s: %w", names[i], err)
+				cancel()
+				return
+			}
+			if results[i], errs[i] = ts.renderRegion(ctx, names[i], data); errs[i] != nil {
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The regions stopped by the cancellation are not reported as failed
+	var failed []error
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, context.Canceled) {
+			failed = append(failed, err)
+		}
+	}
+	if len(failed) > 0 {
+		return nil, errors.Join(failed...)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	rendered := make(map[string]*cacheEntry, len(names))
+	for i, name := range names {
+		rendered[name] = results[i]
+	}
+	return rendered, nil
+}
+
+// renderRegion renders the named region with data on a set of its own and
+// returns its HTML with the templates and CSS it used. The caller must hold
+// renderMu.
+func (ts *TemplateSet) renderRegion(ctx context.Context, name string, data interface{}) (*cacheEntry, error) {
+	ts.mu.Lock()
+	if ts.regionPool == nil {
+		ts.regionPool = &sync.Pool{}
+	}
+	pool := ts.regionPool
+	cancel := ts.renderCancel
+	ts.mu.Unlock()
+
+	worker, err := ts.regionWorker(pool)
+	if err != nil {
+		return nil, err
+	}
+	defer pool.Put(worker)
+
+	entry := &cacheEntry{css: make(map[string][]string)}
+	defer worker.setRenderContext(context.WithValue(ctx, regionsKey{}, map[string]interface{}{name: data}), cancel)()
+	worker.mu.Lock()
+	worker.recorders = []*cacheEntry{entry}
+	worker.mu.Unlock()
+
+	html, err := worker.renderComponent(name, nil)
+
+	worker.mu.Lock()
+	worker.recorders = nil
+	worker.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	entry.html = html
+	return entry, nil
+}
+
+// regionWorker returns a set from pool, or a new one parsed from the templates
+// of ts, configured to render a region like ts. Each worker has its own master
+// template, whose functions are bound to it, so workers render at once without
+// sharing a component stack or the used templates. The caller must hold
+// renderMu, so the templates do not change while the worker is created.
+func (ts *TemplateSet) regionWorker(pool *sync.Pool) (*TemplateSet, error) {
+	worker, _ := pool.Get().(*TemplateSet)
+	if worker == nil {
+		worker = ts.staging()
+		if err := worker.finalizeParsing(worker); err != nil {
+			return nil, err
+		}
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+
+	worker.providers = maps.Clone(ts.providers)
+	worker.compCaches = maps.Clone(ts.compCaches)
+	worker.exposeArgs = ts.exposeArgs
+	worker.maxOutput = ts.maxOutput
+	worker.basePath = ts.basePath
+	worker.assetOrder = ts.assetOrder
+	worker.logger = ts.logger
+	worker.usedTemplates = make(map[string]bool)
+	worker.usedOrder = nil
+	worker.renderedCSS = make(map[string][]string)
+	return worker, nil
+}
+
+// renderContext returns the context of the current render, given to
+// ExecuteContext, which is done once the render timeout expires.
+func (ts *TemplateSet) renderContext() context.Context {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.renderCtx != nil {
+		return ts.renderCtx
+	}
+	return context.Background()
+}
+
+// contextValue returns the value stored under key in the context of the
+// current render, looked up as a ContextKey and then as a plain string.
+func (ts *TemplateSet) contextValue(key string) interface{} {
+	ctx := ts.renderContext()
+	if value := ctx.Value(ContextKey(key)); value != nil {
+		return value
+	}
+	return ctx.Value(key)
+}
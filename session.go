@@ -0,0 +1,50 @@
+package skingo
+
+import (
+	"io"
+	"sync"
+)
+
+// RenderSession tracks the CSS and JS already written to a single response, so
+// fragments streamed into it one after another only carry the assets of the
+// components they introduce. Create one per response with NewRenderSession.
+type RenderSession struct {
+	ts      *TemplateSet
+	mu      sync.Mutex
+	styles  EmittedStyles
+	scripts map[string]bool
+	srcs    map[string]bool
+}
+
+// NewRenderSession returns a session for a new response
+func (ts *TemplateSet) NewRenderSession() *RenderSession {
+	return &RenderSession{
+		ts:      ts,
+		styles:  make(EmittedStyles),
+		scripts: make(map[string]bool),
+		srcs:    make(map[string]bool),
+	}
+}
+
+// RenderFragment renders a template without any layout, like ExecuteFragment,
+// writing the CSS of scope classes and the JS of templates that were not
+// written earlier in the session before and after the fragment.
+func (s *RenderSession) RenderFragment(w io.Writer, name string, data interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ts := s.ts
+	ts.renderMu.Lock()
+	defer ts.renderMu.Unlock()
+
+	content, err := ts.render(name, data, nil)
+	if err != nil {
+		return err
+	}
+	_, css, js, err := ts.collectSplitAssets(s.styles, s.scripts, false, "")
+	if err != nil {
+		return err
+	}
+
+	return writeInlineAssets(ts.limit(w), content, css, ts.externalScripts(s.srcs), js)
+}
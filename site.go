@@ -0,0 +1,57 @@
+package skingo
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// PageSpec describes a page written by RenderSite
+type PageSpec struct {
+	Path     string      // Output path, relative to the output directory
+	Template string      // Name of the rendered template
+	Data     interface{} // Data given to the template
+}
+
+// RenderToFile renders a template with the default layout, like Execute, and
+// writes the complete page to the file at path, creating its parent
+// directories. The page is rendered before the file is created, so a failed
+// render leaves no partial file behind.
+func (ts *TemplateSet) RenderToFile(path, name string, data interface{}) error {
+	var buf bytes.Buffer
+	if err := ts.Execute(&buf, name, data); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("error creating directory of %s: %w", path, err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("error writing %s: %w", path, err)
+	}
+	return nil
+}
+
+// RenderSite writes each page to its path inside outDir with RenderToFile,
+// which allows using skingo as a static site generator:
+//
+//	err := ts.RenderSite("public", []skingo.PageSpec{
+//		{Path: "index.html", Template: "home", Data: home},
+//		{Path: "blog/first-post/index.html", Template: "post", Data: post},
+//	})
+//
+// The CSS and JS of each page are inlined unless ExternalStyles is set. It
+// stops at the first page that fails, and paths that are absolute or leave
+// outDir are rejected.
+func (ts *TemplateSet) RenderSite(outDir string, pages []PageSpec) error {
+	for _, page := range pages {
+		if !filepath.IsLocal(page.Path) {
+			return fmt.Errorf("page path %q must be relative and inside the output directory", page.Path)
+		}
+		if err := ts.RenderToFile(filepath.Join(outDir, page.Path), page.Template, page.Data); err != nil {
+			return fmt.Errorf("error rendering page %s: %w", page.Path, err)
+		}
+	}
+	return nil
+}
@@ -1,17 +1,29 @@
 package skingo
 
 import (
+	"compress/gzip"
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"io/fs"
+	"log/slog"
+	"maps"
+	"math"
 	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 // Template represents a template with separate HTML, CSS and JS.
@@ -23,7 +35,18 @@ type Template struct {
 	CSS        string
 	JS         string
 	tmpl       *template.Template
+	cssTmpl    *template.Template // Set when DynamicCSS is enabled and the CSS contains template actions
 	scopeClass string
+	typed      bool              // Receives a single comp argument as-is, declared with <template typed>
+	parseOrder int               // Position in which the template was parsed
+	requires   []string          // Templates whose JS must run first, declared with <script data-requires="...">
+	critical   bool              // CSS is inlined even with ExternalStyles, declared with <style critical>
+	raw        string            // Markup as written, before scoping, rendered by the include function
+	original   string            // CSS as written, before scoping, returned by OriginalCSS
+	jsonLD     []string          // Structured data declared with <script type="application/ld+json">
+	scripts    []string          // Attributes of the external scripts, declared with <script src="...">
+	leaks      []string          // Scoped selectors that target the page, reported by Lint
+	blocks     map[string]string // Children of the component tags in the markup, by block name
 }
 
 // Layout represents a template for a layout
@@ -32,6 +55,12 @@ type Layout struct {
 	tmpl *template.Template
 }
 
+// compCall represents a component invocation on the call stack
+type compCall struct {
+	Args []interface{}
+	Name string
+}
+
 // TemplateSet represents a set of templates
 type TemplateSet struct {
 	templates     map[string]*Template
@@ -43,13 +72,81 @@ type TemplateSet struct {
 	templateHTML  map[string]string
 	mu            sync.Mutex
 	renderMu      sync.Mutex
+	parseMu       sync.Mutex                    // Serializes the Parse methods
 	usedTemplates map[string]bool               // Track which templates have been used
 	customFuncs   template.FuncMap              // Stores custom functions
 	isolatedCache map[string]*template.Template // Cache of isolated templates
 	cacheMu       sync.RWMutex                  // Specific mutex for cache
 	sources       map[string]string             // Tracks template sources to detect duplicate names
+	expected      map[string]bool               // Templates about to be parsed, known to component tags
+	compStack     []compCall                    // Component call stack for handling nested components
+	compMu        sync.Mutex                    // Specific mutex for the component call stack
+	readable      bool                          // Use readable scope classes instead of hashes
+	scopePrefix   string                        // Prefix of the scope classes, "s" when empty
+	scopeOwners   map[string]string             // Tracks which template owns each scope class
+	dynamicCSS    bool                          // Evaluate template actions inside <style> blocks per render
+	renderedCSS   map[string][]string           // CSS rendered for dynamic templates in the current render
+	maxOutput     int64                         // Maximum number of bytes a render may produce (0 means no limit)
+	observer      func(RenderEvent)             // Called at the end of each Execute when set
+	logger        *slog.Logger                  // Logs parse and render problems (no-op by default)
+	assetOrder    AssetOrder                    // Order in which CSS and JS of used templates are concatenated
+	usedOrder     []string                      // Used templates in the order of first use
+	parsed        int                           // Number of templates parsed so far
+	compression   int                           // Gzip level used by ExecuteHTTP
+	compCaches    map[string]*componentCache    // Caches of rendered components configured with CacheComponent
+	recorders     []*cacheEntry                 // Cache entries being filled by the components in progress
+	cssProcessor  AssetProcessor                // Transforms the combined CSS of each render
+	jsProcessor   AssetProcessor                // Transforms the combined JS of each render
+	processed     map[assetKey]string           // Outputs of the asset processors, by input
+	cacheAssets   bool                          // Cache the outputs of the asset processors, set with CacheProcessedAssets
+	stylesPath    string                        // URL path of external stylesheets, inline <style> when empty
+	assets        map[string][]byte             // Stylesheets served by AssetHandler, by file name
+	deferScripts  bool                          // Run the combined JS only once the DOM is ready
+	disableJS     bool                          // Drop the JS of the components and the layout <script> block
+	noWrap        bool                          // Scope rootless components without a wrapper <div>
+	elementPrefix string                        // Prefix of the custom elements wrapping components, <div> when empty
+	renderTimeout time.Duration                 // Maximum duration of Execute (0 means no timeout)
+	renderCancel  *cancelWriter                 // Writer of the current timed render, cancelled on timeout
+	renderCtx     context.Context               // Context of the current render, read by ctxValue and providers
+	basePath      string                        // Prefix added to the URLs generated by the asset function
+	frozen        bool                          // Set by Freeze; parsing and adding functions are rejected
+	allowOverride bool                          // Later templates replace earlier ones with the same name
+	overrides     []TemplateOverride            // Templates replaced while parsing with AllowOverride
+	requiredData  map[string][]string           // Data keys each template requires, set with RequireData
+	layoutFuncs   template.FuncMap              // Functions available to layouts, set when parsing finishes
+	fileLayouts   map[string]*Layout            // Cache of the layout files parsed by ExecuteLayout
+	providers     map[string]DataProvider       // Data providers of components, set with RegisterProvider
+	debugAttrs    bool                          // Add a data-component attribute to the root of each component
+	critical      map[string]bool               // Templates whose CSS is critical, set with MarkCritical
+	exposeArgs    bool                          // Add the positional comp arguments as a slice under "Args"
+	urlRewriter   func(url string) string       // Rewrites the url(...) values of component CSS
+	pageCaches    map[string]*pageCache         // Caches of rendered pages configured with CachePage
+	leftDelim     string                        // Left action delimiter of the templates, "{{" when empty
+	rightDelim    string                        // Right action delimiter of the templates, "}}" when empty
+	extensions    []string                      // Extensions of the files parsed as templates
+	strictScopes  bool                          // Scope the CSS to the direct children of the scope element
+	isolation     Isolation                     // How the CSS of the components is isolated
+	devMode       bool                          // Set by WithDevMode; enables DebugHandler
+	plugins       []Plugin                      // Plugins registered with Use
+	alwaysInclude []string                      // Templates whose CSS and JS are added to every render
+	regionPool    *sync.Pool                    // Sets rendering the regions of ExecuteParallel, dropped when parsing
 }
 
+// AssetProcessor transforms the combined CSS or JS of a render, for example to
+// add vendor prefixes or minify it. A returned error fails the render.
+type AssetProcessor func(code string) (string, error)
+
+// AssetOrder defines the order in which the CSS and JS of the used templates
+// are concatenated. Since later rules win in the CSS cascade, the order decides
+// which component overrides another when their rules have the same specificity.
+type AssetOrder int
+
+const (
+	OrderAlphabetical AssetOrder = iota // Sorted by template name (default)
+	OrderParse                          // Order in which the templates were parsed
+	OrderUsage                          // Order in which the templates were first used in the render
+)
+
 const (
 	uniqueOpenToken      = "___GO_TEMPLATE_OPEN___"
 	uniqueCloseToken     = "___GO_TEMPLATE_CLOSE___"
@@ -59,27 +156,101 @@ const (
 	ElementTypeContainer = 2 // Root Container
 )
 
+// protectDelims and restoreDelims swap the {{ }} delimiters with the unique
+// tokens in a single pass, so template actions do not interfere with scoping
+var (
+	protectDelims = strings.NewReplacer("{{", uniqueOpenToken, "}}", uniqueCloseToken)
+	restoreDelims = strings.NewReplacer(uniqueOpenToken, "{{", uniqueCloseToken, "}}")
+)
+
+// maxComponentDepth is the maximum nesting of comp calls, to stop infinite recursion
+const maxComponentDepth = 100
+
 var (
-	htmlRegex     = regexp.MustCompile(`(?s)<template([^>]*)>(.*?)</template>`)
-	cssRegex      = regexp.MustCompile(`(?s)<style([^>]*)>(.*?)</style>`)
-	jsRegex       = regexp.MustCompile(`(?s)<script>(.*?)</script>`)
-	classRegex    = regexp.MustCompile(`class\s*=\s*["']([^"']*)["']`)
-	openTagRegex  = regexp.MustCompile(`^\s*<[^>]+>`)
-	unwrapRegex   = regexp.MustCompile(`unwrap`)
-	firstTagRegex = regexp.MustCompile(`^\s*<([a-zA-Z][a-zA-Z0-9]*)([^>]*)>`)
-	compCallRegex = regexp.MustCompile(`{{[^}]*comp\s+"?([^"\s}]+)"?`)
+	templateRegex  = regexp.MustCompile(`(?i)<(/?)template(\s[^>]*)?>`)
+	cssRegex       = regexp.MustCompile(`(?s)<style([^>]*)>(.*?)</style>`)
+	jsRegex        = regexp.MustCompile(`(?s)<script(\s[^>]*)?>(.*?)</script>`)
+	requiresRegex  = regexp.MustCompile(`data-requires\s*=\s*["']([^"']*)["']`)
+	scriptSrcRegex = regexp.MustCompile(`(?i)(?:^|\s)src\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+	classRegex     = regexp.MustCompile(`class\s*=\s*["']([^"']*)["']`)
+	unwrapRegex    = regexp.MustCompile(`unwrap`)
+	nowrapRegex    = regexp.MustCompile(`\bnowrap\b`)
+	scopeVarRegex  = regexp.MustCompile(`{{-?\s*\.ScopeClass\s*-?}}`)
+	typedRegex     = regexp.MustCompile(`\btyped\b`)
+	criticalRegex  = regexp.MustCompile(`\bcritical\b`)
+	jsonLDRegex    = regexp.MustCompile(`(?i)\stype\s*=\s*["']?application/ld\+json\b`)
+	globalRegex    = regexp.MustCompile(`(?i)(?:^|\s)(?:global\b|scoped\s*=\s*["']?false\b)`)
+	mediaRegex     = regexp.MustCompile(`(?i)(?:^|\s)media\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+	cssURLRegex    = regexp.MustCompile(`(?i)url\(\s*(?:"([^"]*)"|'([^']*)'|([^)"'\s]*))\s*\)`)
+	firstTagRegex  = regexp.MustCompile(`^\s*<([a-zA-Z][a-zA-Z0-9-]*)`)
+	compCallRegex  = regexp.MustCompile(`{{[^}]*comp\s+"?([^"\s}]+)"?`)
+	doctypeRegex   = regexp.MustCompile(`(?i)^<!DOCTYPE[^>]*>\s*`)
+	attrNameRegex  = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:.-]*$`)
+	rootClassRegex = regexp.MustCompile(`\sclass\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+	classAttrRegex = regexp.MustCompile(`\sclass\s*=\s*("|'|{{)`)
+	closeTagRegex  = regexp.MustCompile(`</\s*[^>]+>\s*$`)
+	actionRegex    = regexp.MustCompile(`(?s){{(.*?)}}`)
+	compRefRegex   = regexp.MustCompile(`(?:^|[\s(|])(comp|compJoin|include)\s+"([^"]+)"`)
+	commentRegex   = regexp.MustCompile(`(?s)<!--.*?-->`)
+	cssMarkerRegex = regexp.MustCompile(`<!--\s*skingo:css\s*-->`)
+	jsMarkerRegex  = regexp.MustCompile(`<!--\s*skingo:js\s*-->`)
+	themeNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+	namespaceRegex = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]*$`)
+	elementRegex   = regexp.MustCompile(`^[a-z][a-z0-9-]*-$`)
+	rawTextRegex   = regexp.MustCompile(`(?is)<script\b.*?</script>|<style\b.*?</style>|<textarea\b.*?</textarea>|<title\b.*?</title>`)
 )
 
+// RenderEvent describes a finished Execute call and is passed to the observer
+// configured with SetObserver.
+type RenderEvent struct {
+	Template   string        // Name of the rendered template
+	Layout     string        // Name of the layout used
+	Duration   time.Duration // Total time spent rendering
+	Components int           // Number of templates used, including the rendered one
+	Bytes      int64         // Number of bytes written to the writer
+	Err        error         // Error returned by the render, if any
+}
+
+// ParseStats summarizes the parsed templates and is returned by Stats.
+type ParseStats struct {
+	Components int                // Number of parsed templates, excluding layouts
+	Layouts    int                // Number of parsed layouts
+	WithCSS    []string           // Sorted names of the templates that have CSS
+	WithJS     []string           // Sorted names of the templates that have JS
+	CSSBytes   int                // Total size of the scoped CSS
+	JSBytes    int                // Total size of the JS
+	Overrides  []TemplateOverride // Templates replaced by a later one with AllowOverride
+}
+
+// TemplateOverride records a template replaced by another with the same name
+type TemplateOverride struct {
+	Name     string // Template name
+	Replaced string // Source of the replaced template
+	Source   string // Source of the template that replaced it
+}
+
+// ErrOutputLimit is returned when a render produces more output than the limit
+// configured with SetMaxOutputBytes.
+var ErrOutputLimit = errors.New("output limit exceeded")
+
+// ErrFrozen is returned by AddFuncs and the Parse methods after Freeze.
+var ErrFrozen = errors.New("template set is frozen")
+
+// ErrRenderTimeout is returned when Execute takes longer than the timeout
+// configured with SetRenderTimeout.
+var ErrRenderTimeout = errors.New("render timeout exceeded")
+
 // defaultFuncs contains the default functions available in all templates
 var defaultFuncs = template.FuncMap{
-	"add":      func(a, b int) int { return a + b },
-	"mod":      func(a, b int) int { return a % b },
-	"mul":      func(a, b int) int { return a * b },
-	"sub":      func(a, b int) int { return a - b },
-	"addFloat": func(a, b float64) float64 { return a + b },
-	"mulFloat": func(a, b float64) float64 { return a * b },
-	"subFloat": func(a, b float64) float64 { return a - b },
-	"divFloat": func(a, b float64) float64 { return a / b },
+	"add":      arithmetic("add", addInt, func(a, b float64) float64 { return a + b }),
+	"mod":      arithmetic("mod", modInt, math.Mod),
+	"mul":      arithmetic("mul", mulInt, func(a, b float64) float64 { return a * b }),
+	"sub":      arithmetic("sub", subInt, func(a, b float64) float64 { return a - b }),
+	"div":      arithmetic("div", divInt, func(a, b float64) float64 { return a / b }),
+	"addFloat": floatArithmetic("addFloat", func(a, b float64) float64 { return a + b }),
+	"mulFloat": floatArithmetic("mulFloat", func(a, b float64) float64 { return a * b }),
+	"subFloat": floatArithmetic("subFloat", func(a, b float64) float64 { return a - b }),
+	"divFloat": floatArithmetic("divFloat", func(a, b float64) float64 { return a / b }),
 	"toJson": func(v interface{}) string {
 		b, err := json.Marshal(v)
 		if err != nil {
@@ -94,7 +265,24 @@ var defaultFuncs = template.FuncMap{
 // where the CSS and JS will be automatically injected.
 // In addition, it is mandatory to inform the entry point of the templates that will be
 // rendered in the layout, defining the '{{ .Yield }}' variable.
+//
+// An empty layoutName creates a set without a required layout, whose templates
+// are rendered by the methods that do not use one, such as ExecuteInline.
+//
+// NewTemplateSet is NewTemplateSetWithOptions without options.
 func NewTemplateSet(layoutName string) *TemplateSet {
+	return NewTemplateSetWithOptions(layoutName)
+}
+
+// NewTemplateSetWithOptions creates a new template set like NewTemplateSet and
+// applies opts to it, in order, so the configuration of the set can be given
+// in one place:
+//
+//	ts := skingo.NewTemplateSetWithOptions("layout",
+//		skingo.WithDelims("[[", "]]"),
+//		skingo.WithScopeStrategy(skingo.ScopeReadable),
+//	)
+func NewTemplateSetWithOptions(layoutName string, opts ...Option) *TemplateSet {
 	ts := &TemplateSet{
 		templates:     make(map[string]*Template),
 		layout:        nil,
@@ -107,21 +295,37 @@ func NewTemplateSet(layoutName string) *TemplateSet {
 		customFuncs:   make(template.FuncMap),
 		isolatedCache: make(map[string]*template.Template),
 		sources:       make(map[string]string),
+		scopeOwners:   make(map[string]string),
+		renderedCSS:   make(map[string][]string),
+		logger:        slog.New(slog.DiscardHandler),
+		compression:   gzip.DefaultCompression,
+		compCaches:    make(map[string]*componentCache),
+		assets:        make(map[string][]byte),
+		extensions:    []string{".html", ".tmpl"},
 	}
 
 	// Apply default functions immediately
 	ts.masterTmpl.Funcs(defaultFuncs)
 
+	for _, opt := range opts {
+		opt(ts)
+	}
+
 	return ts
 }
 
 // AddFuncs adds custom functions to the template set.
 // These functions will be available in all templates.
+// It returns ErrFrozen after Freeze and nil otherwise.
 // Note: This method should be called before ParseDirs or ParseFS.
-func (ts *TemplateSet) AddFuncs(funcMap template.FuncMap) {
+func (ts *TemplateSet) AddFuncs(funcMap template.FuncMap) error {
 	ts.mu.Lock()
 	defer ts.mu.Unlock()
 
+	if ts.frozen {
+		return ErrFrozen
+	}
+
 	// Save the custom functions for later use
 	for name, fn := range funcMap {
 		ts.customFuncs[name] = fn
@@ -129,863 +333,3805 @@ func (ts *TemplateSet) AddFuncs(funcMap template.FuncMap) {
 
 	// Apply them to the master template
 	ts.masterTmpl.Funcs(funcMap)
-}
-
-func (ts *TemplateSet) registerSource(name, source string) error {
-	if previous, exists := ts.sources[name]; exists && previous != source {
-		return fmt.Errorf("duplicate template name %q found in %s and %s", name, previous, source)
-	}
-	ts.sources[name] = source
+	ts.regionPool = nil
 	return nil
 }
 
-func extractComponentNames(content string) []string {
-	matches := compCallRegex.FindAllStringSubmatch(content, -1)
-	if len(matches) == 0 {
-		return nil
+// AddNamespacedFuncs adds custom functions under a namespace, so they cannot
+// collide with the default and internal functions: with the namespace "my",
+// the function "upper" is available as my_upper. The namespace must start with
+// a letter and contain only letters, digits and underscores.
+// Like AddFuncs, it returns ErrFrozen after Freeze.
+// Note: This method should be called before ParseDirs or ParseFS.
+func (ts *TemplateSet) AddNamespacedFuncs(namespace string, funcMap template.FuncMap) error {
+	if !namespaceRegex.MatchString(namespace) {
+		return fmt.Errorf("invalid function namespace %q", namespace)
 	}
 
-	seen := make(map[string]bool, len(matches))
-	names := make([]string, 0, len(matches))
-	for _, match := range matches {
-		if len(match) <= 1 {
-			continue
-		}
-		name := strings.TrimSuffix(match[1], ".html")
-		if seen[name] {
-			continue
-		}
-		seen[name] = true
-		names = append(names, name)
+	namespaced := make(template.FuncMap, len(funcMap))
+	for name, fn := range funcMap {
+		namespaced[namespace+"_"+name] = fn
 	}
-	return names
+	return ts.AddFuncs(namespaced)
 }
 
-func isLayoutPath(path string) bool {
-	return filepath.Base(filepath.Dir(path)) == layoutsDirName
+// EnableMarkdown adds the markdown function, which converts a markdown string
+// into HTML with renderer, for content-heavy components such as blog posts:
+// {{ markdown .Body }}. Skingo ships no markdown parser, so any library can be
+// plugged in as renderer.
+//
+// The output of renderer is trusted HTML and is not escaped, so renderer must
+// sanitize it (or escape raw HTML in the source) when the markdown comes from
+// users. Like AddFuncs, it returns ErrFrozen after Freeze.
+// Note: This method should be called before ParseDirs, ParseFS or ParseSources.
+func (ts *TemplateSet) EnableMarkdown(renderer func(markdown string) string) error {
+	return ts.AddFuncs(template.FuncMap{
+		"markdown": func(markdown string) template.HTML {
+			return template.HTML(renderer(markdown))
+		},
+	})
 }
 
-// generateScopeClass build a scope class based on the template name and returns
-func generateScopeClass(name string) string {
-	// build a hash basead in template name
-	hash := md5.Sum([]byte(name))
-	// Return the first six characters of the hash
-	return fmt.Sprintf("s-%x", hash)[:8]
+// Freeze marks the template set as complete, usually right after parsing at
+// startup. Afterwards AddFuncs and the Parse methods return ErrFrozen, so the
+// parsed templates, layouts and functions can no longer change.
+//
+// Parsing again before Freeze is safe while rendering, since the new templates
+// are swapped in between renders, and after Freeze the parsed templates are
+// guaranteed not to change. Renders are still serialized by a render lock,
+// since the tracking of used components is shared, and runtime options such as
+// SetObserver keep being guarded by the set mutex.
+func (ts *TemplateSet) Freeze() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.frozen = true
 }
 
-// scopedCSS creates CSS scope for elements inside a container
-// (for example, when elements are inside a div with the scope class)
-func scopedCSS(css string, scopeClass string, rootElementTag string, rootClasses []string, elementType int) string {
-	cssBlocks := strings.Split(css, "}")
-	var scopedCSS strings.Builder
+// checkFrozen returns ErrFrozen after Freeze
+func (ts *TemplateSet) checkFrozen() error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.frozen {
+		return ErrFrozen
+	}
+	return nil
+}
 
-	for _, block := range cssBlocks {
-		if strings.TrimSpace(block) == "" {
-			continue
-		}
+// ReadableScopes enables human-readable scope classes derived from the template
+// name (for example "s-button") instead of the default md5 based classes.
+// Colliding names receive a numeric suffix ("s-button-2").
+// Hashed scopes remain the default to avoid leaking template names in production.
+// Note: This method should be called before ParseDirs or ParseFS.
+func (ts *TemplateSet) ReadableScopes(enabled bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.readable = enabled
+}
 
-		parts := strings.SplitN(block, "{", 2)
-		if len(parts) != 2 {
-			continue
-		}
+// Isolation defines how the CSS of the components is kept from affecting the
+// rest of the page
+type Isolation int
 
-		selectors := parts[0]
-		declarations := parts[1]
+const (
+	ScopeClasses Isolation = iota // Selectors rewritten with scope classes (default)
+	ShadowDOM                     // Components rendered inside a declarative shadow root
+)
 
-		// Split multiple selectors (separated by commas)
-		selectorList := strings.Split(selectors, ",")
-		var scopedSelectors []string
+// IsolationMode sets how the CSS of the components is isolated. With ShadowDOM,
+// each template with CSS is rendered inside a custom element named after it
+// ("sk-" followed by the template name, such as <sk-card>) holding a declarative
+// shadow root (<template shadowrootmode="open">), and its CSS is written as is
+// inside that shadow root instead of being scoped and injected into the layout,
+// so the browser itself keeps styles from leaking in either direction.
+//
+// Declarative shadow roots are supported by Chrome 111, Safari 16.4 and Firefox
+// 123 onwards, and are only attached while the page is parsed: markup inserted
+// later through innerHTML, as done by many fragment libraries, is not isolated.
+// Outside styles do not reach the content of the shadow root besides inherited
+// properties, and scripts must find the elements of a component through its
+// shadowRoot. Templates without CSS and full documents are rendered as with
+// scope classes.
+// Note: This method should be called before ParseDirs, ParseFS or ParseSources.
+func (ts *TemplateSet) IsolationMode(mode Isolation) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.isolation = mode
+}
 
-		for _, selector := range selectorList {
-			selector = strings.TrimSpace(selector)
-			if selector == "" {
-				continue
-			}
+// StrictScopes makes the CSS of each component reach only the direct children
+// of its scope element, scoping "p" as ".s-xxxx > p" instead of ".s-xxxx p", so
+// the styles of a component do not leak into the components rendered inside
+// it. The elements the CSS targets must then be written as direct children, or
+// be matched with explicit selectors such as "ul li", which becomes
+// ".s-xxxx > ul li". The root element itself is still matched by its tag and
+// classes.
+// Note: This method should be called before ParseDirs, ParseFS or ParseSources.
+func (ts *TemplateSet) StrictScopes(enabled bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.strictScopes = enabled
+}
 
-			if selector == rootElementTag {
-				// Is it the root element, add the class directly
-				scopedSelectors = append(scopedSelectors, fmt.Sprintf("%s.%s", selector, scopeClass))
-			} else if strings.HasPrefix(selector, ".") {
-				// Extract the class name without the dot
-				className := selector[1:]
+// ScopePrefix sets a prefix for the generated scope classes to follow an
+// existing naming convention. With a prefix, the scope classes also include the
+// template name and a shorter hash, such as "app-button-a1b2" instead of the
+// default "s-a1b2c3". Together with ReadableScopes the hash is omitted
+// ("app-button"). An empty prefix restores the default "s-" classes.
+// Note: This method should be called before ParseDirs or ParseFS.
+func (ts *TemplateSet) ScopePrefix(prefix string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.scopePrefix = ""
+	if prefix = strings.Trim(prefix, "- "); prefix != "" {
+		ts.scopePrefix = slugify(prefix)
+	}
+}
 
-				// Verify if it's a single element or the class is in the root element
-				useDirectScope := false
+// ExposeArgs also exposes the positional arguments of comp as a slice under the
+// "Args" key of the component data, so {{ comp "button" "Save" "green" }} can
+// read them as {{ index .Args 0 }} or range over them, in addition to the
+// "0", "1", ... keys. The param and paramOr functions are not affected. A
+// single map argument is used as the data and does not receive the key.
+// It is disabled by default.
+func (ts *TemplateSet) ExposeArgs(enabled bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.exposeArgs = enabled
+}
 
-				if elementType == ElementTypeSingle {
-					// For single elements, all classes are treated without space
-					useDirectScope = true
-				} else {
-					// For other types, check if the class is in the root element
-					for _, rootClass := range rootClasses {
-						if rootClass == className {
-							useDirectScope = true
-							break
-						}
-					}
-				}
+// SetURLRewriter sets a function that rewrites the URLs of the url(...) values
+// in the CSS of components, such as background images and fonts, so they can
+// point to fingerprinted files or a CDN. Quoted and unquoted URLs are
+// supported and keep their quotes, while data URIs are left unchanged. The CSS
+// of layouts is not rewritten.
+// Note: This method should be called before ParseDirs, ParseFS or ParseSources.
+func (ts *TemplateSet) SetURLRewriter(rewriter func(url string) string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.urlRewriter = rewriter
+}
 
-				if useDirectScope {
-					// Without espace: ".class" -> ".s-xxxxx.class"
-					scopedSelectors = append(scopedSelectors, fmt.Sprintf(".%s%s", scopeClass, selector))
-				} else {
-					// With espace: ".class" -> ".s-xxxxx .class"
-					scopedSelectors = append(scopedSelectors, fmt.Sprintf(".%s %s", scopeClass, selector))
-				}
-			} else if strings.HasPrefix(selector, ":") {
-				// Is a pseudo-class
-				if rootElementTag != "" {
-					scopedSelectors = append(scopedSelectors, fmt.Sprintf("%s.%s%s", rootElementTag, scopeClass, selector))
-				} else {
-					scopedSelectors = append(scopedSelectors, fmt.Sprintf(".%s%s", scopeClass, selector))
-				}
-			} else if strings.Contains(selector, " ") || strings.Contains(selector, ">") ||
-				strings.Contains(selector, "+") || strings.Contains(selector, "~") {
-				// Is a selector with children or siblings
-				scopedSelectors = append(scopedSelectors, fmt.Sprintf(".%s %s", scopeClass, selector))
-			} else {
-				// Is other element
-				scopedSelectors = append(scopedSelectors, fmt.Sprintf(".%s %s", scopeClass, selector))
-			}
-		}
+// DebugAttributes adds a data-component attribute with the template name to the
+// root element of every component (for example data-component="button"), which
+// makes components easy to find in the browser devtools and to select in
+// end-to-end tests. Components without a root element, such as those made of
+// several elements and no CSS, are left unchanged. It is disabled by default.
+// Note: This method should be called before ParseDirs, ParseFS or ParseSources.
+func (ts *TemplateSet) DebugAttributes(enabled bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.debugAttrs = enabled
+}
 
-		scopedSelector := strings.Join(scopedSelectors, ", ")
-		scopedCSS.WriteString(scopedSelector)
-		scopedCSS.WriteString(" {")
-		scopedCSS.WriteString(declarations)
-		scopedCSS.WriteString("}\n")
-	}
+// AllowOverride lets a template replace an earlier parsed template with the
+// same name instead of failing with a duplicate name error. Combined with
+// ParseSources, an application can customize selected components of a base UI
+// kit by listing its own source after the kit. The replaced templates are
+// reported by Stats. Duplicate names remain an error by default.
+// Note: This method should be called before ParseDirs, ParseFS or ParseSources.
+func (ts *TemplateSet) AllowOverride(enabled bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.allowOverride = enabled
+}
 
-	return scopedCSS.String()
+// DynamicCSS enables Go template expressions inside component <style> blocks,
+// such as "color: {{ .color }}". The CSS of each used component is then rendered
+// during Execute with the same data that component received, instead of being
+// emitted as a precomputed string.
+//
+// This has a cost: every dynamic component executes an extra template per use
+// and its CSS can no longer be reused between renders, so prefer static CSS and
+// variant classes whenever possible. All uses of a component share the same
+// scope class, which means different values for the same component produce
+// competing rules and the last rendered one wins.
+// Note: This method should be called before ParseDirs or ParseFS.
+func (ts *TemplateSet) DynamicCSS(enabled bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.dynamicCSS = enabled
 }
 
-// containedScopedCSS creates CSS scope for elements inside a container
-// (for example, when elements are inside a div with the scope class)
-func containedScopedCSS(css string, scopeClass string) string {
-	// Split CSS into blocks of rules
-	cssBlocks := strings.Split(css, "}")
-	var scopedCSS strings.Builder
+// SetMaxOutputBytes limits the number of bytes a single render may produce.
+// When the content of a template, a component or the final page exceeds the
+// limit, rendering is aborted with an error wrapping ErrOutputLimit. This
+// protects servers from runaway templates or malicious data. Note that part of
+// the page may already have been written to w when the final layout write
+// exceeds the limit. A value of 0 or less disables the limit, which is the
+// default.
+func (ts *TemplateSet) SetMaxOutputBytes(n int64) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.maxOutput = n
+}
 
-	for _, block := range cssBlocks {
-		if strings.TrimSpace(block) == "" {
-			continue
-		}
+// SetLogger sets the logger used to report parse failures, missing templates
+// and component recursion with structured fields such as the file and the
+// template name. Errors are still returned to the caller; logging only adds
+// diagnostics. Passing nil restores the default no-op logger.
+func (ts *TemplateSet) SetLogger(logger *slog.Logger) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if logger == nil {
+		logger = slog.New(slog.DiscardHandler)
+	}
+	ts.logger = logger
+}
 
-		// Split into selector and declarations
-		parts := strings.SplitN(block, "{", 2)
-		if len(parts) != 2 {
-			continue
+// log returns the configured logger
+func (ts *TemplateSet) log() *slog.Logger {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.logger
+}
+
+// SetAssetOrder sets the order in which the CSS and JS of the used templates
+// are concatenated. The default is OrderAlphabetical, which sorts by template
+// name. OrderParse follows the order in which the files were parsed, and
+// OrderUsage follows the order in which the templates were first used during the
+// render, so the page comes first and each component follows its parent.
+func (ts *TemplateSet) SetAssetOrder(order AssetOrder) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.assetOrder = order
+}
+
+// AlwaysInclude adds the CSS and JS of the named templates to every render even
+// when they are not referenced, which keeps global styling such as resets,
+// typography and design tokens apart from the page components:
+//
+//	ts.AlwaysInclude("theme")
+//
+// The templates are included as used, so their assets follow the order set with
+// SetAssetOrder and, with ExecuteTracked and ExecuteFragment, are only sent once.
+// Calling it again adds more templates. Executing fails when a named template
+// does not exist.
+func (ts *TemplateSet) AlwaysInclude(names ...string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for _, name := range names {
+		name = strings.TrimSuffix(name, ".html")
+		if !slices.Contains(ts.alwaysInclude, name) {
+			ts.alwaysInclude = append(ts.alwaysInclude, name)
 		}
+	}
+}
 
-		selectors := parts[0]
-		declarations := parts[1]
+// SetCSSProcessor registers a function applied to the combined CSS of each
+// render before it is injected, which allows integrating external prefixers or
+// minifiers. It is not called when the render has no CSS. Passing nil removes it.
+// The CSS variables added by ExecuteThemed are part of the CSS it receives.
+func (ts *TemplateSet) SetCSSProcessor(processor AssetProcessor) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.cssProcessor = processor
+	ts.processed = nil
+}
 
-		// Split multiple selectors (separated by commas)
-		selectorList := strings.Split(selectors, ",")
-		var scopedSelectors []string
+// SetJSProcessor registers a function applied to the combined JS of each render
+// before it is injected. It is not called when the render has no JS. Passing nil
+// removes it.
+func (ts *TemplateSet) SetJSProcessor(processor AssetProcessor) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.jsProcessor = processor
+	ts.processed = nil
+}
 
-		for _, selector := range selectorList {
-			selector = strings.TrimSpace(selector)
-			if selector == "" {
-				continue
-			}
+// CacheProcessedAssets caches the outputs of the processors set with
+// SetCSSProcessor and SetJSProcessor by input, so renders that combine the same
+// CSS or JS, with the same theme, run each processor once. Only enable it for
+// processors that return the same output for the same input, without nonces,
+// timestamps or per-request state. The cache is cleared when it is disabled,
+// when a processor is set and when templates are parsed again. Disabled by
+// default.
+func (ts *TemplateSet) CacheProcessedAssets(enabled bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.cacheAssets = enabled
+	ts.processed = nil
+}
 
-			// For any type of selector, we use the scope class as the ancestor
-			// This works for elements (h1, p, a) and for classes (.btn, .blue)
-			scopedSelectors = append(scopedSelectors, fmt.Sprintf(".%s %s", scopeClass, selector))
-		}
+// DeferScripts makes the combined JS of each render run only once the DOM is
+// ready, by wrapping it in a function called on DOMContentLoaded, or right away
+// when the document has already loaded (for example, fragments swapped in by
+// HTMX). Since the scripts then share a function scope, top-level declarations
+// are no longer globals; assign to window to share values.
+func (ts *TemplateSet) DeferScripts(enabled bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.deferScripts = enabled
+}
 
-		// Merge the transformed selectors
-		scopedSelector := strings.Join(scopedSelectors, ", ")
-		scopedCSS.WriteString(scopedSelector)
-		scopedCSS.WriteString(" {")
-		scopedCSS.WriteString(declarations)
-		scopedCSS.WriteString("}\n")
-	}
+// DisableJS drops all component JavaScript, for environments that forbid it,
+// such as AMP pages or strict no-JS policies. The <script> blocks of the
+// components are discarded with a warning when they are parsed, no JS is
+// collected in renders and the layouts get no injected <script> block, while
+// the CSS is still inlined as usual.
+//
+// Note: This method should be called before ParseDirs, ParseFS or ParseSources.
+func (ts *TemplateSet) DisableJS(disabled bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.disableJS = disabled
+}
 
-	return scopedCSS.String()
+// DisableWrapping stops wrapping the components without a single root element
+// in a <div> carrying the scope class, which is invalid where only specific
+// elements are allowed, such as table rows. The scope class is added to each
+// top-level element instead, and the CSS selectors match them and the
+// elements inside them. Top-level text is then left unstyled by the scoped
+// CSS. The same applies to a single component with <template nowrap>.
+//
+// Note: This method should be called before ParseDirs, ParseFS or ParseSources.
+func (ts *TemplateSet) DisableWrapping(disabled bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.noWrap = disabled
 }
 
-// parseLayoutFile processes a layout template file
-func (ts *TemplateSet) parseLayoutFile(name string, content string) error {
-	layout := &Layout{
-		HTML: content,
+// CustomElementPrefix makes the components that are wrapped, because they have
+// no single root element, render inside a custom element named after them
+// instead of a <div>. With the prefix "x-", the card component renders as
+// <x-card class="s-xxxx">...</x-card> and its CSS is scoped to x-card.s-xxxx,
+// so client-side behavior can be attached with customElements.define("x-card").
+// A missing trailing "-" is added, and the prefix must start with a letter and
+// contain only lowercase letters, digits and "-". An empty prefix restores the
+// <div> wrapper.
+//
+// Custom elements are inline by default, unlike <div>, so give them a display
+// value in CSS when the layout depends on it.
+//
+// Note: This method should be called before ParseDirs, ParseFS or ParseSources.
+func (ts *TemplateSet) CustomElementPrefix(prefix string) error {
+	if prefix != "" && !strings.HasSuffix(prefix, "-") {
+		prefix += "-"
 	}
-
-	if !strings.Contains(layout.HTML, ".Yield") {
-		return fmt.Errorf("layout template must contain {{ .Yield }}")
+	if prefix != "" && !elementRegex.MatchString(prefix) {
+		return fmt.Errorf("invalid custom element prefix %q", prefix)
 	}
 
-	// Insert the style tag for the template before the </head>
-	headCloseIndex := strings.Index(layout.HTML, "</head>")
-	if headCloseIndex == -1 {
-		return fmt.Errorf("layout template must contain </head> tag")
-	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.elementPrefix = prefix
+	return nil
+}
 
-	layout.HTML = layout.HTML[:headCloseIndex] +
-		"\n\t<style>{{ .CSS }}</style>\n" +
-		layout.HTML[headCloseIndex:]
+// SetBasePath sets the prefix that the asset template function adds to paths,
+// so an application can be mounted under a subpath behind a reverse proxy.
+// For example, with SetBasePath("/app"), {{ asset "css/app.css" }} renders
+// "/app/css/app.css". The default prefix is empty.
+func (ts *TemplateSet) SetBasePath(prefix string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.basePath = strings.TrimSuffix(prefix, "/")
+}
 
-	// Insert the script tag for the template before the </body>
-	bodyCloseIndex := strings.Index(layout.HTML, "</body>")
-	if bodyCloseIndex == -1 {
-		return fmt.Errorf("layout template must contain </body> tag")
+// RequireData declares the keys that the data of templateName must contain.
+// Renders of the template whose data lacks any of them fail with an error
+// naming the missing keys before anything is written, turning silent empty
+// values into explicit errors. For map data the keys are looked up in the map,
+// and for struct data (or a pointer to a struct) they are exported field
+// names. Calling RequireData again for the same template replaces its keys.
+func (ts *TemplateSet) RequireData(templateName string, keys ...string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.requiredData == nil {
+		ts.requiredData = make(map[string][]string)
 	}
+	ts.requiredData[strings.TrimSuffix(templateName, ".html")] = keys
+}
 
-	layout.HTML = layout.HTML[:bodyCloseIndex] +
-		"\n\t<script>{{ .JS }}</script>\n" +
-		layout.HTML[bodyCloseIndex:]
+// checkRequiredData returns an error if data lacks any key required for name
+func (ts *TemplateSet) checkRequiredData(name string, data interface{}) error {
+	ts.mu.Lock()
+	keys := ts.requiredData[name]
+	ts.mu.Unlock()
 
-	ts.layouts[name] = layout
-	ts.layoutUses[name] = extractComponentNames(layout.HTML)
-	if name == ts.layoutName {
-		ts.layout = layout
+	var missing []string
+	for _, key := range keys {
+		if !hasDataKey(data, key) {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		ts.log().Error("missing required data", "template", name, "keys", missing)
+		return fmt.Errorf("template %s: missing required data %s", name, strings.Join(missing, ", "))
 	}
-
 	return nil
 }
 
-// processTemplate processes a single template and extracts HTML, CSS, and JS
-func (ts *TemplateSet) processTemplate(name string, content []byte, source string, isLayout bool) error {
-	if err := ts.registerSource(name, source); err != nil {
-		return err
+// hasDataKey reports whether data is a map containing key or a struct with an
+// exported field named key.
+func hasDataKey(data interface{}, key string) bool {
+	v := reflect.ValueOf(data)
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return false
+		}
+		v = v.Elem()
 	}
 
-	// Process layout in a special way
-	if isLayout {
-		return ts.parseLayoutFile(name, string(content))
+	switch v.Kind() {
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return false
+		}
+		return v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key())).IsValid()
+	case reflect.Struct:
+		field, ok := v.Type().FieldByName(key)
+		return ok && field.IsExported()
 	}
+	return false
+}
 
-	t := &Template{
-		Name:       name,
-		scopeClass: generateScopeClass(name),
+// layoutKeys are the keys Skingo sets in the data of layouts
+var layoutKeys = []string{"Yield", "CriticalCSS", "CSS", "CSSHref", "JS", "Data", "StructuredData", "Scripts"}
+
+// reservedDataKeys returns the keys of data that are also layout keys
+func reservedDataKeys(data interface{}) []string {
+	var reserved []string
+	for _, key := range layoutKeys {
+		if hasDataKey(data, key) {
+			reserved = append(reserved, key)
+		}
 	}
+	return reserved
+}
 
-	// Extract the HTML, CSS and JS from template tags
-	if matches := htmlRegex.FindStringSubmatch(string(content)); len(matches) > 1 {
-		templateAttrs := matches[1]
-		templateContent := matches[2]
-		trimmedContent := strings.TrimSpace(templateContent)
+// addDataKeys copies the entries of map data to layoutData without replacing
+// the layout keys. Struct and other data are only available under .Data.
+func addDataKeys(layoutData map[string]interface{}, data interface{}) {
+	v := reflect.ValueOf(data)
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
 
-		// Verify if has unwrap attribute
-		unwrap := unwrapRegex.MatchString(templateAttrs)
+	if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+		return
+	}
+	for iter := v.MapRange(); iter.Next(); {
+		if _, reserved := layoutData[iter.Key().String()]; !reserved {
+			layoutData[iter.Key().String()] = iter.Value().Interface()
+		}
+	}
+}
 
-		t.HTML = trimmedContent
+// assetURL prepends the base path to path. Absolute URLs, such as
+// "https://cdn.example.com/app.js" or "//cdn.example.com/app.js", are returned
+// unchanged.
+func (ts *TemplateSet) assetURL(path string) string {
+	if strings.HasPrefix(path, "//") || strings.Contains(path, "://") {
+		return path
+	}
 
-		// First, temporarily replace the {{ }} delimiters so as not to interfere with parsing
-		safeContent := strings.ReplaceAll(trimmedContent, "{{", uniqueOpenToken)
-		safeContent = strings.ReplaceAll(safeContent, "}}", uniqueCloseToken)
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.basePath + "/" + strings.TrimPrefix(path, "/")
+}
 
-		// Verify if it starts with an opening tag and find which it is
-		hasRootElement := false
-		isSingleElement := false
-		isRootContainer := false // Flag for identifying a root container
-		rootTagName := ""
-		rootClasses := []string{} // Store the classes of the root element
+// markUsed records name as used in the current render. The caller must hold ts.mu.
+func (ts *TemplateSet) markUsed(name string) {
+	if !ts.usedTemplates[name] {
+		ts.usedTemplates[name] = true
+		ts.usedOrder = append(ts.usedOrder, name)
+	}
+	for _, entry := range ts.recorders {
+		entry.addUsed(name)
+	}
+}
 
-		// Regex for finding the first opening tag
-		if firstTagMatch := firstTagRegex.FindStringSubmatch(safeContent); len(firstTagMatch) > 2 {
-			tagName := firstTagMatch[1]
-			rootTagName = tagName
+// SetObserver registers a function called at the end of each Execute with the
+// timing and size of the render, which allows wiring skingo into metrics
+// systems such as Prometheus without depending on them. The observer is called
+// synchronously, so it should return quickly. Passing nil removes it, and no
+// measurement is done while no observer is set.
+func (ts *TemplateSet) SetObserver(observer func(event RenderEvent)) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.observer = observer
+}
 
-			// Extract classes from root element
-			rootAttributes := firstTagMatch[2]
-			if classMatches := classRegex.FindStringSubmatch(rootAttributes); len(classMatches) > 1 {
-				classStr := classMatches[1]
-				// Split classes by space and append
-				rootClasses = append(rootClasses, strings.Fields(classStr)...)
-			}
+// countingWriter counts the bytes written to w
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
 
-			// Verify if it ends with the corresponding closing tag
-			closeTagPattern := fmt.Sprintf(`</\s*%s\s*>\s*$`, regexp.QuoteMeta(tagName))
-			closeTagRegex := regexp.MustCompile(closeTagPattern)
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
 
-			if closeTagRegex.MatchString(safeContent) {
-				hasRootElement = true
+// limitWriter writes to w until the limit is reached
+type limitWriter struct {
+	w         io.Writer
+	remaining int64
+	limit     int64
+}
 
-				// Verify if it's a single element (without other elements between the tags)
-				innerContent := safeContent
-				innerContent = openTagRegex.ReplaceAllString(innerContent, "")
-				closeTagRegex := regexp.MustCompile(`</\s*[^>]+>\s*$`)
-				innerContent = closeTagRegex.ReplaceAllString(innerContent, "")
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) <= l.remaining {
+		n, err := l.w.Write(p)
+		l.remaining -= int64(n)
+		return n, err
+	}
 
-				if !strings.Contains(innerContent, "<") {
-					isSingleElement = true
-				} else {
-					isRootContainer = true
-				}
-			}
-		}
+	n, err := l.w.Write(p[:l.remaining])
+	l.remaining -= int64(n)
+	if err != nil {
+		return n, err
+	}
+	return n, fmt.Errorf("%w: render exceeded %d bytes", ErrOutputLimit, l.limit)
+}
 
-		// Extract the CSS
-		var css string
-		if cssMatches := cssRegex.FindStringSubmatch(string(content)); len(cssMatches) > 2 {
-			css = cssMatches[2]
-		}
+// limit wraps w with the configured output limit and, during a timed render,
+// stops writing once the render timed out.
+func (ts *TemplateSet) limit(w io.Writer) io.Writer {
+	ts.mu.Lock()
+	maxOutput := ts.maxOutput
+	cancel := ts.renderCancel
+	ts.mu.Unlock()
 
-		// If there is no CSS, we don't need to do anything with the scope
-		if css == "" {
-			// Nothing to do
-		} else if unwrap || hasRootElement {
-			if hasRootElement {
-				// Verify if there is a class attribute, adding our class in various possible situations
-				if strings.Contains(t.HTML, "class=\"") {
-					t.HTML = strings.Replace(t.HTML, "class=\"", fmt.Sprintf("class=\"%s ", t.scopeClass), 1)
-				} else if strings.Contains(t.HTML, "class='") {
-					t.HTML = strings.Replace(t.HTML, "class='", fmt.Sprintf("class='%s ", t.scopeClass), 1)
-				} else if strings.Contains(t.HTML, "class={{") {
-					t.HTML = strings.Replace(t.HTML, "class={{", fmt.Sprintf("class=\"%s {{", t.scopeClass), 1)
-				} else {
-					// Without class attribute, we need to add before the >
-					lastPos := -1
-					depth := 0
-					for i, char := range t.HTML {
-						if char == '{' {
-							depth++
-						} else if char == '}' {
-							depth--
-						} else if char == '>' && depth == 0 {
-							lastPos = i
-							break
-						}
-					}
+	if cancel != nil {
+		w = &abortWriter{w: w, cancel: cancel}
+	}
+	if maxOutput <= 0 {
+		return w
+	}
+	return &limitWriter{w: w, remaining: maxOutput, limit: maxOutput}
+}
 
-					if lastPos != -1 {
-						t.HTML = t.HTML[:lastPos] + fmt.Sprintf(" class=\"%s\"", t.scopeClass) + t.HTML[lastPos:]
-					}
-				}
+// SetRenderTimeout aborts Execute calls whose render takes longer than d with
+// an error wrapping ErrRenderTimeout. The template is rendered in a goroutine
+// and, once the timeout expires, nothing else is written to the writer and the
+// render stops at its next write. A template function that never returns still
+// blocks the following renders, so functions should honor their own deadlines.
+// A value of 0 or less disables the timeout, which is the default.
+func (ts *TemplateSet) SetRenderTimeout(d time.Duration) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.renderTimeout = d
+}
 
-				// Process CSS according to element type
-				var elementType int
-				if isSingleElement || unwrap {
-					elementType = ElementTypeSingle
-				} else if isRootContainer {
-					elementType = ElementTypeContainer
-				} else {
-					elementType = ElementTypeNormal
-				}
+// executeTimed runs render holding renderMu with ctx as the context of the
+// render, enforcing the render timeout
+func (ts *TemplateSet) executeTimed(ctx context.Context, w io.Writer, name string, render func(w io.Writer) error) error {
+	ts.mu.Lock()
+	timeout := ts.renderTimeout
+	ts.mu.Unlock()
 
-				t.CSS = scopedCSS(css, t.scopeClass, rootTagName, rootClasses, elementType)
-			} else {
-				// Without root element, but with unwrap, we use a custom selector instead of class
-				t.HTML = fmt.Sprintf(`<div class="%s" style="display:contents">%s</div>`, t.scopeClass, t.HTML)
-				t.CSS = containedScopedCSS(css, t.scopeClass)
-			}
-		} else {
-			// Default case: wrap with div
-			t.HTML = fmt.Sprintf(`<div class="%s">%s</div>`, t.scopeClass, t.HTML)
-			t.CSS = containedScopedCSS(css, t.scopeClass)
-		}
+	if timeout <= 0 {
+		ts.renderMu.Lock()
+		defer ts.renderMu.Unlock()
+		defer ts.setRenderContext(ctx, nil)()
+		return render(w)
 	}
 
-	// Extract the JS from tags script
-	if matches := jsRegex.FindStringSubmatch(string(content)); len(matches) > 1 {
-		t.JS = matches[1]
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	cw := &cancelWriter{w: w, stop: stop}
+	started := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		ts.renderMu.Lock()
+		defer ts.renderMu.Unlock()
+		defer ts.setRenderContext(ctx, cw)()
+
+		close(started)
+		done <- render(cw)
+	}()
+
+	// The timeout starts once the render holds the lock
+	<-started
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		cw.cancel()
+		ts.log().Error("render timeout exceeded", "template", name, "timeout", timeout)
+		return fmt.Errorf("%w: template %s took longer than %s", ErrRenderTimeout, name, timeout)
 	}
-
-	// Stores the template for later processing
-	ts.templates[t.Name] = t
-	ts.templateHTML[t.Name] = t.HTML
-
-	return nil
 }
 
-// finalizeParsing completes the template processing after all individual templates have been parsed
-func (ts *TemplateSet) finalizeParsing() error {
-	type compCall struct {
-		Args []interface{}
-		Name string
-	}
+// setRenderContext sets the context and the cancel writer of the render about
+// to start and returns a function that clears them. The caller must hold
+// renderMu.
+func (ts *TemplateSet) setRenderContext(ctx context.Context, cw *cancelWriter) func() {
+	ts.mu.Lock()
+	ts.renderCtx = ctx
+	ts.renderCancel = cw
+	ts.mu.Unlock()
 
-	// Component call stack for handling nested components
-	var compStack []compCall
-	var compMu sync.Mutex
+	return func() {
+		ts.mu.Lock()
+		ts.renderCtx = nil
+		ts.renderCancel = nil
+		ts.mu.Unlock()
+	}
+}
 
-	// Global functions for all templates
-	internalFuncs := template.FuncMap{
-		"_register_template": func(name string) string {
-			ts.mu.Lock()
-			defer ts.mu.Unlock()
-			ts.usedTemplates[name] = true
-			return ""
-		},
-		"dict": func(values ...interface{}) (map[string]interface{}, error) {
-			if len(values)%2 != 0 {
-				return nil, fmt.Errorf("dict needs key and value pairs as arguments")
-			}
-			dict := make(map[string]interface{}, len(values)/2)
-			for i := 0; i < len(values); i += 2 {
-				key, ok := values[i].(string)
-				if !ok {
-					return nil, fmt.Errorf("dict keys must be strings")
-				}
-				dict[key] = values[i+1]
-			}
-			return dict, nil
-		},
-		"param": func(index int) interface{} {
-			compMu.Lock()
-			defer compMu.Unlock()
+// cancelWriter writes to w until it is cancelled
+type cancelWriter struct {
+	w         io.Writer
+	stop      context.CancelFunc // Cancels the context of the render
+	mu        sync.Mutex
+	cancelled bool
+}
 
-			if len(compStack) == 0 {
-				return nil
-			}
+func (c *cancelWriter) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cancelled {
+		return 0, ErrRenderTimeout
+	}
+	return c.w.Write(p)
+}
 
-			current := compStack[len(compStack)-1]
-			if index < 0 || index >= len(current.Args) {
-				return nil
-			}
-			return current.Args[index]
-		},
-		"paramOr": func(index int, defaultValue interface{}) interface{} {
-			compMu.Lock()
-			defer compMu.Unlock()
+func (c *cancelWriter) cancel() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cancelled = true
+	c.stop()
+}
 
-			if len(compStack) == 0 {
-				return defaultValue
-			}
+func (c *cancelWriter) isCancelled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cancelled
+}
 
-			current := compStack[len(compStack)-1]
-			if index < 0 || index >= len(current.Args) {
-				return defaultValue
-			}
-			if current.Args[index] == nil {
-				return defaultValue
-			}
-			return current.Args[index]
-		},
-		"comp": func(templateName string, args ...interface{}) (template.HTML, error) {
-			name := strings.TrimSuffix(templateName, ".html")
+// abortWriter writes to w until the render of cancel is cancelled
+type abortWriter struct {
+	w      io.Writer
+	cancel *cancelWriter
+}
 
-			ts.mu.Lock()
-			ts.usedTemplates[name] = true
-			ts.mu.Unlock()
+func (a *abortWriter) Write(p []byte) (int, error) {
+	if a.cancel.isCancelled() {
+		return 0, ErrRenderTimeout
+	}
+	return a.w.Write(p)
+}
 
-			compMu.Lock()
-			compStack = append(compStack, compCall{
-				Args: args,
-				Name: name,
-			})
-			compMu.Unlock()
+// renderCSS executes the CSS template of a dynamic component with the given
+// data and stores the result for the current render.
+func (ts *TemplateSet) renderCSS(t *Template, data interface{}) error {
+	if t.cssTmpl == nil {
+		return nil
+	}
 
-			// Ensures stack removal when finished
-			defer func() {
-				compMu.Lock()
-				if len(compStack) > 0 {
-					compStack = compStack[:len(compStack)-1]
-				}
-				compMu.Unlock()
-			}()
+	var buf strings.Builder
+	if err := t.cssTmpl.Execute(&buf, data); err != nil {
+		return fmt.Errorf("error rendering CSS of template %s: %w", t.Name, err)
+	}
+	css := strings.TrimSuffix(strings.TrimPrefix(buf.String(), "<style>"), "</style>")
 
-			var buf strings.Builder
-			var data interface{}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.addRenderedCSS(t.Name, css)
+	return nil
+}
 
-			if len(args) == 1 {
-				if mapData, ok := args[0].(map[string]interface{}); ok {
-					data = mapData
-				} else {
-					data = map[string]interface{}{
-						"0": args[0],
-					}
-				}
-			} else {
-				dataMap := make(map[string]interface{})
-				for i, arg := range args {
-					dataMap[fmt.Sprintf("%d", i)] = arg
-				}
-				data = dataMap
-			}
+// addRenderedCSS records the CSS rendered for a dynamic template in the current
+// render, skipping duplicates. The caller must hold ts.mu.
+func (ts *TemplateSet) addRenderedCSS(name, css string) {
+	for _, entry := range ts.recorders {
+		entry.addCSS(name, css)
+	}
+	for _, rendered := range ts.renderedCSS[name] {
+		if rendered == css {
+			return
+		}
+	}
+	ts.renderedCSS[name] = append(ts.renderedCSS[name], css)
+}
 
-			tmplName := name
-			if !strings.HasSuffix(tmplName, ".html") {
-				tmplName = tmplName + ".html"
-			}
+// expectTemplates records the names of the templates that walk finds, so the
+// component tags of a template may refer to the ones parsed after it. Errors
+// are left to the walk that parses the files.
+func (ts *TemplateSet) expectTemplates(walk func(fn fs.WalkDirFunc) error) {
+	_ = walk(func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || isLayoutPath(path) || !ts.hasExtension(filepath.Ext(d.Name())) {
+			return nil
+		}
+		if ts.expected == nil {
+			ts.expected = make(map[string]bool)
+		}
+		ts.expected[strings.TrimSuffix(d.Name(), filepath.Ext(d.Name()))] = true
+		return nil
+	})
+}
 
-			if err := ts.masterTmpl.ExecuteTemplate(&buf, tmplName, data); err != nil {
-				return "", err
-			}
+// knownTemplate reports whether name is a template already parsed or about to
+// be parsed
+func (ts *TemplateSet) knownTemplate(name string) bool {
+	return ts.templates[name] != nil || ts.expected[name]
+}
 
-			return template.HTML(buf.String()), nil
-		},
+func (ts *TemplateSet) registerSource(name, source string) error {
+	if previous, exists := ts.sources[name]; exists && previous != source {
+		if !ts.allowOverride {
+			return fmt.Errorf("duplicate template name %q found in %s and %s", name, previous, source)
+		}
+		ts.overrides = append(ts.overrides, TemplateOverride{Name: name, Replaced: previous, Source: source})
 	}
+	ts.sources[name] = source
+	return nil
+}
 
-	// Add internal functions
-	ts.masterTmpl.Funcs(internalFuncs)
+func extractComponentNames(content string) []string {
+	matches := compCallRegex.FindAllStringSubmatch(content, -1)
+	if len(matches) == 0 {
+		return nil
+	}
 
-	// Second pass: create the templates and allow references between them
-	for name, html := range ts.templateHTML {
-		templateName := name
-		if !strings.HasSuffix(templateName, ".html") {
-			templateName = name + ".html"
+	seen := make(map[string]bool, len(matches))
+	names := make([]string, 0, len(matches))
+	for _, match := range matches {
+		if len(match) <= 1 {
+			continue
+		}
+		name := strings.TrimSuffix(match[1], ".html")
+		if seen[name] {
+			continue
 		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names
+}
 
-		// We modified the HTML to register the template when it is executed
-		registeredHTML := "{{_register_template \"" + name + "\"}}" + html
+func isLayoutPath(path string) bool {
+	return filepath.Base(filepath.Dir(path)) == layoutsDirName
+}
 
-		_, err := ts.masterTmpl.New(templateName).Parse(registeredHTML)
-		if err != nil {
-			return fmt.Errorf("error parsing template %s: %v", name, err)
+// generateScopeClass build a scope class based on the template name and returns
+func (ts *TemplateSet) generateScopeClass(name string) string {
+	if !ts.readable {
+		// build a hash basead in template name
+		hash := md5.Sum([]byte(name))
+		if ts.scopePrefix != "" {
+			// Return the name followed by the first four characters of the hash
+			return fmt.Sprintf("%s-%s-%x", ts.scopePrefix, slugify(name), hash[:2])
 		}
-
-		ts.templates[name].tmpl = ts.masterTmpl.Lookup(templateName)
+		// Return the first six characters of the hash
+		return fmt.Sprintf("s-%x", hash)[:8]
 	}
 
-	// Prepare the layout template with all functions
-	layoutFuncs := template.FuncMap{}
+	prefix := "s"
+	if ts.scopePrefix != "" {
+		prefix = ts.scopePrefix
+	}
+	base := prefix + "-" + slugify(name)
+	class := base
+	for i := 2; ; i++ {
+		owner, taken := ts.scopeOwners[class]
+		if !taken || owner == name {
+			break
+		}
+		class = fmt.Sprintf("%s-%d", base, i)
+	}
+	ts.scopeOwners[class] = name
+	return class
+}
 
-	// Combine default functions
-	for name, fn := range defaultFuncs {
-		layoutFuncs[name] = fn
+// slugify converts a template name into a lowercase string that is safe to use
+// inside a CSS class name.
+func slugify(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
 	}
 
-	// Add custom functions
-	for name, fn := range ts.customFuncs {
-		layoutFuncs[name] = fn
+	slug := strings.TrimSuffix(b.String(), "-")
+	if slug == "" {
+		return "component"
 	}
+	return slug
+}
 
-	// Add internal functions to layout - especially 'comp'
-	for name, fn := range internalFuncs {
-		// Add only useful functions for the layout
-		if name == "comp" || name == "dict" || name == "param" || name == "paramOr" {
-			layoutFuncs[name] = fn
+// addScopeClass adds scopeClass to the class attribute of the start tag at loc,
+// given as returned by findFirstTag, creating the attribute when it is absent.
+func addScopeClass(html string, loc []int, scopeClass string) string {
+	attrs := html[loc[4]:loc[5]]
+	if classLoc := classAttrRegex.FindStringSubmatchIndex(attrs); classLoc != nil {
+		start := loc[4] + classLoc[2]
+		if quote := attrs[classLoc[2]:classLoc[3]]; quote != "{{" {
+			return html[:start+1] + scopeClass + " " + html[start+1:]
+		} else if end := actionEnd(html, start); end != -1 {
+			// An unquoted action is quoted together with our class
+			return html[:start] + fmt.Sprintf("\"%s ", scopeClass) + html[start:end] + "\"" + html[end:]
 		}
+		return html
 	}
 
-	for name, layout := range ts.layouts {
-		layoutTmpl := template.New(name)
-		layoutTmpl.Funcs(layoutFuncs)
-
-		parsedLayout, err := layoutTmpl.Parse(layout.HTML)
-		if err != nil {
-			return fmt.Errorf("error parsing layout %s: %w", name, err)
+	// Without class attribute, we need to add before the >
+	lastPos := loc[5]
+	// Keep the class before the slash of self-closing tags
+	if lastPos > 0 && html[lastPos-1] == '/' {
+		lastPos--
+		for lastPos > 0 && html[lastPos-1] == ' ' {
+			lastPos--
 		}
-		layout.tmpl = parsedLayout
 	}
+	return html[:lastPos] + fmt.Sprintf(" class=\"%s\"", scopeClass) + html[lastPos:]
+}
 
-	return nil
+// restrictedElements are the elements only valid inside specific parents, like
+// <tr> inside a table, which a wrapper <div> would make invalid
+var restrictedElements = map[string]bool{
+	"caption": true, "col": true, "colgroup": true, "dd": true, "dt": true, "li": true, "optgroup": true,
+	"option": true, "tbody": true, "td": true, "tfoot": true, "th": true, "thead": true, "tr": true,
 }
 
-// parseFile analyze a file and extract HTML, CSS and JS
-func (ts *TemplateSet) parseFile(filename string, isLayout bool) error {
-	content, err := os.ReadFile(filename)
-	if err != nil {
-		return err
+// hasRestrictedTag reports whether any of the tags of html, given as returned
+// by topLevelTags, is a restricted element
+func hasRestrictedTag(html string, tags [][]int) bool {
+	for _, loc := range tags {
+		if restrictedElements[strings.ToLower(html[loc[2]:loc[3]])] {
+			return true
+		}
 	}
+	return false
+}
 
-	name := filepath.Base(filename)
-	name = strings.TrimSuffix(name, filepath.Ext(name))
+// topLevelTags returns the bounds of the start tags of html that are not inside
+// another element, as returned by findFirstTag. Template actions, comments and
+// the content of raw text elements are skipped.
+func topLevelTags(html string) [][]int {
+	var tags [][]int
+	depth := 0
+	for i := 0; i < len(html); {
+		switch {
+		case strings.HasPrefix(html[i:], "{{"):
+			end := actionEnd(html, i)
+			if end == -1 {
+				return tags
+			}
+			i = end
+		case strings.HasPrefix(html[i:], "<!--"):
+			end := strings.Index(html[i:], "-->")
+			if end == -1 {
+				return tags
+			}
+			i += end + len("-->")
+		case strings.HasPrefix(html[i:], "</"):
+			end := strings.IndexByte(html[i:], '>')
+			if end == -1 {
+				return tags
+			}
+			if depth > 0 {
+				depth--
+			}
+			i += end + 1
+		case html[i] == '<':
+			loc := findFirstTag(html[i:])
+			if loc == nil {
+				i++
+				continue
+			}
+			for j := range loc {
+				loc[j] += i
+			}
+			if depth == 0 {
+				tags = append(tags, loc)
+			}
+			i = loc[1]
 
-	return ts.processTemplate(name, content, filename, isLayout)
+			name := strings.ToLower(html[loc[2]:loc[3]])
+			if voidElements[name] || strings.HasSuffix(strings.TrimSpace(html[loc[4]:loc[5]]), "/") {
+				continue
+			}
+			depth++
+			// The content of raw text elements is not markup
+			if name == "script" || name == "style" || name == "textarea" || name == "title" {
+				if end := strings.Index(strings.ToLower(html[i:]), "</"+name); end != -1 {
+					i += end
+				}
+			}
+		default:
+			i++
+		}
+	}
+	return tags
 }
 
-// ParseDirs parses all HTML/template files in the given directories.
-// The method processes files with the .html or .tmpl extension, extracting
-// components that contain <template>, <style>, and <script> tags.
-//
-// For each file, the content inside the <template> tag is extracted as HTML.
-// The content inside the <style> tag is extracted as CSS and automatically
-// scoped using unique classes to avoid conflicts.
-// The content inside the <script> tag is extracted as JavaScript.
-//
-// The method walks directories recursively and requires that a layout template
-// (defined when creating the TemplateSet) be found inside a layouts directory.
-//
-// After processing, the templates are available for rendering via
-// the Execute method, with their CSS styles and JS scripts automatically
-// included in the appropriate places in the layout.
-//
-// Returns an error if any directory cannot be read, if any template
-// cannot be parsed, or if the layout template is not found in a layouts directory.
-func (ts *TemplateSet) ParseDirs(dirs ...string) error {
-	layoutFound := false
+// findFirstTag locates the start tag that opens html. Like the index of a
+// regexp submatch, it returns the bounds of the whole tag, of its name and of
+// its attributes, or nil if html does not start with a tag.
+func findFirstTag(html string) []int {
+	loc := firstTagRegex.FindStringSubmatchIndex(html)
+	if loc == nil {
+		return nil
+	}
+	end := tagEnd(html, loc[3])
+	if end == -1 {
+		return nil
+	}
+	return []int{loc[0], end + 1, loc[2], loc[3], loc[3], end}
+}
 
-	for _, dir := range dirs {
-		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
-			if err != nil {
-				return err
+// tagEnd returns the index of the ">" that closes the tag whose attributes
+// start at start, or -1 if the tag is not closed. Quoted attribute values and
+// template actions are skipped, since both may contain ">" themselves.
+func tagEnd(html string, start int) int {
+	var quote byte
+	for i := start; i < len(html); i++ {
+		switch c := html[i]; {
+		case strings.HasPrefix(html[i:], "{{"):
+			end := actionEnd(html, i)
+			if end == -1 {
+				return -1
 			}
-			if d.IsDir() {
-				return nil
+			i = end - 1
+		case quote != 0:
+			if c == quote {
+				quote = 0
 			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '>':
+			return i
+		}
+	}
+	return -1
+}
 
-			ext := filepath.Ext(d.Name())
-			if ext != ".html" && ext != ".tmpl" {
-				return nil
+// actionEnd returns the index right after the "}}" that closes the template
+// action starting at start, skipping the strings and comments inside it. It
+// returns -1 if the action is not closed.
+func actionEnd(html string, start int) int {
+	var quote byte
+	for i := start + 2; i < len(html); i++ {
+		switch c := html[i]; {
+		case quote != 0:
+			if c == '\\' && quote != '`' {
+				i++
+			} else if c == quote {
+				quote = 0
 			}
+		case c == '"' || c == '\'' || c == '`':
+			quote = c
+		case strings.HasPrefix(html[i:], "/*"):
+			end := strings.Index(html[i+2:], "*/")
+			if end == -1 {
+				return -1
+			}
+			i += end + 3
+		case strings.HasPrefix(html[i:], "}}"):
+			return i + 2
+		}
+	}
+	return -1
+}
 
-			name := strings.TrimSuffix(d.Name(), ext)
-			isLayout := isLayoutPath(path)
-			if isLayout && name == ts.layoutName {
-				layoutFound = true
+// markRootAttrs inserts the actions that render the caller attrs right after
+// the tag name of the root element and the caller class at the end of its class
+// attribute. A root without a class attribute receives the caller class from
+// the attrs action, while a class attribute that already contains template
+// actions is left to the component. The other static attributes of the root
+// are only rendered when the caller does not pass a replacement for them.
+func markRootAttrs(html string) string {
+	loc := findFirstTag(html)
+	if loc == nil {
+		return html
+	}
+
+	attrs := guardRootAttrs(html[loc[4]:loc[5]])
+	classLoc := rootClassRegex.FindStringSubmatchIndex(attrs)
+	if classLoc == nil {
+		return html[:loc[3]] + "{{ _root_attrs . true }}" + attrs + html[loc[5]:]
+	}
+
+	// End of the class value, inside the quotes
+	end := classLoc[3]
+	if classLoc[2] == -1 {
+		end = classLoc[5]
+	}
+	if !strings.Contains(attrs[classLoc[0]:end], "{{") {
+		attrs = attrs[:end] + "{{ _root_class . }}" + attrs[end:]
+	}
+	return html[:loc[3]] + "{{ _root_attrs . false }}" + attrs + html[loc[5]:]
+}
+
+// guardRootAttrs wraps each static attribute of the root element, except the
+// class, in an action that drops it when the caller attrs replace it. Template
+// actions and attributes whose values contain actions are kept as they are.
+func guardRootAttrs(attrs string) string {
+	var b strings.Builder
+	for i := 0; i < len(attrs); {
+		start := i
+		for i < len(attrs) && isHTMLSpace(attrs[i]) {
+			i++
+		}
+		if strings.HasPrefix(attrs[i:], "{{") {
+			end := actionEnd(attrs, i)
+			if end == -1 {
+				end = len(attrs)
 			}
+			b.WriteString(attrs[start:end])
+			i = end
+			continue
+		}
 
-			if err := ts.parseFile(path, isLayout); err != nil {
-				return fmt.Errorf("error parsing file %s: %w", path, err)
+		nameStart := i
+		for i < len(attrs) && !isHTMLSpace(attrs[i]) && !strings.ContainsRune("=/>\"'{", rune(attrs[i])) {
+			i++
+		}
+		name := attrs[nameStart:i]
+		if name == "" {
+			if i < len(attrs) {
+				i++
 			}
+			b.WriteString(attrs[start:i])
+			continue
+		}
 
-			return nil
-		})
+		// Optional value, quoted or not
+		valueEnd := i
+		for valueEnd < len(attrs) && isHTMLSpace(attrs[valueEnd]) {
+			valueEnd++
+		}
+		if valueEnd < len(attrs) && attrs[valueEnd] == '=' {
+			valueEnd++
+			for valueEnd < len(attrs) && isHTMLSpace(attrs[valueEnd]) {
+				valueEnd++
+			}
+			valueEnd = attrValueEnd(attrs, valueEnd)
+			i = valueEnd
+		}
 
-		if err != nil {
-			if os.IsNotExist(err) {
-				return fmt.Errorf("error reading directory %s: %w", dir, err)
+		attr := attrs[start:i]
+		if strings.EqualFold(name, "class") || !attrNameRegex.MatchString(name) || strings.Contains(attr, "{{") {
+			b.WriteString(attr)
+			continue
+		}
+		b.WriteString(`{{ if not (_has_root_attr . "` + name + `") }}` + attr + "{{ end }}")
+	}
+	return b.String()
+}
+
+// attrValueEnd returns the index right after the attribute value starting at
+// start. Template actions inside the value are skipped.
+func attrValueEnd(attrs string, start int) int {
+	var quote byte
+	if start < len(attrs) && (attrs[start] == '"' || attrs[start] == '\'') {
+		quote = attrs[start]
+		start++
+	}
+	for i := start; i < len(attrs); i++ {
+		switch c := attrs[i]; {
+		case strings.HasPrefix(attrs[i:], "{{"):
+			end := actionEnd(attrs, i)
+			if end == -1 {
+				return len(attrs)
 			}
-			return fmt.Errorf("error processing directory %s: %w", dir, err)
+			i = end - 1
+		case quote != 0 && c == quote:
+			return i + 1
+		case quote == 0 && (isHTMLSpace(c) || c == '>'):
+			return i
 		}
 	}
+	return len(attrs)
+}
 
-	if !layoutFound {
-		return fmt.Errorf("layout template '%s' not found in any layouts directory in the provided directories", ts.layoutName)
+// isHTMLSpace reports whether c separates attributes inside a tag
+func isHTMLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+// inComponent reports whether a component called with comp is being rendered.
+// The class and attrs of the data only reach the root element of components,
+// so the data given to Execute never changes the root of the page.
+func (ts *TemplateSet) inComponent() bool {
+	ts.compMu.Lock()
+	defer ts.compMu.Unlock()
+	return len(ts.compStack) > 0
+}
+
+// rootClass returns the classes passed by the caller under the "class" key of
+// the component data or of its attrs, prefixed by a space so they follow the
+// existing classes.
+func rootClass(data interface{}) string {
+	values, ok := data.(map[string]interface{})
+	if !ok {
+		return ""
 	}
 
-	return ts.finalizeParsing()
+	var classes []string
+	for _, value := range []interface{}{values["class"], callerAttrs(values)["class"]} {
+		if value != nil {
+			classes = append(classes, strings.Fields(fmt.Sprint(value))...)
+		}
+	}
+	if len(classes) == 0 {
+		return ""
+	}
+	return " " + strings.Join(classes, " ")
 }
 
-// ParseFS parses all HTML/template files in the given embedded filesystem.
-// This method allows using Go's embed feature to include templates
-// directly in the binary.
-//
-// The method accepts multiple root directories within the filesystem to scan for templates.
-// It processes files with the .html or .tmpl extension, extracting
-// components that contain <template>, <style>, and <script> tags.
-//
-// Similar to ParseDirs, this method requires that a layout template
-// (defined when creating the TemplateSet) be found inside a layouts directory.
-//
-// Example usage with embed:
-//
-//	//go:embed templates
-//	var templateFS embed.FS
-//
-//	ts := skingo.NewTemplateSet("layout")
-//	err := ts.ParseFS(templateFS, "templates")
+// callerAttrs returns a copy of the "attrs" entry of the component data
+func callerAttrs(values map[string]interface{}) map[string]interface{} {
+	attrs := make(map[string]interface{})
+	switch v := values["attrs"].(type) {
+	case map[string]interface{}:
+		for name, value := range v {
+			attrs[name] = value
+		}
+	case map[string]string:
+		for name, value := range v {
+			attrs[name] = value
+		}
+	}
+	return attrs
+}
+
+// urlAttrs lists the attributes whose values are URLs. Their values must use a
+// safe scheme to be rendered, as html/template does for URLs in templates.
+var urlAttrs = map[string]bool{
+	"href":       true,
+	"src":        true,
+	"action":     true,
+	"formaction": true,
+	"xlink:href": true,
+}
+
+// safeRootAttrs returns the caller attrs that are rendered on the root element,
+// without the class. Invalid names, event handlers ("on*") and style are
+// skipped, since their values would not be escaped for JS or CSS, as are URL
+// attributes with an unsafe scheme and nil or false values.
+func safeRootAttrs(values map[string]interface{}) map[string]interface{} {
+	attrs := callerAttrs(values)
+	for name, value := range attrs {
+		lower := strings.ToLower(name)
+		switch {
+		case lower == "class", lower == "style", strings.HasPrefix(lower, "on"), !attrNameRegex.MatchString(name):
+			delete(attrs, name)
+		case value == nil || value == false:
+			delete(attrs, name)
+		case urlAttrs[lower] && !safeURL(fmt.Sprint(value)):
+			delete(attrs, name)
+		}
+	}
+	return attrs
+}
+
+// safeURL reports whether the URL is relative or uses the http, https or
+// mailto scheme.
+func safeURL(url string) bool {
+	i := strings.IndexRune(url, ':')
+	if i < 0 || strings.ContainsRune(url[:i], '/') {
+		return true
+	}
+	switch strings.ToLower(strings.TrimSpace(url[:i])) {
+	case "http", "https", "mailto":
+		return true
+	}
+	return false
+}
+
+// hasRootAttr reports whether the caller attrs render the named attribute, so
+// the static attribute of the root element is dropped in favor of it.
+func hasRootAttr(data interface{}, name string) bool {
+	values, ok := data.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	for attr := range safeRootAttrs(values) {
+		if strings.EqualFold(attr, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// rootAttrs renders the "attrs" entry of the component data as HTML attributes.
+// The entry may be a map[string]interface{} or a map[string]string. Values are
+// escaped, true renders a boolean attribute and false or nil omit it. Unsafe
+// attributes are skipped, see safeRootAttrs. When withClass is true, the root
+// has no class attribute and the caller class is rendered as one.
+func rootAttrs(data interface{}, withClass bool) template.HTMLAttr {
+	values, ok := data.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+
+	// The classes are merged with the class attribute of the root
+	attrs := safeRootAttrs(values)
+	if class := rootClass(data); withClass && class != "" {
+		attrs["class"] = strings.TrimSpace(class)
+	}
+
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		switch value := attrs[name].(type) {
+		case bool:
+			b.WriteString(" " + name)
+		default:
+			b.WriteString(fmt.Sprintf(` %s="%s"`, name, template.HTMLEscapeString(fmt.Sprint(value))))
+		}
+	}
+	return template.HTMLAttr(b.String())
+}
+
+// scopedCSS creates CSS scope for elements inside a container
+// (for example, when elements are inside a div with the scope class)
 //
-// Returns an error if any template cannot be parsed
-// or if the layout template is not found in a layouts directory.
-func (ts *TemplateSet) ParseFS(filesystem fs.FS, roots ...string) error {
-	layoutFound := false
+// The combinator links the scope class to the selectors of the descendants of
+// the root element: " " matches them at any depth, while " > " only matches
+// the direct children, so the elements of nested components are left alone.
+func scopedCSS(css string, scopeClass string, rootElementTag string, rootClasses []string, elementType int, combinator string) string {
+	return scopeRules(css, func(selectors, declarations string) string {
+		var b strings.Builder
+		b.Grow(len(selectors) + len(declarations) + 2*len(scopeClass) + 8)
 
-	for _, root := range roots {
-		// Read all files in this root directory of the filesystem
-		err := fs.WalkDir(filesystem, root, func(path string, d fs.DirEntry, err error) error {
-			if err != nil {
-				return err
+		// Split multiple selectors (separated by commas)
+		for rest := selectors; rest != ""; {
+			var selector string
+			selector, rest, _ = strings.Cut(rest, ",")
+			selector = strings.TrimSpace(selector)
+			if selector == "" {
+				continue
+			}
+			if b.Len() > 0 {
+				b.WriteString(", ")
 			}
 
-			// Skip directories
-			if d.IsDir() {
-				return nil
+			// The root element is matched without its pseudo-classes and
+			// pseudo-elements: "nav:hover" -> "nav" + ":hover"
+			base, pseudo := splitPseudo(selector)
+
+			if base == rootElementTag {
+				// Is it the root element, add the class directly
+				b.WriteString(base + "." + scopeClass + pseudo)
+			} else if strings.HasPrefix(selector, ".") {
+				// Extract the class name without the dot
+				className := base[1:]
+
+				// Verify if it's a single element or the class is in the root element
+				useDirectScope := false
+
+				if elementType == ElementTypeSingle {
+					// For single elements, all classes are treated without space
+					useDirectScope = true
+				} else {
+					// For other types, check if the class is in the root element
+					for _, rootClass := range rootClasses {
+						if rootClass == className {
+							useDirectScope = true
+							break
+						}
+					}
+				}
+
+				if useDirectScope {
+					// Without espace: ".class" -> ".s-xxxxx.class"
+					b.WriteString("." + scopeClass + selector)
+				} else {
+					// With espace: ".class" -> ".s-xxxxx .class"
+					b.WriteString("." + scopeClass + combinator + selector)
+				}
+			} else if strings.HasPrefix(selector, ":") {
+				// Is a pseudo-class
+				if rootElementTag != "" {
+					b.WriteString(rootElementTag + "." + scopeClass + selector)
+				} else {
+					b.WriteString("." + scopeClass + selector)
+				}
+			} else {
+				// Is other element, or a selector with children or siblings
+				b.WriteString("." + scopeClass + combinator + selector)
+			}
+		}
+
+		b.WriteString(" {" + declarations + "}\n")
+		return b.String()
+	})
+}
+
+// splitPseudo splits a compound selector followed only by pseudo-classes and
+// pseudo-elements, such as ".menu:hover", into ".menu" and ":hover". Other
+// selectors are returned whole with an empty suffix.
+func splitPseudo(selector string) (string, string) {
+	end := compoundEnd(selector)
+	if end == 0 || end == len(selector) || selector[end] != ':' {
+		return selector, ""
+	}
+
+	depth := 0
+	for i := end; i < len(selector); i++ {
+		switch c := selector[i]; {
+		case c == '[' || c == '(':
+			depth++
+		case c == ']' || c == ')':
+			depth--
+		case depth == 0 && strings.IndexByte(" >+~", c) != -1:
+			return selector, ""
+		}
+	}
+	return selector[:end], selector[end:]
+}
+
+// fragmentScopedCSS creates CSS scope for a component that is not wrapped in a
+// container, whose top-level elements carry the scope class themselves. Each
+// selector matches both the top-level elements and the elements inside them,
+// which are linked to them by combinator like in scopedCSS.
+func fragmentScopedCSS(css string, scopeClass string, combinator string) string {
+	return scopeRules(css, func(selectors, declarations string) string {
+		var b strings.Builder
+		b.Grow(2*len(selectors) + len(declarations) + 4*len(scopeClass) + 8)
+
+		// Split multiple selectors (separated by commas)
+		for rest := selectors; rest != ""; {
+			var selector string
+			selector, rest, _ = strings.Cut(rest, ",")
+			selector = strings.TrimSpace(selector)
+			if selector == "" {
+				continue
+			}
+			if b.Len() > 0 {
+				b.WriteString(", ")
+			}
+
+			// The class is added to the first compound selector, before its
+			// pseudo-classes and pseudo-elements: "tr:hover td" -> "tr.s-xxxxx:hover td"
+			end := compoundEnd(selector)
+			b.WriteString(selector[:end] + "." + scopeClass + selector[end:])
+			b.WriteString(", ." + scopeClass + combinator + selector)
+		}
+
+		b.WriteString(" {" + declarations + "}\n")
+		return b.String()
+	})
+}
+
+// compoundEnd returns the index where the type, class, id and attribute parts
+// of the first compound selector of selector end, which is its first
+// pseudo-class, pseudo-element or combinator.
+func compoundEnd(selector string) int {
+	depth := 0
+	for i := 0; i < len(selector); i++ {
+		switch c := selector[i]; {
+		case c == '[' || c == '(':
+			depth++
+		case c == ']' || c == ')':
+			depth--
+		case depth == 0 && strings.IndexByte(": >+~", c) != -1:
+			return i
+		}
+	}
+	return len(selector)
+}
+
+// containedScopedCSS creates CSS scope for elements inside a container
+// (for example, when elements are inside a div with the scope class), linked
+// to it by combinator like in scopedCSS.
+func containedScopedCSS(css string, scopeClass string, combinator string) string {
+	return scopeRules(css, func(selectors, declarations string) string {
+		var b strings.Builder
+		b.Grow(len(selectors) + len(declarations) + 2*len(scopeClass) + 8)
+
+		// Split multiple selectors (separated by commas)
+		for rest := selectors; rest != ""; {
+			var selector string
+			selector, rest, _ = strings.Cut(rest, ",")
+			selector = strings.TrimSpace(selector)
+			if selector == "" {
+				continue
+			}
+			if b.Len() > 0 {
+				b.WriteString(", ")
+			}
+
+			// For any type of selector, we use the scope class as the ancestor
+			// This works for elements (h1, p, a) and for classes (.btn, .blue)
+			b.WriteString("." + scopeClass + combinator + selector)
+		}
+
+		b.WriteString(" {" + declarations + "}\n")
+		return b.String()
+	})
+}
+
+// qualifyScope restricts the scope class selectors of css to the element that
+// wraps the component, unless it is a plain <div>
+func qualifyScope(css, scopeClass, element string) string {
+	if element == "div" {
+		return css
+	}
+
+	// Only whole class tokens are qualified, so .s-card leaves .s-card-title alone
+	class := "." + scopeClass
+	var b strings.Builder
+	for {
+		i := strings.Index(css, class)
+		if i == -1 {
+			b.WriteString(css)
+			return b.String()
+		}
+		end := i + len(class)
+		b.WriteString(css[:i])
+		if end == len(css) || !isClassChar(css[end]) {
+			b.WriteString(element)
+		}
+		b.WriteString(class)
+		css = css[end:]
+	}
+}
+
+// isClassChar reports whether c may continue a class name in a selector
+func isClassChar(c byte) bool {
+	return c == '-' || c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80
+}
+
+// endsWithCloseTag reports whether html ends with the closing tag of tagName,
+// ignoring the trailing whitespace.
+func endsWithCloseTag(html, tagName string) bool {
+	const space = " \t\n\f\r"
+	html = strings.TrimRight(html, space)
+	start := strings.LastIndex(html, "</")
+	if start == -1 || !strings.HasSuffix(html, ">") {
+		return false
+	}
+	return strings.Trim(html[start+2:len(html)-1], space) == tagName
+}
+
+// rewriteCSSURLs replaces the URLs of the url(...) values of css with the
+// result of rewrite, keeping their quotes. Data URIs and URLs containing
+// template actions are left unchanged.
+func rewriteCSSURLs(css string, rewrite func(url string) string) string {
+	return cssURLRegex.ReplaceAllStringFunc(css, func(match string) string {
+		groups := cssURLRegex.FindStringSubmatch(match)
+		url, quote := groups[3], ""
+		if groups[1] != "" {
+			url, quote = groups[1], `"`
+		} else if groups[2] != "" {
+			url, quote = groups[2], "'"
+		}
+
+		if url == "" || strings.HasPrefix(strings.ToLower(url), "data:") || strings.Contains(url, "{{") {
+			return match
+		}
+		return "url(" + quote + rewrite(url) + quote + ")"
+	})
+}
+
+// cssGroupRules are the at-rules whose blocks contain style rules, which are
+// scoped like the rules outside them
+var cssGroupRules = []string{"@layer", "@media", "@supports", "@container"}
+
+// scopeRules calls scopeRule with the selectors and declarations of each style
+// rule of css and returns the concatenated results. The blocks of grouping
+// at-rules, such as "@layer components { ... }" and "@media (...) { ... }",
+// are kept with their rules scoped, while statement at-rules such as
+// "@layer base, components;" and the at-rules without selectors, such as
+// "@font-face { ... }" and "@keyframes spin { ... }", are passed through
+// untouched, since what they define is global.
+func scopeRules(css string, scopeRule func(selectors, declarations string) string) string {
+	var out strings.Builder
+
+	for strings.TrimSpace(css) != "" {
+		open := strings.Index(css, "{")
+		if semi := strings.Index(css, ";"); strings.HasPrefix(strings.TrimSpace(css), "@") && semi != -1 && (open == -1 || semi < open) {
+			out.WriteString(strings.TrimSpace(css[:semi+1]) + "\n")
+			css = css[semi+1:]
+			continue
+		}
+		if open == -1 {
+			break
+		}
+
+		// Find the matching closing brace, ignoring braces inside strings
+		end := len(css)
+		depth := 0
+		var quote byte
+	scan:
+		for i := open; i < len(css); i++ {
+			switch c := css[i]; {
+			case quote != 0:
+				if c == '\\' {
+					i++
+				} else if c == quote {
+					quote = 0
+				}
+			case c == '"' || c == '\'':
+				quote = c
+			case c == '{':
+				depth++
+			case c == '}':
+				depth--
+				if depth == 0 {
+					end = i
+					break scan
+				}
 			}
+		}
+
+		prelude := css[:open]
+		body := css[open+1 : end]
+		if end < len(css) {
+			css = css[end+1:]
+		} else {
+			css = ""
+		}
+
+		if isGroupRule(prelude) {
+			out.WriteString(strings.TrimSpace(prelude) + " {\n" + scopeRules(body, scopeRule) + "}\n")
+		} else if strings.HasPrefix(strings.TrimSpace(prelude), "@") {
+			out.WriteString(strings.TrimSpace(prelude) + " {" + body + "}\n")
+		} else {
+			out.WriteString(scopeRule(prelude, body))
+		}
+	}
+
+	return out.String()
+}
+
+// isGroupRule reports whether prelude starts a grouping at-rule
+func isGroupRule(prelude string) bool {
+	prelude = strings.ToLower(strings.TrimSpace(prelude))
+	for _, rule := range cssGroupRules {
+		if prelude == rule || strings.HasPrefix(prelude, rule+" ") || strings.HasPrefix(prelude, rule+"(") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseLayoutFile processes a layout template file
+func (ts *TemplateSet) parseLayoutFile(name string, content string) error {
+	layout, err := newLayout(content, !ts.disableJS)
+	if err != nil {
+		return err
+	}
+
+	ts.layouts[name] = layout
+	ts.layoutUses[name] = extractComponentNames(layout.HTML)
+	if name == ts.layoutName {
+		ts.layout = layout
+	}
+
+	return nil
+}
+
+// newLayout returns a layout for content, with the CSS and JS of the used
+// templates injected at the <!-- skingo:css --> and <!-- skingo:js --> markers
+// or, when they are absent, before the </head> and </body> tags. Without
+// withJS, no script tag is injected and the JS marker is removed.
+func newLayout(content string, withJS bool) (*Layout, error) {
+	layout := &Layout{
+		HTML: content,
+	}
+
+	if !strings.Contains(layout.HTML, ".Yield") {
+		return nil, fmt.Errorf("layout template must contain {{ .Yield }}")
+	}
+
+	// Insert the style tag for the template at the <!-- skingo:css --> marker
+	// or, without it, before the </head>
+	var cssStart, cssEnd int
+	if loc := cssMarkerRegex.FindStringIndex(layout.HTML); loc != nil {
+		cssStart, cssEnd = loc[0], loc[1]
+	} else if headCloseIndex := strings.Index(layout.HTML, "</head>"); headCloseIndex != -1 {
+		cssStart, cssEnd = headCloseIndex, headCloseIndex
+	} else {
+		return nil, fmt.Errorf("layout template must contain </head> tag or a <!-- skingo:css --> marker")
+	}
+
+	layout.HTML = layout.HTML[:cssStart] +
+		"\n\t{{ if .CriticalCSS }}<style>{{ .CriticalCSS }}</style>{{ end }}" +
+		"{{ if .CSSHref }}{{ if .CriticalCSS }}<link rel=\"stylesheet\" href=\"{{ .CSSHref }}\" media=\"print\" onload=\"this.media='all'\">" +
+		"<noscript><link rel=\"stylesheet\" href=\"{{ .CSSHref }}\"></noscript>" +
+		"{{ else }}<link rel=\"stylesheet\" href=\"{{ .CSSHref }}\">{{ end }}" +
+		"{{ else if not .CriticalCSS }}<style>{{ .CSS }}</style>{{ end }}{{ .StructuredData }}\n" +
+		layout.HTML[cssEnd:]
+
+	if !withJS {
+		layout.HTML = jsMarkerRegex.ReplaceAllLiteralString(layout.HTML, "")
+		return layout, nil
+	}
+
+	// Insert the script tag for the template at the <!-- skingo:js --> marker
+	// or, without it, before the </body>
+	var jsStart, jsEnd int
+	if loc := jsMarkerRegex.FindStringIndex(layout.HTML); loc != nil {
+		jsStart, jsEnd = loc[0], loc[1]
+	} else if bodyCloseIndex := strings.Index(layout.HTML, "</body>"); bodyCloseIndex != -1 {
+		jsStart, jsEnd = bodyCloseIndex, bodyCloseIndex
+	} else {
+		return nil, fmt.Errorf("layout template must contain </body> tag or a <!-- skingo:js --> marker")
+	}
+
+	layout.HTML = layout.HTML[:jsStart] +
+		"\n\t{{ .Scripts }}<script>{{ .JS }}</script>\n" +
+		layout.HTML[jsEnd:]
+
+	return layout, nil
+}
+
+// matchTemplateBlock finds the outer <template> element of content, balancing
+// the native <template> elements nested in it, which a component may contain
+// for client-side cloning. Like a regexp submatch, it returns the whole
+// element, the attributes of its opening tag and its content, or nil when
+// content has no complete <template> element.
+func matchTemplateBlock(content string) []string {
+	depth := 0
+	var start, contentStart int
+	var attrs string
+	for _, loc := range templateRegex.FindAllStringSubmatchIndex(content, -1) {
+		if loc[2] == loc[3] {
+			// Opening tag
+			if depth == 0 {
+				start, contentStart = loc[0], loc[1]
+				if loc[4] != -1 {
+					attrs = content[loc[4]:loc[5]]
+				}
+			}
+			depth++
+		} else if depth > 0 {
+			depth--
+			if depth == 0 {
+				return []string{content[start:loc[1]], attrs, content[contentStart:loc[0]]}
+			}
+		}
+	}
+	return nil
+}
+
+// componentTags are the tags that delimit the parts of a component file
+var componentTags = []struct {
+	name  string
+	open  *regexp.Regexp
+	close *regexp.Regexp
+}{
+	{"template", regexp.MustCompile(`(?i)<template[\s>]`), regexp.MustCompile(`(?i)</template\s*>`)},
+	{"style", regexp.MustCompile(`(?i)<style[\s>]`), regexp.MustCompile(`(?i)</style\s*>`)},
+	{"script", regexp.MustCompile(`(?i)<script[\s>]`), regexp.MustCompile(`(?i)</script\s*>`)},
+}
+
+// checkClosedTags returns an error if a <template>, <style> or <script> tag of
+// content is not closed, since the extraction would otherwise silently produce
+// an empty part.
+func checkClosedTags(content string) error {
+	for _, tag := range componentTags {
+		opened := tag.open.FindAllStringIndex(content, -1)
+		closed := len(tag.close.FindAllStringIndex(content, -1))
+		if len(opened) > closed {
+			// The parts are not nested, so the closed tags are the first ones opened
+			line := strings.Count(content[:opened[closed][0]], "\n") + 1
+			return fmt.Errorf("unclosed <%s> tag opened on line %d", tag.name, line)
+		}
+	}
+	return nil
+}
+
+// processTemplate processes a single template and extracts HTML, CSS, and JS
+func (ts *TemplateSet) processTemplate(name string, content []byte, source string, isLayout bool) error {
+	if err := ts.registerSource(name, source); err != nil {
+		return err
+	}
+
+	// Process layout in a special way
+	if isLayout {
+		return ts.parseLayoutFile(name, ts.convertDelims(string(content), true))
+	}
+
+	if err := checkClosedTags(string(content)); err != nil {
+		return err
+	}
+
+	t := &Template{
+		Name:       name,
+		scopeClass: ts.generateScopeClass(name),
+		parseOrder: ts.parsed,
+	}
+	ts.parsed++
+
+	// Extract the HTML, CSS and JS from template tags
+	if matches := matchTemplateBlock(string(content)); len(matches) > 1 {
+		templateAttrs := matches[1]
+		templateContent := ts.convertDelims(matches[2], true)
+		if _, custom := ts.customFuncs["slot"]; !custom {
+			templateContent = rewriteSlots(templateContent)
+		}
+		templateContent, blocks, err := rewriteComponentTags(templateContent, name, ts.knownTemplate)
+		if err != nil {
+			return err
+		}
+		t.blocks = blocks
+		trimmedContent := strings.TrimSpace(templateContent)
+
+		// Full documents keep their doctype out of the root element processing
+		doctype := doctypeRegex.FindString(trimmedContent)
+		trimmedContent = trimmedContent[len(doctype):]
+
+		// Verify if has unwrap attribute
+		unwrap := unwrapRegex.MatchString(templateAttrs)
+		t.typed = typedRegex.MatchString(templateAttrs)
+
+		t.HTML = trimmedContent
+		t.raw = doctype + trimmedContent
+
+		// Verify if it starts with an opening tag and find which it is
+		hasRootElement := false
+		isSingleElement := false
+		isRootContainer := false // Flag for identifying a root container
+		rootTagName := ""
+		rootClasses := []string{} // Store the classes of the root element
+
+		// Regex for finding the first opening tag
+		if loc := findFirstTag(trimmedContent); loc != nil {
+			tagName := trimmedContent[loc[2]:loc[3]]
+			rootTagName = tagName
+
+			// Extract classes from root element
+			rootAttributes := trimmedContent[loc[4]:loc[5]]
+			if classMatches := classRegex.FindStringSubmatch(rootAttributes); len(classMatches) > 1 {
+				classStr := classMatches[1]
+				// Split classes by space and append
+				rootClasses = append(rootClasses, strings.Fields(classStr)...)
+			}
+
+			// A void or self-closing element alone is a single root element
+			isVoid := voidElements[strings.ToLower(tagName)] || strings.HasSuffix(strings.TrimSpace(rootAttributes), "/")
+			if isVoid && loc[1] == len(trimmedContent) {
+				hasRootElement = true
+				isSingleElement = true
+			} else if endsWithCloseTag(trimmedContent, tagName) && len(topLevelTags(trimmedContent)) == 1 {
+				// It ends with the corresponding closing tag, and sibling
+				// elements such as "<li>a</li><li>b</li>" are not a root
+				hasRootElement = true
+
+				// Verify if it's a single element (without other elements between the tags)
+				innerContent := trimmedContent[loc[1]:]
+				innerContent = closeTagRegex.ReplaceAllString(innerContent, "")
+
+				if !strings.Contains(innerContent, "<") {
+					isSingleElement = true
+				} else {
+					isRootContainer = true
+				}
+			}
+		}
+
+		// Extract the CSS of every <style> block outside the template, in order,
+		// since the blocks inside it are part of the HTML. Blocks declared with
+		// <style global> or <style scoped="false"> are kept apart and not scoped,
+		// and blocks with a media attribute are wrapped in a matching @media rule.
+		var scoped, global, original []string
+		cssSource := strings.Replace(string(content), matches[0], "", 1)
+		for _, cssMatches := range cssRegex.FindAllStringSubmatch(cssSource, -1) {
+			block := cssMatches[2]
+			if ts.dynamicCSS {
+				block = ts.convertDelims(block, false)
+			}
+			original = append(original, block)
+			t.critical = t.critical || criticalRegex.MatchString(cssMatches[1])
+
+			if ts.urlRewriter != nil {
+				block = rewriteCSSURLs(block, ts.urlRewriter)
+			}
+			if media := mediaRegex.FindStringSubmatch(cssMatches[1]); media != nil {
+				if query := strings.TrimSpace(media[1] + media[2]); query != "" && !strings.EqualFold(query, "all") {
+					block = "@media " + query + " {\n" + strings.TrimSpace(block) + "\n}"
+				}
+			}
+			if globalRegex.MatchString(cssMatches[1]) {
+				global = append(global, strings.TrimSpace(block))
+			} else {
+				scoped = append(scoped, block)
+			}
+		}
+		t.original = strings.Join(original, "\n")
+		css := strings.Join(scoped, "\n")
+
+		// Protect template actions so their braces do not interfere with scoping
+		dynamic := ts.dynamicCSS && strings.Contains(css, "{{")
+		if dynamic {
+			css = protectDelims.Replace(css)
+		}
+		if doctype == "" {
+			t.leaks = leakingSelectors(css)
+		}
+
+		// Wrapped components render inside a <div> or, with a custom element
+		// prefix, inside a custom element named after the component
+		wrapper := "div"
+		if ts.elementPrefix != "" {
+			wrapper = ts.elementPrefix + slugify(name)
+		}
+
+		// Strict scopes only reach the direct children of the scope element
+		combinator := " "
+		if ts.strictScopes {
+			combinator = " > "
+		}
+
+		// If there is no CSS, we don't need to do anything with the scope
+		if css == "" {
+			// Nothing to do
+		} else if ts.isolation == ShadowDOM && doctype == "" {
+			// The browser scopes the CSS written inside the shadow root
+			host := "sk-" + slugify(name)
+			t.HTML = "<" + host + `><template shadowrootmode="open"><style>` + restoreDelims.Replace(css) + "</style>" + t.HTML + "</template></" + host + ">"
+		} else if unwrap || hasRootElement {
+			if hasRootElement {
+				// Only the attributes of the root tag are searched, so the classes of its children are left untouched.
+				if loc := findFirstTag(t.HTML); loc != nil {
+					t.HTML = addScopeClass(t.HTML, loc, t.scopeClass)
+				}
+
+				// Process CSS according to element type
+				var elementType int
+				if isSingleElement || unwrap {
+					elementType = ElementTypeSingle
+				} else if isRootContainer {
+					elementType = ElementTypeContainer
+				} else {
+					elementType = ElementTypeNormal
+				}
+
+				t.CSS = scopedCSS(css, t.scopeClass, rootTagName, rootClasses, elementType, combinator)
+			} else {
+				// Without root element, but with unwrap, we use a custom selector instead of class
+				t.HTML = fmt.Sprintf(`<%s class="%s" style="display:contents">%s</%s>`, wrapper, t.scopeClass, t.HTML, wrapper)
+				t.CSS = qualifyScope(containedScopedCSS(css, t.scopeClass, combinator), t.scopeClass, wrapper)
+			}
+		} else if tags := topLevelTags(t.HTML); ts.noWrap || nowrapRegex.MatchString(templateAttrs) || hasRestrictedTag(t.HTML, tags) {
+			// Without wrapper, each top-level element carries the scope class,
+			// so fragments such as table rows stay valid where they are used
+			for i := len(tags) - 1; i >= 0; i-- {
+				t.HTML = addScopeClass(t.HTML, tags[i], t.scopeClass)
+			}
+			t.CSS = fragmentScopedCSS(css, t.scopeClass, combinator)
+		} else {
+			// Default case: wrap with div
+			t.HTML = fmt.Sprintf(`<%s class="%s">%s</%s>`, wrapper, t.scopeClass, t.HTML, wrapper)
+			t.CSS = qualifyScope(containedScopedCSS(css, t.scopeClass, combinator), t.scopeClass, wrapper)
+		}
+
+		// Mark the root element so the attrs passed by the caller are merged into it
+		if hasRootElement || css != "" {
+			if ts.debugAttrs {
+				if loc := findFirstTag(t.HTML); loc != nil {
+					t.HTML = t.HTML[:loc[3]] + fmt.Sprintf(` data-component="%s"`, template.HTMLEscapeString(name)) + t.HTML[loc[3]:]
+				}
+			}
+			t.HTML = markRootAttrs(t.HTML)
+		}
+
+		if dynamic {
+			t.CSS = restoreDelims.Replace(t.CSS)
+		}
+		if len(global) > 0 {
+			t.CSS += strings.Join(global, "\n") + "\n"
+		}
+
+		t.HTML = doctype + t.HTML
+	}
+
+	// Extract the JS of every script tag, in order, ignoring scripts that are part of the HTML
+	jsSource := string(content)
+	if block := matchTemplateBlock(jsSource); block != nil {
+		jsSource = strings.Replace(jsSource, block[0], "", 1)
+	}
+	var scripts []string
+	for _, matches := range jsRegex.FindAllStringSubmatch(jsSource, -1) {
+		// Structured data is collected apart and placed in the <head>
+		if jsonLDRegex.MatchString(matches[1]) {
+			if data := strings.TrimSpace(matches[2]); data != "" {
+				t.jsonLD = append(t.jsonLD, data)
+			}
+			continue
+		}
+		// External scripts are kept as tags, placed before the combined JS
+		if scriptSrcRegex.MatchString(matches[1]) {
+			t.scripts = append(t.scripts, strings.TrimSpace(matches[1]))
+		} else if strings.TrimSpace(matches[2]) != "" {
+			scripts = append(scripts, matches[2])
+		}
+
+		if requires := requiresRegex.FindStringSubmatch(matches[1]); len(requires) > 1 {
+			for _, dependency := range strings.FieldsFunc(requires[1], func(r rune) bool {
+				return r == ',' || r == ' ' || r == '\t' || r == '\n'
+			}) {
+				if !slices.Contains(t.requires, dependency) {
+					t.requires = append(t.requires, dependency)
+				}
+			}
+		}
+	}
+	// The JS is not a template, but may reference its scope class like the HTML
+	t.JS = ts.scopeVarRegex().ReplaceAllLiteralString(strings.Join(scripts, "\n"), t.scopeClass)
+	if ts.disableJS && (t.JS != "" || len(t.scripts) > 0) {
+		ts.log().Warn("component script dropped because JS is disabled", "template", t.Name)
+		t.JS = ""
+		t.scripts = nil
+	}
+
+	ts.onParse(t)
+
+	// Stores the template for later processing
+	ts.templates[t.Name] = t
+	ts.templateHTML[t.Name] = t.HTML
+
+	return nil
+}
+
+// renderComponent renders a component the way the comp function does, pushing
+// its arguments onto the component call stack while it executes.
+//
+// The data the component receives depends on the arguments:
+//   - a single map[string]interface{} argument is used as the data, so its keys
+//     are accessed as {{ .key }};
+//   - a single argument of a component declared with <template typed> is used
+//     as-is, so a struct is accessed as {{ .Field }} and any value as {{ . }};
+//   - any other arguments are stored in a map under the keys "0", "1", ...
+//     which are usually read with param and paramOr, and also as a slice under
+//     the "Args" key when ExposeArgs is enabled.
+//
+// Map data also receives the component scope class under the "ScopeClass" key,
+// unless the caller already set that key.
+//
+// The result is trusted HTML and is not escaped again by the caller. The data is
+// escaped by the component itself, which is an html/template like any other.
+func (ts *TemplateSet) renderComponent(templateName string, args []interface{}) (template.HTML, error) {
+	name := strings.TrimSuffix(templateName, ".html")
+
+	if _, ok := ts.templates[name]; !ok {
+		ts.log().Error("component not found", "template", name)
+		return "", fmt.Errorf("template %s not found", name)
+	}
+
+	ts.mu.Lock()
+	ts.markUsed(name)
+	ts.mu.Unlock()
+
+	// Regions rendered ahead by ExecuteParallel are used by calls without arguments
+	if region := ts.renderedRegion(name, args); region != nil {
+		ts.replay(region)
+		return region.html, nil
+	}
+
+	ts.compMu.Lock()
+	depth := len(ts.compStack)
+	if depth < maxComponentDepth {
+		ts.compStack = append(ts.compStack, compCall{
+			Args: args,
+			Name: name,
+		})
+	}
+	ts.compMu.Unlock()
+
+	if depth >= maxComponentDepth {
+		ts.log().Error("component recursion limit exceeded", "template", name, "depth", depth)
+		return "", fmt.Errorf("component %s exceeded the maximum nesting depth of %d", name, maxComponentDepth)
+	}
+
+	// Ensures stack removal when finished
+	defer func() {
+		ts.compMu.Lock()
+		if len(ts.compStack) > 0 {
+			ts.compStack = ts.compStack[:len(ts.compStack)-1]
+		}
+		ts.compMu.Unlock()
+	}()
+
+	ts.mu.Lock()
+	cache := ts.compCaches[name]
+	ts.mu.Unlock()
+	if cache != nil {
+		return ts.renderCached(cache, name, args)
+	}
+	return ts.executeComponent(name, args)
+}
+
+// renderInclude renders the markup of the named template as written, like the
+// native {{ template }} action: without scoping, without the comp data
+// remapping and without marking the template as used, so its CSS and JS are
+// not included. The optional data argument becomes its dot.
+func (ts *TemplateSet) renderInclude(templateName string, data []interface{}) (template.HTML, error) {
+	name := strings.TrimSuffix(templateName, ".html")
+	if _, ok := ts.templates[name]; !ok {
+		ts.log().Error("included template not found", "template", name)
+		return "", fmt.Errorf("template %s not found", name)
+	}
+	if len(data) > 1 {
+		return "", fmt.Errorf("include accepts a single data argument, got %d", len(data))
+	}
+
+	var dot interface{}
+	if len(data) == 1 {
+		dot = data[0]
+	}
+
+	var buf strings.Builder
+	if err := ts.masterTmpl.ExecuteTemplate(ts.limit(&buf), name+".raw", dot); err != nil {
+		return "", err
+	}
+	return template.HTML(buf.String()), nil
+}
+
+// renderJoined renders the named component once for each element of items,
+// passing the element as its single argument like {{ comp name element }},
+// and joins the results with the HTML escaped separator. An empty or nil
+// items renders nothing, but the component is still marked as used once, so
+// its CSS is in the page for items added later by scripts.
+func (ts *TemplateSet) renderJoined(templateName string, items interface{}, separator string) (template.HTML, error) {
+	name := strings.TrimSuffix(templateName, ".html")
+	if _, ok := ts.templates[name]; !ok {
+		ts.log().Error("component not found", "template", name)
+		return "", fmt.Errorf("template %s not found", name)
+	}
+
+	ts.mu.Lock()
+	ts.markUsed(name)
+	ts.mu.Unlock()
+
+	v := reflect.ValueOf(items)
+	if items == nil || (v.Kind() == reflect.Pointer && v.IsNil()) {
+		return "", nil
+	}
+	if v.Kind() == reflect.Pointer {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return "", fmt.Errorf("compJoin needs a slice or array of items, got %T", items)
+	}
+
+	var b strings.Builder
+	for i := 0; i < v.Len(); i++ {
+		if i > 0 {
+			b.WriteString(template.HTMLEscapeString(separator))
+		}
+		html, err := ts.renderComponent(name, []interface{}{v.Index(i).Interface()})
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(string(html))
+	}
+	return template.HTML(b.String()), nil
+}
+
+// executeComponent builds the data of a component from its arguments and
+// executes it, including its dynamic CSS.
+func (ts *TemplateSet) executeComponent(name string, args []interface{}) (template.HTML, error) {
+	var buf strings.Builder
+	var data interface{}
+	component := ts.templates[name]
+
+	args, provided, err := ts.provide(name, args)
+	if err != nil {
+		return "", err
+	}
+
+	ts.mu.Lock()
+	exposeArgs := ts.exposeArgs
+	ts.mu.Unlock()
+
+	if len(args) == 1 {
+		if mapData, ok := args[0].(map[string]interface{}); ok {
+			// Copy the map so the caller data is not modified
+			dataMap := make(map[string]interface{}, len(mapData)+1)
+			for key, value := range mapData {
+				dataMap[key] = value
+			}
+			if _, exists := dataMap["ScopeClass"]; !exists {
+				dataMap["ScopeClass"] = component.scopeClass
+			}
+			data = dataMap
+		} else if component.typed || provided {
+			data = args[0]
+		} else {
+			dataMap := map[string]interface{}{
+				"0":          args[0],
+				"ScopeClass": component.scopeClass,
+			}
+			if exposeArgs {
+				dataMap["Args"] = args
+			}
+			data = dataMap
+		}
+	} else {
+		dataMap := make(map[string]interface{}, len(args)+2)
+		for i, arg := range args {
+			dataMap[fmt.Sprintf("%d", i)] = arg
+		}
+		dataMap["ScopeClass"] = component.scopeClass
+		if exposeArgs {
+			dataMap["Args"] = args
+		}
+		data = dataMap
+	}
+
+	tmplName := name
+	if !strings.HasSuffix(tmplName, ".html") {
+		tmplName = tmplName + ".html"
+	}
+
+	if err := ts.masterTmpl.ExecuteTemplate(ts.limit(&buf), tmplName, data); err != nil {
+		return "", err
+	}
+
+	if err := ts.renderCSS(component, data); err != nil {
+		return "", err
+	}
+
+	return template.HTML(buf.String()), nil
+}
+
+// finalizeParsing completes the template processing after all individual templates have been parsed
+// into next. The functions of the templates are bound to ts, which next replaces once swapped.
+func (ts *TemplateSet) finalizeParsing(next *TemplateSet) error {
+	if err := next.checkScriptDependencies(); err != nil {
+		ts.log().Error("invalid script dependencies", "error", err)
+		return err
+	}
+	if err := next.checkComponentRefs(); err != nil {
+		ts.log().Error("unknown components referenced", "error", err)
+		return err
+	}
+
+	// Global functions for all templates
+	internalFuncs := template.FuncMap{
+		"_register_template": func(name string) string {
+			ts.mu.Lock()
+			defer ts.mu.Unlock()
+			ts.markUsed(name)
+			return ""
+		},
+		"_root_attrs": func(data interface{}, withClass bool) template.HTMLAttr {
+			if !ts.inComponent() {
+				return ""
+			}
+			return rootAttrs(data, withClass)
+		},
+		"_has_root_attr": func(data interface{}, name string) bool {
+			return ts.inComponent() && hasRootAttr(data, name)
+		},
+		"_children": ts.renderChildren,
+		"_comment":  func(comment string) template.HTML { return template.HTML(comment) },
+		"_root_class": func(data interface{}) string {
+			if !ts.inComponent() {
+				return ""
+			}
+			return rootClass(data)
+		},
+		"dict": func(values ...interface{}) (map[string]interface{}, error) {
+			if len(values)%2 != 0 {
+				return nil, fmt.Errorf("dict needs key and value pairs as arguments")
+			}
+			dict := make(map[string]interface{}, len(values)/2)
+			for i := 0; i < len(values); i += 2 {
+				key, ok := values[i].(string)
+				if !ok {
+					return nil, fmt.Errorf("dict keys must be strings")
+				}
+				dict[key] = values[i+1]
+			}
+			return dict, nil
+		},
+		"param": func(index int) interface{} {
+			ts.compMu.Lock()
+			defer ts.compMu.Unlock()
+
+			if len(ts.compStack) == 0 {
+				return nil
+			}
+
+			current := ts.compStack[len(ts.compStack)-1]
+			if index < 0 || index >= len(current.Args) {
+				return nil
+			}
+			return current.Args[index]
+		},
+		// paramRequired works like param, but fails the render when the
+		// argument was not passed, naming the component whose contract broke
+		"paramRequired": func(index int) (interface{}, error) {
+			ts.compMu.Lock()
+			defer ts.compMu.Unlock()
+
+			if len(ts.compStack) == 0 {
+				return nil, fmt.Errorf("paramRequired %d called outside a component", index)
+			}
+
+			current := ts.compStack[len(ts.compStack)-1]
+			if index < 0 || index >= len(current.Args) {
+				return nil, fmt.Errorf("component %q: missing required param %d", current.Name, index)
+			}
+			return current.Args[index], nil
+		},
+		// parentParam reads the arguments of the component that called the
+		// current one, which is the second frame from the top of the stack
+		"parentParam": func(index int) interface{} {
+			ts.compMu.Lock()
+			defer ts.compMu.Unlock()
+
+			if len(ts.compStack) < 2 {
+				return nil
+			}
+
+			parent := ts.compStack[len(ts.compStack)-2]
+			if index < 0 || index >= len(parent.Args) {
+				return nil
+			}
+			return parent.Args[index]
+		},
+		"paramOr": func(index int, defaultValue interface{}) interface{} {
+			ts.compMu.Lock()
+			defer ts.compMu.Unlock()
+
+			if len(ts.compStack) == 0 {
+				return defaultValue
+			}
+
+			current := ts.compStack[len(ts.compStack)-1]
+			if index < 0 || index >= len(current.Args) {
+				return defaultValue
+			}
+			if current.Args[index] == nil {
+				return defaultValue
+			}
+			return current.Args[index]
+		},
+		"comp": func(templateName string, args ...interface{}) (template.HTML, error) {
+			return ts.renderComponent(templateName, args)
+		},
+		"compJoin": ts.renderJoined,
+		"include": func(templateName string, data ...interface{}) (template.HTML, error) {
+			return ts.renderInclude(templateName, data)
+		},
+		"asset":        ts.assetURL,
+		"ctxValue":     ts.contextValue,
+		"scopeClasses": ts.scopeClasses,
+	}
+
+	// Custom functions take precedence over internal functions with the same name,
+	// except for the reserved functions starting with an underscore. Shadowing
+	// is allowed but logged, since it is easy to do by accident.
+	for name := range next.customFuncs {
+		if strings.HasPrefix(name, "_") {
+			continue
+		}
+		if _, ok := internalFuncs[name]; ok {
+			ts.log().Warn("custom function shadows an internal function", "function", name)
+			delete(internalFuncs, name)
+		} else if _, ok := defaultFuncs[name]; ok {
+			ts.log().Warn("custom function shadows a default function", "function", name)
+		}
+	}
+
+	// Add internal functions
+	next.masterTmpl.Funcs(internalFuncs)
+
+	// Second pass: create the templates and allow references between them
+	for name, html := range next.templateHTML {
+		templateName := name
+		if !strings.HasSuffix(templateName, ".html") {
+			templateName = name + ".html"
+		}
+
+		// We modified the HTML to register the template when it is executed
+		registeredHTML := "{{_register_template \"" + name + "\"}}" + preserveComments(html)
+
+		_, err := next.masterTmpl.New(templateName).Parse(registeredHTML)
+		if err != nil {
+			ts.log().Error("error parsing template", "file", next.sources[name], "template", name, "error", err)
+			return fmt.Errorf("error parsing template %s: %v", name, err)
+		}
+
+		next.templates[name].tmpl = next.masterTmpl.Lookup(templateName)
+
+		// The raw markup is parsed apart for the include function
+		if _, err := next.masterTmpl.New(name + ".raw").Parse(preserveComments(next.templates[name].raw)); err != nil {
+			ts.log().Error("error parsing template", "file", next.sources[name], "template", name, "error", err)
+			return fmt.Errorf("error parsing template %s: %v", name, err)
+		}
+
+		// The children of component tags are rendered by the comp calls
+		for block, html := range next.templates[name].blocks {
+			if _, err := next.masterTmpl.New(block).Parse(preserveComments(html)); err != nil {
+				ts.log().Error("error parsing template", "file", next.sources[name], "template", name, "error", err)
+				return fmt.Errorf("error parsing template %s: %v", name, err)
+			}
+		}
+
+		// Dynamic CSS is parsed inside a <style> element so html/template applies
+		// CSS escaping to the values
+		if t := next.templates[name]; next.dynamicCSS && strings.Contains(t.CSS, "{{") {
+			cssTmpl, err := next.masterTmpl.New(name + ".css").Parse("<style>" + t.CSS + "</style>")
+			if err != nil {
+				ts.log().Error("error parsing template CSS", "file", next.sources[name], "template", name, "error", err)
+				return fmt.Errorf("error parsing CSS of template %s: %v", name, err)
+			}
+			t.cssTmpl = cssTmpl
+		}
+	}
+
+	// Prepare the layout template with all functions
+	layoutFuncs := template.FuncMap{}
+
+	// Combine default functions
+	for name, fn := range defaultFuncs {
+		layoutFuncs[name] = fn
+	}
+
+	// Add custom functions
+	for name, fn := range next.customFuncs {
+		layoutFuncs[name] = fn
+	}
+
+	// Add internal functions to layout - especially 'comp'.
+	// Overridden internal functions were already removed above.
+	for name, fn := range internalFuncs {
+		// Add only useful functions for the layout
+		if name == "comp" || name == "compJoin" || name == "include" || name == "dict" || name == "param" || name == "paramOr" || name == "paramRequired" || name == "parentParam" || name == "asset" || name == "ctxValue" || name == "scopeClasses" || name == "_comment" {
+			layoutFuncs[name] = fn
+		}
+	}
+
+	for name, layout := range next.layouts {
+		layoutTmpl := template.New(name)
+		layoutTmpl.Funcs(layoutFuncs)
+
+		parsedLayout, err := layoutTmpl.Parse(preserveComments(layout.HTML))
+		if err != nil {
+			ts.log().Error("error parsing layout", "file", next.sources[name], "layout", name, "error", err)
+			return fmt.Errorf("error parsing layout %s: %w", name, err)
+		}
+		layout.tmpl = parsedLayout
+	}
+	next.layoutFuncs = layoutFuncs
+
+	return nil
+}
+
+// preserveComments replaces the HTML comments of html, such as the conditional
+// comments used by email clients (<!--[if mso]>...<![endif]-->), with calls to
+// the _comment function, since html/template removes comments from the output.
+// Comments inside raw text elements like <script> are left to html/template.
+func preserveComments(html string) string {
+	if !strings.Contains(html, "<!--") {
+		return html
+	}
+
+	rawText := rawTextRegex.FindAllStringIndex(html, -1)
+	var b strings.Builder
+	last := 0
+	for _, loc := range commentRegex.FindAllStringIndex(html, -1) {
+		inRawText := false
+		for _, raw := range rawText {
+			if loc[0] > raw[0] && loc[0] < raw[1] {
+				inRawText = true
+				break
+			}
+		}
+		if inRawText {
+			continue
+		}
+
+		b.WriteString(html[last:loc[0]])
+		b.WriteString("{{_comment " + strconv.Quote(html[loc[0]:loc[1]]) + "}}")
+		last = loc[1]
+	}
+	b.WriteString(html[last:])
+	return b.String()
+}
+
+// parseFile analyze a file and extract HTML, CSS and JS
+func (ts *TemplateSet) parseFile(filename string, isLayout bool) error {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	name := filepath.Base(filename)
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+
+	return ts.processTemplate(name, content, filename, isLayout)
+}
+
+// ParseDirs parses all HTML/template files in the given directories.
+// The method processes files with the .html or .tmpl extension (or the ones
+// set with WithExtensions), extracting
+// components that contain <template>, <style>, and <script> tags.
+//
+// For each file, the content inside the <template> tag is extracted as HTML.
+// The content inside the <style> tag is extracted as CSS and automatically
+// scoped using unique classes to avoid conflicts.
+// The content inside the <script> tag is extracted as JavaScript.
+//
+// The method walks directories recursively and requires that a layout template
+// (defined when creating the TemplateSet) be found inside a layouts directory.
+//
+// After processing, the templates are available for rendering via
+// the Execute method, with their CSS styles and JS scripts automatically
+// included in the appropriate places in the layout.
+//
+// The Parse methods may be called again while templates are being rendered, for
+// example to reload them at runtime. The templates are parsed apart and swapped
+// in between renders, so each render uses either the previous or the new
+// templates, and the previous ones are kept when parsing fails.
+//
+// Returns an error if any directory cannot be read, if any template
+// cannot be parsed, or if the layout template is not found in a layouts directory.
+func (ts *TemplateSet) ParseDirs(dirs ...string) error {
+	return ts.reparse(func(next *TemplateSet) error {
+		return next.parseDirs(dirs)
+	})
+}
+
+// parseDirs processes the templates found in dirs
+func (ts *TemplateSet) parseDirs(dirs []string) error {
+	layoutFound := false
+	for _, dir := range dirs {
+		ts.expectTemplates(func(fn fs.WalkDirFunc) error { return filepath.WalkDir(dir, fn) })
+	}
+
+	for _, dir := range dirs {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+
+			ext := filepath.Ext(d.Name())
+			if !ts.hasExtension(ext) {
+				return nil
+			}
+
+			name := strings.TrimSuffix(d.Name(), ext)
+			isLayout := isLayoutPath(path)
+			if isLayout && name == ts.layoutName {
+				layoutFound = true
+			}
+
+			if err := ts.parseFile(path, isLayout); err != nil {
+				ts.log().Error("error parsing file", "file", path, "template", name, "error", err)
+				return fmt.Errorf("error parsing file %s: %w", path, err)
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("error reading directory %s: %w", dir, err)
+			}
+			return fmt.Errorf("error processing directory %s: %w", dir, err)
+		}
+	}
+
+	if !layoutFound && ts.layoutName != "" {
+		return fmt.Errorf("layout template '%s' not found in any layouts directory in the provided directories", ts.layoutName)
+	}
+	return nil
+}
+
+// ParseFS parses all HTML/template files in the given embedded filesystem.
+// This method allows using Go's embed feature to include templates
+// directly in the binary.
+//
+// The method accepts multiple root directories within the filesystem to scan for templates.
+// It processes files with the .html or .tmpl extension (or the ones set with
+// WithExtensions), extracting
+// components that contain <template>, <style>, and <script> tags.
+//
+// Similar to ParseDirs, this method requires that a layout template
+// (defined when creating the TemplateSet) be found inside a layouts directory.
+//
+// Example usage with embed:
+//
+//	//go:embed templates
+//	var templateFS embed.FS
+//
+//	ts := skingo.NewTemplateSet("layout")
+//	err := ts.ParseFS(templateFS, "templates")
+//
+// Returns an error if any template cannot be parsed
+// or if the layout template is not found in a layouts directory.
+func (ts *TemplateSet) ParseFS(filesystem fs.FS, roots ...string) error {
+	return ts.reparse(func(next *TemplateSet) error {
+		next.expectFS(filesystem, roots)
+		layoutFound, err := next.walkFS(filesystem, roots, "")
+		if err != nil {
+			return err
+		}
+
+		if !layoutFound && next.layoutName != "" {
+			return fmt.Errorf("layout template '%s' not found in any layouts directory in the provided filesystem paths", next.layoutName)
+		}
+		return nil
+	})
+}
+
+// Source is a filesystem together with the root directories to parse in it,
+// used by ParseSources.
+type Source struct {
+	FS    fs.FS
+	Roots []string
+}
+
+// ParseSources parses templates from several filesystems at once, for example
+// a component library embedded in one package and the application components
+// embedded in another. Each source is processed like ParseFS, in order, and a
+// template name found in more than one source is reported as an error. The
+// layout may be in any of the sources.
+func (ts *TemplateSet) ParseSources(sources ...Source) error {
+	return ts.reparse(func(next *TemplateSet) error {
+		layoutFound := false
+		for _, source := range sources {
+			next.expectFS(source.FS, source.Roots)
+		}
+		for i, source := range sources {
+			found, err := next.walkFS(source.FS, source.Roots, fmt.Sprintf("source %d: ", i+1))
+			if err != nil {
+				return err
+			}
+			layoutFound = layoutFound || found
+		}
+
+		if !layoutFound && next.layoutName != "" {
+			return fmt.Errorf("layout template '%s' not found in any layouts directory in the provided sources", next.layoutName)
+		}
+		return nil
+	})
+}
+
+// reparse runs parse on a copy of the parsed templates and layouts and, once
+// it succeeds, swaps the result into ts under the render lock. Renders in
+// progress finish with the previous templates, later renders see the new ones
+// and a failed parse leaves the set unchanged.
+func (ts *TemplateSet) reparse(parse func(next *TemplateSet) error) error {
+	if err := ts.checkFrozen(); err != nil {
+		return err
+	}
+
+	ts.parseMu.Lock()
+	defer ts.parseMu.Unlock()
+
+	next := ts.staging()
+	if err := parse(next); err != nil {
+		return err
+	}
+	if err := ts.finalizeParsing(next); err != nil {
+		return err
+	}
+
+	ts.renderMu.Lock()
+	defer ts.renderMu.Unlock()
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.templates = next.templates
+	ts.layout = next.layout
+	ts.layouts = next.layouts
+	ts.layoutUses = next.layoutUses
+	ts.masterTmpl = next.masterTmpl
+	ts.templateHTML = next.templateHTML
+	ts.sources = next.sources
+	ts.scopeOwners = next.scopeOwners
+	ts.parsed = next.parsed
+	ts.overrides = next.overrides
+	ts.layoutFuncs = next.layoutFuncs
+	ts.processed = nil
+	ts.regionPool = nil
+	return nil
+}
+
+// staging returns a set holding a copy of the parsed templates and layouts of
+// ts and the options used while parsing, so that parsing more templates does
+// not modify the ones being rendered. The master template is created anew,
+// since html/template does not allow adding templates after an execution.
+func (ts *TemplateSet) staging() *TemplateSet {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	next := &TemplateSet{
+		templates:     make(map[string]*Template, len(ts.templates)),
+		layouts:       make(map[string]*Layout, len(ts.layouts)),
+		layoutName:    ts.layoutName,
+		layoutUses:    maps.Clone(ts.layoutUses),
+		masterTmpl:    template.New("master").Funcs(defaultFuncs).Funcs(ts.customFuncs),
+		templateHTML:  maps.Clone(ts.templateHTML),
+		customFuncs:   maps.Clone(ts.customFuncs),
+		sources:       maps.Clone(ts.sources),
+		readable:      ts.readable,
+		scopePrefix:   ts.scopePrefix,
+		scopeOwners:   maps.Clone(ts.scopeOwners),
+		dynamicCSS:    ts.dynamicCSS,
+		logger:        ts.logger,
+		parsed:        ts.parsed,
+		allowOverride: ts.allowOverride,
+		overrides:     slices.Clone(ts.overrides),
+		debugAttrs:    ts.debugAttrs,
+		urlRewriter:   ts.urlRewriter,
+		leftDelim:     ts.leftDelim,
+		rightDelim:    ts.rightDelim,
+		extensions:    ts.extensions,
+		strictScopes:  ts.strictScopes,
+		isolation:     ts.isolation,
+		plugins:       ts.plugins,
+		disableJS:     ts.disableJS,
+		noWrap:        ts.noWrap,
+		elementPrefix: ts.elementPrefix,
+	}
+
+	// Templates and layouts are copied because finalizing sets their parsed templates
+	for name, t := range ts.templates {
+		copied := *t
+		next.templates[name] = &copied
+	}
+	for name, layout := range ts.layouts {
+		copied := *layout
+		next.layouts[name] = &copied
+		if layout == ts.layout {
+			next.layout = &copied
+		}
+	}
+	return next
+}
+
+// expectFS records the names of the templates found in the roots of filesystem
+func (ts *TemplateSet) expectFS(filesystem fs.FS, roots []string) {
+	for _, root := range roots {
+		ts.expectTemplates(func(fn fs.WalkDirFunc) error { return fs.WalkDir(filesystem, root, fn) })
+	}
+}
+
+// walkFS processes the templates found in the roots of filesystem and reports
+// whether the main layout was among them. The label is prepended to the paths
+// used to detect duplicate names across filesystems.
+func (ts *TemplateSet) walkFS(filesystem fs.FS, roots []string, label string) (bool, error) {
+	layoutFound := false
+
+	for _, root := range roots {
+		// Read all files in this root directory of the filesystem
+		err := fs.WalkDir(filesystem, root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			// Skip directories
+			if d.IsDir() {
+				return nil
+			}
+
+			// Process only HTML and template files
+			ext := filepath.Ext(d.Name())
+			if !ts.hasExtension(ext) {
+				return nil
+			}
+
+			// Extract the template name
+			name := strings.TrimSuffix(d.Name(), ext)
+			isLayout := isLayoutPath(path)
+			if isLayout && name == ts.layoutName {
+				layoutFound = true
+			}
+
+			// Read file content
+			content, err := fs.ReadFile(filesystem, path)
+			if err != nil {
+				return fmt.Errorf("error reading file %s: %w", path, err)
+			}
+
+			// Process the template
+			if err := ts.processTemplate(name, content, label+path, isLayout); err != nil {
+				ts.log().Error("error parsing file", "file", label+path, "template", name, "error", err)
+				return fmt.Errorf("error parsing file %s: %w", label+path, err)
+			}
+			return nil
+		})
+
+		if err != nil {
+			return false, fmt.Errorf("error processing embedded filesystem path %s%s: %w", label, root, err)
+		}
+	}
+
+	return layoutFound, nil
+}
+
+// ExecuteIsolatedFS renders a template directly from an embedded filesystem,
+// without using the configured layout.
+//
+// This method is similar to ExecuteIsolated but works with embedded filesystems.
+// It is ideal for use with 'HTMX', Ajax requests, or any scenario where only an
+// HTML fragment is needed.
+//
+// The 'fsPath' parameter must be the path within the filesystem.
+//
+// Example usage with embed:
+//
+//	//go:embed templates
+//	var templateFS embed.FS
+//
+//	err := ts.ExecuteIsolatedFS(w, templateFS, "templates/fragment.html", data)
+//
+// Returns an error if the file cannot be read or if an error occurs during
+// template execution.
+func (ts *TemplateSet) ExecuteIsolatedFS(w io.Writer, filesystem fs.FS, fsPath string, data interface{}) error {
+	cacheKey := fmt.Sprintf("embed:%s", fsPath)
+
+	ts.cacheMu.RLock()
+	cachedTmpl, exists := ts.isolatedCache[cacheKey]
+	ts.cacheMu.RUnlock()
+
+	if exists {
+		return cachedTmpl.Execute(w, data) // Use the cached template
+	}
+
+	content, err := fs.ReadFile(filesystem, fsPath)
+	if err != nil {
+		return fmt.Errorf("error reading template file from filesystem: %w", err)
+	}
+
+	name := filepath.Base(fsPath)
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+
+	var htmlContent string
+	if matches := matchTemplateBlock(string(content)); len(matches) > 1 {
+		htmlContent = matches[2] // Use index 2 which contains the actual content
+	} else {
+		htmlContent = string(content)
+	}
+
+	isolatedTmpl := template.New(name + "_isolated")
+	isolatedTmpl.Delims(ts.leftDelim, ts.rightDelim)           // Use the delimiters of the set
+	isolatedTmpl.Funcs(defaultFuncs)                           // Add default functions
+	isolatedTmpl.Funcs(template.FuncMap{"asset": ts.assetURL}) // Add the asset function
+	isolatedTmpl.Funcs(ts.customFuncs)                         // Add custom functions
+
+	parsedTmpl, err := isolatedTmpl.Parse(htmlContent)
+	if err != nil {
+		return fmt.Errorf("error parsing isolated template from filesystem: %w", err)
+	}
+
+	// Add to cache
+	ts.cacheMu.Lock()
+	ts.isolatedCache[cacheKey] = parsedTmpl
+	ts.cacheMu.Unlock()
+
+	// Execute the isolated template with data
+	return parsedTmpl.Execute(w, data)
+}
+
+// MustParseDirs invokes ParseDirs and panics if parsing fails.
+func (ts *TemplateSet) MustParseDirs(dirs ...string) {
+	if err := ts.ParseDirs(dirs...); err != nil {
+		panic(err)
+	}
+}
+
+// MustParseFS invokes ParseFS and panics if parsing fails.
+func (ts *TemplateSet) MustParseFS(filesystem fs.FS, roots ...string) {
+	if err := ts.ParseFS(filesystem, roots...); err != nil {
+		panic(err)
+	}
+}
+
+// ParseDir invokes ParseDirs, but with a unique directory.
+func (ts *TemplateSet) ParseDir(dir string) error {
+	return ts.ParseDirs(dir)
+}
+
+// Execute renders a specific template using the configured layout.
+// The method combines the HTML content of the requested template with the
+// layout, automatically injecting all CSS and JavaScript associated with the
+// templates used (including referenced components) into the appropriate places
+// in the layout.
+//
+// The 'name' parameter must match the name of a previously parsed template
+// (without extension).
+//
+// The 'data' parameter contains the data that will be passed to the template.
+// It can be any type supported by the html/template package, such as map,
+// struct, or nil if no data is required.
+//
+// During rendering, the system automatically tracks which templates
+// are used (including components referenced via the comp function) and includes
+// only the CSS and JavaScript of the templates actually used.
+//
+// The resulting HTML is written in Writer 'w'.
+//
+// Returns an error if the requested template does not exist, if the layout is
+// not defined, or if an error occurs during template execution.
+func (ts *TemplateSet) Execute(w io.Writer, name string, data interface{}) error {
+	return ts.ExecuteWithLayout(w, ts.layoutName, name, data)
+}
+
+// ExecuteWithLayout renders a specific template using the requested layout.
+// The layoutName parameter must match a parsed layout template name without extension.
+func (ts *TemplateSet) ExecuteWithLayout(w io.Writer, layoutName string, name string, data interface{}) error {
+	return ts.executeContext(context.Background(), w, layoutName, name, data)
+}
+
+// ExecuteContext works like Execute, but makes ctx, typically the context of
+// the HTTP request, available to the template functions during the render:
+// {{ ctxValue "user" }} returns the value stored in ctx under the key
+// ContextKey("user") or, when there is none, under the plain string key. Data
+// providers registered with RegisterProvider receive ctx, or a context derived
+// from it when a render timeout is set.
+//
+// Renders of a TemplateSet run one at a time, so the context is stored on the
+// set when the render starts, while holding the render lock, and cleared when
+// it ends. Functions only see the context of the render that calls them and
+// concurrent calls to ExecuteContext wait for each other, as with Execute.
+func (ts *TemplateSet) ExecuteContext(ctx context.Context, w io.Writer, name string, data interface{}) error {
+	return ts.executeContext(ctx, w, ts.layoutName, name, data)
+}
+
+// ContextKey is the type of the context keys read by the ctxValue template
+// function, which avoids collisions with the keys of other packages:
+//
+//	ctx = context.WithValue(ctx, skingo.ContextKey("user"), user)
+type ContextKey string
+
+// executeContext renders a template with a layout and ctx as the context of
+// the render, serving it from the page cache when one is configured.
+func (ts *TemplateSet) executeContext(ctx context.Context, w io.Writer, layoutName string, name string, data interface{}) error {
+	ts.mu.Lock()
+	cache := ts.pageCaches[strings.TrimSuffix(name, ".html")]
+	ts.mu.Unlock()
+
+	execute := func(w io.Writer) error {
+		return ts.executeTimed(ctx, w, name, func(w io.Writer) error {
+			return ts.executeWithLayout(w, layoutName, name, data)
+		})
+	}
+	if cache != nil {
+		return ts.executeCachedPage(ctx, w, cache, layoutName, data, execute)
+	}
+	return execute(w)
+}
+
+// ExecuteWithUsed works like Execute, but also returns the sorted names of the
+// templates used in the render, including the layout components, which can be
+// used to build cache keys or to debug a page. The page is not served from the
+// cache of CachePage, since a cached page does not render its components.
+func (ts *TemplateSet) ExecuteWithUsed(w io.Writer, name string, data interface{}) ([]string, error) {
+	var used []string
+	err := ts.executeTimed(context.Background(), w, name, func(w io.Writer) error {
+		err := ts.executeWithLayout(w, ts.layoutName, name, data)
+
+		ts.mu.Lock()
+		used = slices.Sorted(maps.Keys(ts.usedTemplates))
+		ts.mu.Unlock()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return used, nil
+}
+
+func (ts *TemplateSet) executeWithLayout(w io.Writer, layoutName string, name string, data interface{}) error {
+	return ts.executeTracked(w, layoutName, name, data, nil)
+}
+
+// ExecuteThemed works like Execute, but adds the CSS variables of theme to the
+// page in a :root block placed before the CSS of the components, so a single
+// TemplateSet can render each tenant of an application with its own colors:
+//
+//	ts.ExecuteThemed(w, "home", data, map[string]string{"brand": "#0a7", "radius": "4px"})
+//
+// The names may be given with or without the leading "--" and the variables are
+// not scoped. Values may contain quoted strings, as in `"Inter", sans-serif`.
+// Names other than letters, digits, "-" and "_" and values with characters that
+// could end the declaration, such as ";", "{", "}", "<", unbalanced quotes and
+// comment delimiters ("/*" and "*/"), are rejected. The page is not served from
+// the cache of CachePage, since its key does not include the theme.
+func (ts *TemplateSet) ExecuteThemed(w io.Writer, name string, data interface{}, theme map[string]string) error {
+	themeCSS, err := themeVariables(theme)
+	if err != nil {
+		return err
+	}
+
+	return ts.executeTimed(context.Background(), w, name, func(w io.Writer) error {
+		return ts.observe(w, ts.layoutName, name, func(w io.Writer) error {
+			return ts.executeLayout(w, ts.layoutName, name, data, nil, themeCSS)
+		})
+	})
+}
+
+// themeVariables returns the :root block declaring the variables of theme,
+// sorted by name.
+func themeVariables(theme map[string]string) (string, error) {
+	if len(theme) == 0 {
+		return "", nil
+	}
+
+	variables := make(map[string]string, len(theme))
+	for key, value := range theme {
+		name := strings.TrimPrefix(key, "--")
+		value = strings.TrimSpace(value)
+		if !themeNameRegex.MatchString(name) {
+			return "", fmt.Errorf("invalid theme variable name %q", key)
+		}
+		if !validThemeValue(value) {
+			return "", fmt.Errorf("invalid value of theme variable %q", key)
+		}
+		variables[name] = value
+	}
+
+	var b strings.Builder
+	b.WriteString(":root {")
+	for _, name := range slices.Sorted(maps.Keys(variables)) {
+		b.WriteString(" --" + name + ": " + variables[name] + ";")
+	}
+	b.WriteString(" }\n")
+	return b.String(), nil
+}
+
+// validThemeValue reports whether value can be written as the value of a CSS
+// declaration without ending it: quotes must be balanced and the value must not
+// contain characters that end the declaration or open a comment.
+func validThemeValue(value string) bool {
+	if value == "" || strings.ContainsAny(value, ";{}<>\\\n\r") || strings.Contains(value, "/*") || strings.Contains(value, "*/") {
+		return false
+	}
+
+	var quote rune
+	for _, r := range value {
+		switch {
+		case quote == 0 && (r == '"' || r == '\''):
+			quote = r
+		case r == quote:
+			quote = 0
+		}
+	}
+	return quote == 0
+}
+
+func (ts *TemplateSet) executeTracked(w io.Writer, layoutName string, name string, data interface{}, emitted EmittedStyles) error {
+	return ts.observe(w, layoutName, name, func(w io.Writer) error {
+		return ts.executeLayout(w, layoutName, name, data, emitted, "")
+	})
+}
+
+// observe runs render and reports it to the observer configured with SetObserver
+func (ts *TemplateSet) observe(w io.Writer, layoutName string, name string, render func(w io.Writer) error) error {
+	ts.mu.Lock()
+	observer := ts.observer
+	ts.mu.Unlock()
+
+	if observer == nil {
+		return render(w)
+	}
+
+	start := time.Now()
+	cw := &countingWriter{w: w}
+	err := render(cw)
+
+	ts.mu.Lock()
+	components := len(ts.usedTemplates)
+	ts.mu.Unlock()
+
+	observer(RenderEvent{
+		Template:   name,
+		Layout:     layoutName,
+		Duration:   time.Since(start),
+		Components: components,
+		Bytes:      cw.n,
+		Err:        err,
+	})
+	return err
+}
+
+func (ts *TemplateSet) executeLayout(w io.Writer, layoutName string, name string, data interface{}, emitted EmittedStyles, theme string) error {
+	if _, ok := ts.templates[name]; !ok {
+		ts.log().Error("template not found", "template", name)
+		return fmt.Errorf("template %s not found", name)
+	}
+
+	layout, ok := ts.layouts[layoutName]
+	if !ok || layout == nil {
+		ts.log().Error("layout not found", "layout", layoutName, "template", name)
+		return fmt.Errorf("layout template %s not found", layoutName)
+	}
+
+	return ts.renderLayout(w, layout, ts.layoutUses[layoutName], name, data, emitted, theme)
+}
+
+// renderLayout renders the named template inside layout, whose referenced
+// components are given by uses. The theme CSS is placed before the CSS of the
+// components, in the critical CSS when there is any, and goes through the CSS
+// processor with it.
+func (ts *TemplateSet) renderLayout(w io.Writer, layout *Layout, uses []string, name string, data interface{}, emitted EmittedStyles, theme string) error {
+	content, err := ts.render(name, data, uses)
+	if err != nil {
+		return err
+	}
+	// Critical CSS is only split from the linked stylesheet with ExternalStyles
+	ts.mu.Lock()
+	split := ts.stylesPath != ""
+	ts.mu.Unlock()
+
+	critical, css, js, err := ts.collectSplitAssets(emitted, nil, split, theme)
+	if err != nil {
+		return err
+	}
+
+	// The entries of map data are also set at the top level, so the layout can
+	// read {{ .Title }}, but the layout keys are reserved and the same keys of
+	// the data are only reachable through .Data
+	if shadowed := reservedDataKeys(data); len(shadowed) > 0 {
+		ts.log().Warn("data keys shadowed by layout keys, read them from .Data in the layout", "template", name, "keys", shadowed)
+	}
+
+	// Prepare the data for layout
+	layoutData := map[string]interface{}{
+		"Yield":          template.HTML(content),
+		"CriticalCSS":    template.CSS(critical),
+		"CSS":            template.CSS(css),
+		"CSSHref":        ts.storeStylesheet(css),
+		"JS":             template.JS(js),
+		"Data":           data,
+		"StructuredData": template.HTML(ts.structuredData()),
+		"Scripts":        template.HTML(ts.externalScripts(nil)),
+	}
+	addDataKeys(layoutData, data)
+
+	// Execute the layout template with the prepared data
+	return layout.tmpl.Execute(ts.limit(w), layoutData)
+}
+
+// ExecuteLayout renders a specific template using the layout read from
+// layoutFile, instead of a layout found while parsing, which suits ad-hoc
+// views such as a print version of a page. The layout file follows the same
+// rules as the parsed layouts and receives the CSS and JS of the used
+// templates as usual.
+//
+// The 'layoutFile' parameter must be the full path to the layout file. It is
+// read and parsed on the first call and cached for the following ones, until
+// ClearIsolatedCache is called. The templates must have been parsed before.
+func (ts *TemplateSet) ExecuteLayout(w io.Writer, layoutFile string, name string, data interface{}) error {
+	layout, err := ts.fileLayout(layoutFile)
+	if err != nil {
+		return err
+	}
+
+	return ts.executeTimed(context.Background(), w, name, func(w io.Writer) error {
+		return ts.observe(w, layoutFile, name, func(w io.Writer) error {
+			return ts.renderLayout(w, layout, extractComponentNames(layout.HTML), name, data, nil, "")
+		})
+	})
+}
+
+// fileLayout returns the layout of layoutFile, reading and parsing it on first use
+func (ts *TemplateSet) fileLayout(layoutFile string) (*Layout, error) {
+	ts.cacheMu.RLock()
+	layout, exists := ts.fileLayouts[layoutFile]
+	ts.cacheMu.RUnlock()
+
+	if exists {
+		return layout, nil
+	}
+
+	content, err := os.ReadFile(layoutFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading layout file: %w", err)
+	}
+
+	ts.mu.Lock()
+	disableJS := ts.disableJS
+	ts.mu.Unlock()
+
+	layout, err = newLayout(string(content), !disableJS)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing layout file %s: %w", layoutFile, err)
+	}
+
+	name := filepath.Base(layoutFile)
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	if layout.tmpl, err = template.New(name).Funcs(ts.layoutFuncs).Parse(preserveComments(layout.HTML)); err != nil {
+		return nil, fmt.Errorf("error parsing layout file %s: %w", layoutFile, err)
+	}
+
+	// Add to cache
+	ts.cacheMu.Lock()
+	if ts.fileLayouts == nil {
+		ts.fileLayouts = make(map[string]*Layout)
+	}
+	ts.fileLayouts[layoutFile] = layout
+	ts.cacheMu.Unlock()
+
+	return layout, nil
+}
+
+// render executes the named template and returns the generated HTML, tracking
+// every template used along the way. The preUsed templates are marked as used
+// before rendering (for example, the components referenced by a layout).
+// The caller must hold renderMu.
+func (ts *TemplateSet) render(name string, data interface{}, preUsed []string) (string, error) {
+	page, ok := ts.templates[name]
+	if !ok {
+		ts.log().Error("template not found", "template", name)
+		return "", fmt.Errorf("template %s not found", name)
+	}
+	if err := ts.checkRequiredData(name, data); err != nil {
+		return "", err
+	}
+
+	// Clean the usedTemplates list.
+	ts.mu.Lock()
+	always, err := ts.resetUsed(preUsed)
+	ts.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	for _, t := range always {
+		if err := ts.renderCSS(t, data); err != nil {
+			return "", err
+		}
+	}
+
+	// Creates a buffer to capture the template output
+	var contentBuf strings.Builder
+
+	// Use masterTmpl to execute the template
+	if err := ts.masterTmpl.ExecuteTemplate(ts.limit(&contentBuf), name+".html", data); err != nil {
+		return "", err
+	}
+	if err := ts.renderCSS(page, data); err != nil {
+		return "", err
+	}
+
+	return ts.onRender(name, data, contentBuf.String()), nil
+}
+
+// resetUsed starts a new tracking of the used templates, marking the preUsed
+// templates and the ones set with AlwaysInclude as used, and returns the
+// latter. The caller must hold ts.mu.
+func (ts *TemplateSet) resetUsed(preUsed []string) ([]*Template, error) {
+	ts.usedTemplates = make(map[string]bool)
+	ts.usedOrder = nil
+	ts.renderedCSS = make(map[string][]string)
+	for _, compName := range preUsed {
+		ts.markUsed(compName)
+	}
+	var always []*Template
+	for _, compName := range ts.alwaysInclude {
+		t, ok := ts.templates[compName]
+		if !ok {
+			return nil, fmt.Errorf("always included template %s not found", compName)
+		}
+		ts.markUsed(compName)
+		always = append(always, t)
+	}
+	return always, nil
+}
+
+// collectAssets returns the CSS and JS of the templates used in the last render,
+// transformed by the processors configured with SetCSSProcessor and
+// SetJSProcessor. When emitted is not nil, the CSS of scope classes already
+// present in it is skipped and the newly included scope classes are recorded.
+func (ts *TemplateSet) collectAssets(emitted EmittedStyles) (string, string, error) {
+	_, css, js, err := ts.collectSplitAssets(emitted, nil, false, "")
+	return css, js, err
+}
+
+// collectSplitAssets works like collectAssets, but when split is true the CSS
+// of the critical templates is returned apart from the remaining CSS. Each part
+// is transformed by the CSS processor on its own. When emittedJS is not nil,
+// the JS of templates already present in it is skipped as well. The theme CSS
+// is placed before the critical CSS when there is any, or else before the
+// remaining CSS, ahead of the processing.
+func (ts *TemplateSet) collectSplitAssets(emitted EmittedStyles, emittedJS map[string]bool, split bool, theme string) (string, string, string, error) {
+	critical, css, js := ts.concatAssets(emitted, emittedJS, split)
+	if theme != "" && critical != "" {
+		critical = theme + critical
+	} else if theme != "" {
+		css = theme + css
+	}
+
+	ts.mu.Lock()
+	cssProcessor, jsProcessor := ts.cssProcessor, ts.jsProcessor
+	deferScripts := ts.deferScripts
+	disableJS := ts.disableJS
+	ts.mu.Unlock()
+
+	if disableJS {
+		js = ""
+	}
+
+	if deferScripts && js != "" {
+		js = deferredJS(js)
+	}
+
+	var err error
+	if cssProcessor != nil && critical != "" {
+		if critical, err = ts.processAsset(false, cssProcessor, critical); err != nil {
+			return "", "", "", fmt.Errorf("error processing CSS: %w", err)
+		}
+	}
+	if cssProcessor != nil && css != "" {
+		if css, err = ts.processAsset(false, cssProcessor, css); err != nil {
+			return "", "", "", fmt.Errorf("error processing CSS: %w", err)
+		}
+	}
+	if jsProcessor != nil && js != "" {
+		if js, err = ts.processAsset(true, jsProcessor, js); err != nil {
+			return "", "", "", fmt.Errorf("error processing JS: %w", err)
+		}
+	}
+	return critical, css, js, nil
+}
+
+// maxProcessedAssets bounds the processor outputs kept in cache, which grow
+// with the combinations of components rendered together and with dynamic CSS
+const maxProcessedAssets = 256
+
+// assetKey identifies a processor output by the kind and the hash of its input
+type assetKey struct {
+	js  bool
+	sum [sha256.Size]byte
+}
+
+// processAsset returns the output of processor for input. With
+// CacheProcessedAssets, it reuses the output of an earlier render with the same
+// input. Errors are not cached.
+func (ts *TemplateSet) processAsset(js bool, processor AssetProcessor, input string) (string, error) {
+	key := assetKey{js: js, sum: sha256.Sum256([]byte(input))}
+
+	ts.mu.Lock()
+	cache := ts.cacheAssets
+	output, ok := ts.processed[key]
+	ts.mu.Unlock()
+	if !cache {
+		return processor(input)
+	}
+	if ok {
+		return output, nil
+	}
+
+	output, err := processor(input)
+	if err != nil {
+		return "", err
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.processed == nil || len(ts.processed) >= maxProcessedAssets {
+		ts.processed = make(map[assetKey]string)
+	}
+	ts.processed[key] = output
+	return output, nil
+}
+
+// deferredJS wraps js so it runs once the DOM is ready
+func deferredJS(js string) string {
+	return "(function (run) {\n" +
+		"if (document.readyState === \"loading\") { document.addEventListener(\"DOMContentLoaded\", run); } else { run(); }\n" +
+		"})(function () {\n" + js + "});\n"
+}
+
+// orderedUsed returns the templates used in the last render in the order set
+// with SetAssetOrder, so the output does not depend on map iteration order.
+// The caller must hold ts.mu.
+func (ts *TemplateSet) orderedUsed() []string {
+	names := append([]string(nil), ts.usedOrder...)
+	switch ts.assetOrder {
+	case OrderParse:
+		sort.SliceStable(names, func(i, j int) bool {
+			return ts.parseOrderOf(names[i]) < ts.parseOrderOf(names[j])
+		})
+	case OrderUsage:
+		// Already in order of first use
+	default:
+		sort.Strings(names)
+	}
+	return names
+}
+
+// scopeClasses returns the scope classes of the templates used in the current
+// render that add them to their markup, in the order of their CSS. In the
+// layout, which runs after the page, it covers every component of the page.
+func (ts *TemplateSet) scopeClasses() []string {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	var classes []string
+	for _, templateName := range ts.orderedUsed() {
+		if t, ok := ts.templates[templateName]; ok && t.scopeClass != "" && strings.Contains(t.HTML, t.scopeClass) {
+			classes = append(classes, t.scopeClass)
+		}
+	}
+	return classes
+}
+
+// structuredData returns the <script type="application/ld+json"> blocks of
+// the templates used in the last render, in the order of their CSS.
+func (ts *TemplateSet) structuredData() string {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	var b strings.Builder
+	for _, templateName := range ts.orderedUsed() {
+		if t, ok := ts.templates[templateName]; ok {
+			for _, data := range t.jsonLD {
+				b.WriteString(`<script type="application/ld+json">` + data + "</script>\n")
+			}
+		}
+	}
+	return b.String()
+}
+
+// externalScripts returns the <script src> tags of the templates used in the
+// last render, in the order of their JS, with a single tag per src. The srcs
+// already present in emitted are skipped and the new ones are recorded when it
+// is not nil.
+func (ts *TemplateSet) externalScripts(emitted map[string]bool) string {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.disableJS {
+		return ""
+	}
+
+	seen := make(map[string]bool)
+	var b strings.Builder
+	for _, templateName := range ts.orderScripts(ts.orderedUsed()) {
+		for _, attrs := range ts.templates[templateName].scripts {
+			src := scriptSrcRegex.FindStringSubmatch(attrs)
+			key := src[1] + src[2] + src[3]
+			if seen[key] || emitted[key] {
+				continue
+			}
+			seen[key] = true
+			if emitted != nil {
+				emitted[key] = true
+			}
+			b.WriteString("<script " + attrs + "></script>\n")
+		}
+	}
+	return b.String()
+}
+
+// concatAssets concatenates the CSS and JS of the templates used in the last
+// render, recording the included scope classes in emitted and the templates
+// whose JS was included in emittedJS when they are not nil. When split is
+// true, the CSS of the critical templates is returned first and apart from the
+// rest.
+func (ts *TemplateSet) concatAssets(emitted EmittedStyles, emittedJS map[string]bool, split bool) (string, string, string) {
+	var criticalCSS strings.Builder
+	var allCSS strings.Builder
+	var allJS strings.Builder
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
 
-			// Process only HTML and template files
-			ext := filepath.Ext(d.Name())
-			if ext != ".html" && ext != ".tmpl" {
-				return nil
+	names := ts.orderedUsed()
+	for _, templateName := range names {
+		if template, ok := ts.templates[templateName]; ok {
+			// Skip CSS that was already sent to the client
+			includeCSS := true
+			if template.CSS != "" && emitted != nil {
+				includeCSS = !emitted[template.scopeClass]
+				emitted[template.scopeClass] = true
 			}
 
-			// Extract the template name
-			name := strings.TrimSuffix(d.Name(), ext)
-			isLayout := isLayoutPath(path)
-			if isLayout && name == ts.layoutName {
-				layoutFound = true
+			target := &allCSS
+			if split && (template.critical || ts.critical[templateName]) {
+				target = &criticalCSS
 			}
 
-			// Read file content
-			content, err := fs.ReadFile(filesystem, path)
-			if err != nil {
-				return fmt.Errorf("error reading file %s: %w", path, err)
+			if !includeCSS {
+				// Nothing to do
+			} else if template.cssTmpl != nil {
+				for _, css := range ts.renderedCSS[templateName] {
+					target.WriteString(css)
+					target.WriteString("\n")
+				}
+			} else if template.CSS != "" {
+				target.WriteString(template.CSS)
+				target.WriteString("\n")
 			}
-
-			// Process the template
-			return ts.processTemplate(name, content, path, isLayout)
-		})
-
-		if err != nil {
-			return fmt.Errorf("error processing embedded filesystem path %s: %w", root, err)
 		}
 	}
 
-	if !layoutFound {
-		return fmt.Errorf("layout template '%s' not found in any layouts directory in the provided filesystem paths", ts.layoutName)
+	for _, templateName := range ts.orderScripts(names) {
+		if template := ts.templates[templateName]; template.JS != "" {
+			if emittedJS != nil {
+				if emittedJS[templateName] {
+					continue
+				}
+				emittedJS[templateName] = true
+			}
+			allJS.WriteString(template.JS)
+			allJS.WriteString("\n")
+		}
 	}
 
-	return ts.finalizeParsing()
+	return criticalCSS.String(), allCSS.String(), allJS.String()
 }
 
-// ExecuteIsolatedFS renders a template directly from an embedded filesystem,
-// without using the configured layout.
-//
-// This method is similar to ExecuteIsolated but works with embedded filesystems.
-// It is ideal for use with 'HTMX', Ajax requests, or any scenario where only an
-// HTML fragment is needed.
-//
-// The 'fsPath' parameter must be the path within the filesystem.
-//
-// Example usage with embed:
-//
-//	//go:embed templates
-//	var templateFS embed.FS
-//
-//	err := ts.ExecuteIsolatedFS(w, templateFS, "templates/fragment.html", data)
-//
-// Returns an error if the file cannot be read or if an error occurs during
-// template execution.
-func (ts *TemplateSet) ExecuteIsolatedFS(w io.Writer, filesystem fs.FS, fsPath string, data interface{}) error {
-	cacheKey := fmt.Sprintf("embed:%s", fsPath)
-
-	ts.cacheMu.RLock()
-	cachedTmpl, exists := ts.isolatedCache[cacheKey]
-	ts.cacheMu.RUnlock()
-
-	if exists {
-		return cachedTmpl.Execute(w, data) // Use the cached template
+// orderScripts returns the templates whose JS must be included for names, with
+// the templates each one requires placed before it. Required templates are
+// included even when they were not used in the render.
+func (ts *TemplateSet) orderScripts(names []string) []string {
+	var ordered []string
+	visited := make(map[string]bool)
+
+	var visit func(name string)
+	visit = func(name string) {
+		t, ok := ts.templates[name]
+		if !ok || visited[name] {
+			return
+		}
+		visited[name] = true
+		for _, required := range t.requires {
+			visit(required)
+		}
+		ordered = append(ordered, name)
 	}
 
-	content, err := fs.ReadFile(filesystem, fsPath)
-	if err != nil {
-		return fmt.Errorf("error reading template file from filesystem: %w", err)
+	for _, name := range names {
+		visit(name)
 	}
+	return ordered
+}
 
-	name := filepath.Base(fsPath)
-	name = strings.TrimSuffix(name, filepath.Ext(name))
-
-	var htmlContent string
-	if matches := htmlRegex.FindStringSubmatch(string(content)); len(matches) > 1 {
-		htmlContent = matches[2] // Use index 2 which contains the actual content
-	} else {
-		htmlContent = string(content)
+// checkScriptDependencies verifies that the templates required by scripts exist
+// and do not depend on each other in a cycle.
+func (ts *TemplateSet) checkScriptDependencies() error {
+	names := make([]string, 0, len(ts.templates))
+	for name := range ts.templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make(map[string]int)
+
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("script dependency cycle: %s", strings.Join(append(path, name), " -> "))
+		case done:
+			return nil
+		}
+		state[name] = visiting
+		for _, required := range ts.templates[name].requires {
+			if _, ok := ts.templates[required]; !ok {
+				return fmt.Errorf("script of template %s requires unknown template %s", name, required)
+			}
+			if err := visit(required, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = done
+		return nil
 	}
 
-	isolatedTmpl := template.New(name + "_isolated")
-	isolatedTmpl.Funcs(defaultFuncs)   // Add default functions
-	isolatedTmpl.Funcs(ts.customFuncs) // Add custom functions
-
-	parsedTmpl, err := isolatedTmpl.Parse(htmlContent)
-	if err != nil {
-		return fmt.Errorf("error parsing isolated template from filesystem: %w", err)
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	// Add to cache
-	ts.cacheMu.Lock()
-	ts.isolatedCache[cacheKey] = parsedTmpl
-	ts.cacheMu.Unlock()
+// checkComponentRefs returns an error listing the template names written as
+// literals in comp, compJoin and include calls, in templates and layouts, that
+// do not match any parsed template, so typos are caught before serving traffic.
+// Names given by expressions, such as {{ comp .Widget }}, are only checked when
+// rendered, as are functions replaced by custom functions with the same name.
+func (ts *TemplateSet) checkComponentRefs() error {
+	sources := make(map[string]string, len(ts.templates)+len(ts.layouts))
+	files := make(map[string]string, len(sources)) // Source file of each source, blocks included
+	for name, html := range ts.templateHTML {
+		sources[name] = html
+		files[name] = ts.sources[name]
+		for block, html := range ts.templates[name].blocks {
+			sources[block] = html
+			files[block] = ts.sources[name]
+		}
+	}
+	for name, layout := range ts.layouts {
+		sources[name] = layout.HTML
+		files[name] = ts.sources[name]
+	}
 
-	// Execute the isolated template with data
-	return parsedTmpl.Execute(w, data)
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(sources)) {
+		for _, ref := range ts.componentRefs(sources[name]) {
+			if _, ok := ts.templates[strings.TrimSuffix(ref.name, ".html")]; !ok {
+				errs = append(errs, fmt.Errorf("%s references unknown template %q in %s", ref.function, ref.name, files[name]))
+			}
+		}
+	}
+	return errors.Join(errs...)
 }
 
-// MustParseDirs invokes ParseDirs and panics if parsing fails.
-func (ts *TemplateSet) MustParseDirs(dirs ...string) {
-	if err := ts.ParseDirs(dirs...); err != nil {
-		panic(err)
-	}
+// componentRef is a template named by a literal comp, compJoin or include call
+type componentRef struct {
+	function string
+	name     string
 }
 
-// MustParseFS invokes ParseFS and panics if parsing fails.
-func (ts *TemplateSet) MustParseFS(filesystem fs.FS, roots ...string) {
-	if err := ts.ParseFS(filesystem, roots...); err != nil {
-		panic(err)
+// componentRefs returns the templates named by literal comp, compJoin and
+// include calls in source, skipping the functions replaced by custom functions.
+func (ts *TemplateSet) componentRefs(source string) []componentRef {
+	var refs []componentRef
+	for _, action := range actionRegex.FindAllStringSubmatch(source, -1) {
+		for _, ref := range compRefRegex.FindAllStringSubmatch(action[1], -1) {
+			if _, custom := ts.customFuncs[ref[1]]; !custom {
+				refs = append(refs, componentRef{function: ref[1], name: ref[2]})
+			}
+		}
 	}
+	return refs
 }
 
-// ParseDir invokes ParseDirs, but with a unique directory.
-func (ts *TemplateSet) ParseDir(dir string) error {
-	return ts.ParseDirs(dir)
+// parseOrderOf returns the parse position of a template, placing unknown names last
+func (ts *TemplateSet) parseOrderOf(name string) int {
+	if t, ok := ts.templates[name]; ok {
+		return t.parseOrder
+	}
+	return len(ts.templates)
 }
 
-// Execute renders a specific template using the configured layout.
-// The method combines the HTML content of the requested template with the
-// layout, automatically injecting all CSS and JavaScript associated with the
-// templates used (including referenced components) into the appropriate places
-// in the layout.
-//
-// The 'name' parameter must match the name of a previously parsed template
-// (without extension).
-//
-// The 'data' parameter contains the data that will be passed to the template.
-// It can be any type supported by the html/template package, such as map,
-// struct, or nil if no data is required.
-//
-// During rendering, the system automatically tracks which templates
-// are used (including components referenced via the comp function) and includes
-// only the CSS and JavaScript of the templates actually used.
-//
-// The resulting HTML is written in Writer 'w'.
-//
-// Returns an error if the requested template does not exist, if the layout is
-// not defined, or if an error occurs during template execution.
-func (ts *TemplateSet) Execute(w io.Writer, name string, data interface{}) error {
-	return ts.ExecuteWithLayout(w, ts.layoutName, name, data)
+// EmittedStyles records the scope classes whose CSS has already been sent to a
+// client. Create one per page (for example, stored with the user session) and
+// pass it to ExecuteTracked and ExecuteFragment so fragments swapped into an
+// already styled page do not repeat <style> blocks.
+type EmittedStyles map[string]bool
+
+// ExecuteTracked works like Execute, but records the scope classes whose CSS
+// was included in the page in emitted. CSS of scope classes already present in
+// emitted is not included again.
+func (ts *TemplateSet) ExecuteTracked(w io.Writer, name string, data interface{}, emitted EmittedStyles) error {
+	return ts.executeTimed(context.Background(), w, name, func(w io.Writer) error {
+		return ts.executeTracked(w, ts.layoutName, name, data, emitted)
+	})
 }
 
-// ExecuteWithLayout renders a specific template using the requested layout.
-// The layoutName parameter must match a parsed layout template name without extension.
-func (ts *TemplateSet) ExecuteWithLayout(w io.Writer, layoutName string, name string, data interface{}) error {
+// ExecuteFragment renders a parsed template without any layout, which makes it
+// suited for 'HTMX' and Ajax responses. Unlike ExecuteIsolated, the template
+// is rendered with all component features and the CSS of components whose
+// scope class is not yet in emitted is written in a <style> block before the
+// fragment. The JS of the used components is written in a <script> block
+// after the fragment. A nil emitted includes the CSS of every used component.
+func (ts *TemplateSet) ExecuteFragment(w io.Writer, name string, data interface{}, emitted EmittedStyles) error {
 	ts.renderMu.Lock()
 	defer ts.renderMu.Unlock()
 
-	return ts.executeWithLayout(w, layoutName, name, data)
+	content, err := ts.render(name, data, nil)
+	if err != nil {
+		return err
+	}
+	css, js, err := ts.collectAssets(emitted)
+	if err != nil {
+		return err
+	}
+
+	return writeInlineAssets(ts.limit(w), content, css, ts.externalScripts(nil), js)
 }
 
-func (ts *TemplateSet) executeWithLayout(w io.Writer, layoutName string, name string, data interface{}) error {
-	_, ok := ts.templates[name]
-	if !ok {
-		return fmt.Errorf("template %s not found", name)
-	}
+// ExecuteInline renders a parsed template without any layout, writing the CSS
+// of the used components in a <style> block before the content and their JS
+// in a <script> block after it, so the result can be inserted into a page
+// built elsewhere. Unlike ExecuteIsolated, the assets are kept, and unlike
+// Execute, no layout is required, so it also works with a set created with
+// NewTemplateSet("").
+func (ts *TemplateSet) ExecuteInline(w io.Writer, name string, data interface{}) error {
+	return ts.ExecuteFragment(w, name, data, nil)
+}
 
-	layout, ok := ts.layouts[layoutName]
-	if !ok || layout == nil {
-		return fmt.Errorf("layout template %s not found", layoutName)
+// RenderComponent renders a single component to a string, without any layout,
+// giving Go code the same power templates have through the comp function.
+// The arguments follow the comp rules: a single map argument becomes the
+// component data, while any other arguments are exposed positionally through
+// param, paramOr and the "0", "1", ... keys.
+//
+// The templates used by the component are tracked as in Execute, so their CSS
+// and JS are the ones of this render until the next one starts.
+func (ts *TemplateSet) RenderComponent(name string, args ...interface{}) (string, error) {
+	html, err := ts.renderAlone(func() (template.HTML, error) {
+		if _, ok := ts.templates[strings.TrimSuffix(name, ".html")]; !ok {
+			return "", fmt.Errorf("template %s not found", name)
+		}
+		return ts.renderComponent(name, args)
+	})
+	if err != nil {
+		return "", err
 	}
+	return string(html), nil
+}
+
+// renderAlone runs render as a render of its own, holding renderMu and
+// starting a new tracking of the used templates.
+func (ts *TemplateSet) renderAlone(render func() (template.HTML, error)) (template.HTML, error) {
+	ts.renderMu.Lock()
+	defer ts.renderMu.Unlock()
 
-	// Clean the usedTemplates list.
 	ts.mu.Lock()
 	ts.usedTemplates = make(map[string]bool)
+	ts.usedOrder = nil
+	ts.renderedCSS = make(map[string][]string)
 	ts.mu.Unlock()
 
+	return render()
+}
+
+// AttachTo adds the component functions and the parsed components to t, an
+// html/template of the application, so an existing codebase can adopt
+// components one page at a time. It must be called after parsing the
+// components and before parsing the templates of t that use them.
+//
+// The templates of t can then call {{ comp "card" }}, compJoin and include as
+// well as dict, param, paramOr, paramRequired, parentParam, asset, the default
+// functions and the functions added with AddFuncs. Each component is also
+// defined in t under its name, so {{ template "card" . }} works too, although
+// it does not receive comp arguments through param.
+//
+// In this mode the CSS and JS of the components are not injected anywhere,
+// since t has no layout: the scoped markup is rendered, but the page must
+// include the styles and scripts of the components by other means, for example
+// RenderParts or ExternalStyles on a page rendered by Skingo. Each comp call is
+// a render of its own, like RenderComponent, so calls from templates executed
+// concurrently are serialized.
+func (ts *TemplateSet) AttachTo(t *template.Template) error {
 	ts.mu.Lock()
-	for _, compName := range ts.layoutUses[layoutName] {
-		ts.usedTemplates[compName] = true
-	}
+	layoutFuncs := ts.layoutFuncs
+	customFuncs := maps.Clone(ts.customFuncs)
+	templateHTML := maps.Clone(ts.templateHTML)
 	ts.mu.Unlock()
 
-	// Creates a buffer to capture the template output
-	var contentBuf strings.Builder
+	if layoutFuncs == nil {
+		return fmt.Errorf("templates must be parsed before AttachTo")
+	}
 
-	// Use masterTmpl to execute the template
-	err := ts.masterTmpl.ExecuteTemplate(&contentBuf, name+".html", data)
+	// The rendering functions of the layouts become renders of their own,
+	// unless they were replaced by custom functions
+	funcs := maps.Clone(layoutFuncs)
+	attached := template.FuncMap{
+		"comp": func(templateName string, args ...interface{}) (template.HTML, error) {
+			return ts.renderAlone(func() (template.HTML, error) {
+				return ts.renderComponent(templateName, args)
+			})
+		},
+		"compJoin": func(templateName string, items interface{}, separator string) (template.HTML, error) {
+			return ts.renderAlone(func() (template.HTML, error) {
+				return ts.renderJoined(templateName, items, separator)
+			})
+		},
+		"include": func(templateName string, data ...interface{}) (template.HTML, error) {
+			return ts.renderAlone(func() (template.HTML, error) {
+				return ts.renderInclude(templateName, data)
+			})
+		},
+	}
+	for name, fn := range attached {
+		if _, custom := customFuncs[name]; !custom {
+			funcs[name] = fn
+		}
+	}
+	// The templates of t are not executed by comp, so the class and attrs of the
+	// data are not moved to their root element
+	funcs["_root_attrs"] = func(interface{}, bool) template.HTMLAttr { return "" }
+	funcs["_has_root_attr"] = func(interface{}, string) bool { return false }
+	funcs["_children"] = ts.renderChildren
+	funcs["_root_class"] = func(interface{}) string { return "" }
+	t.Funcs(funcs)
+
+	for name, html := range templateHTML {
+		if _, err := t.New(name).Parse(preserveComments(html)); err != nil {
+			return fmt.Errorf("error attaching template %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// ExecuteStandalone renders a template that is a complete page on its own (for
+// example, an email template) without using any layout. The CSS and JS of the
+// used components are inlined into <style> and <script> blocks, placed before
+// the template's </head> and </body> tags when they exist or around the
+// content otherwise.
+//
+// Unlike ExecuteIsolated, the template must have been parsed and its CSS is
+// kept. Unlike Execute, no layout is required.
+func (ts *TemplateSet) ExecuteStandalone(w io.Writer, name string, data interface{}) error {
+	ts.renderMu.Lock()
+	defer ts.renderMu.Unlock()
+
+	content, err := ts.render(name, data, nil)
+	if err != nil {
+		return err
+	}
+	css, js, err := ts.collectAssets(nil)
 	if err != nil {
 		return err
 	}
 
-	var allCSS strings.Builder
-	var allJS strings.Builder
+	return writePageAssets(ts.limit(w), content, css, ts.externalScripts(nil), js)
+}
 
-	ts.mu.Lock()
-	for templateName := range ts.usedTemplates {
-		if template, ok := ts.templates[templateName]; ok {
-			if template.CSS != "" {
-				allCSS.WriteString(template.CSS)
-				allCSS.WriteString("\n")
-			}
-			if template.JS != "" {
-				allJS.WriteString(template.JS)
-				allJS.WriteString("\n")
-			}
+// writePageAssets writes a complete page with its CSS and JS injected before
+// the </head> and </body> tags, the external script tags given by scripts
+// preceding the JS. Content without those tags is handled by
+// writeInlineAssets.
+func writePageAssets(w io.Writer, content, css, scripts, js string) error {
+	if !strings.Contains(content, "</head>") && !strings.Contains(content, "</body>") {
+		return writeInlineAssets(w, content, css, scripts, js)
+	}
+
+	if css != "" {
+		style := "<style>" + css + "</style>\n"
+		if i := strings.Index(content, "</head>"); i != -1 {
+			content = content[:i] + style + content[i:]
+		} else {
+			content = style + content
+		}
+	}
+	if scripts != "" || js != "" {
+		script := scripts
+		if js != "" {
+			script += "<script>" + js + "</script>\n"
+		}
+		if i := strings.LastIndex(content, "</body>"); i != -1 {
+			content = content[:i] + script + content[i:]
+		} else {
+			content += script
 		}
 	}
-	ts.mu.Unlock()
 
-	// Prepare the data for layout
-	layoutData := map[string]interface{}{
-		"Yield": template.HTML(contentBuf.String()),
-		"CSS":   template.CSS(allCSS.String()),
-		"JS":    template.JS(allJS.String()),
-		"Data":  data,
+	_, err := io.WriteString(w, content)
+	return err
+}
+
+// writeInlineAssets writes the content surrounded by its CSS and JS, omitting
+// empty <style> and <script> blocks. The external script tags given by scripts
+// precede the JS.
+func writeInlineAssets(w io.Writer, content, css, scripts, js string) error {
+	var b strings.Builder
+	if css != "" {
+		b.WriteString("<style>")
+		b.WriteString(css)
+		b.WriteString("</style>\n")
+	}
+	b.WriteString(content)
+	if scripts != "" {
+		b.WriteString("\n")
+		b.WriteString(strings.TrimSuffix(scripts, "\n"))
+	}
+	if js != "" {
+		b.WriteString("\n<script>")
+		b.WriteString(js)
+		b.WriteString("</script>")
 	}
 
-	// Execute the layout template with the prepared data
-	return layout.tmpl.Execute(w, layoutData)
+	_, err := io.WriteString(w, b.String())
+	return err
 }
 
 // ExecuteString renders a specific template using the configured layout and
@@ -1013,11 +4159,116 @@ func (ts *TemplateSet) Render(name string, data interface{}) (string, error) {
 	return ts.ExecuteString(name, data)
 }
 
-// ClearIsolatedCache removes all cached isolated templates.
+// RenderParts renders a parsed template without any layout and returns the
+// rendered content, the scoped CSS and the JS of the used components as
+// separate values, for callers that assemble the response themselves, such as
+// a JSON API returning an HTML island and its styles. The CSS and JS are
+// collected as in Execute, including the configured processors.
+func (ts *TemplateSet) RenderParts(name string, data interface{}) (html, css, js []byte, err error) {
+	ts.renderMu.Lock()
+	defer ts.renderMu.Unlock()
+
+	content, err := ts.render(name, data, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	cssCode, jsCode, err := ts.collectAssets(nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return []byte(content), []byte(cssCode), []byte(jsCode), nil
+}
+
+// Stats returns a summary of the parsed templates, which helps tooling inspect
+// the composition of the CSS and JS bundles and spot components without styles.
+func (ts *TemplateSet) Stats() ParseStats {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	stats := ParseStats{
+		Components: len(ts.templates),
+		Layouts:    len(ts.layouts),
+	}
+	for name, t := range ts.templates {
+		if t.CSS != "" {
+			stats.WithCSS = append(stats.WithCSS, name)
+			stats.CSSBytes += len(t.CSS)
+		}
+		if t.JS != "" {
+			stats.WithJS = append(stats.WithJS, name)
+			stats.JSBytes += len(t.JS)
+		}
+	}
+	sort.Strings(stats.WithCSS)
+	sort.Strings(stats.WithJS)
+	stats.Overrides = append([]TemplateOverride(nil), ts.overrides...)
+
+	return stats
+}
+
+// LayoutSource returns the source of the default layout after parsing, including
+// the <style> and <script> injected at the markers or before </head> and
+// </body>, which helps to verify the injection points. It returns an empty
+// string before the layout is parsed.
+func (ts *TemplateSet) LayoutSource() string {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.layout == nil {
+		return ""
+	}
+	return ts.layout.HTML
+}
+
+// OriginalCSS returns the CSS of the named template as written in its <style>
+// block, before scoping, so it can be compared with the scoped CSS while
+// debugging a selector. The returned bool reports whether the template exists.
+func (ts *TemplateSet) OriginalCSS(name string) (string, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	t, ok := ts.templates[strings.TrimSuffix(name, ".html")]
+	if !ok {
+		return "", false
+	}
+	return t.original, true
+}
+
+// ScopedCSS returns the CSS of the named template after scoping, as added to
+// the pages that use it, so tests can assert on the exact output of the
+// scoping transform. With DynamicCSS, the template actions are kept as
+// written. The returned bool reports whether the template exists.
+func (ts *TemplateSet) ScopedCSS(name string) (string, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	t, ok := ts.templates[strings.TrimSuffix(name, ".html")]
+	if !ok {
+		return "", false
+	}
+	return t.CSS, true
+}
+
+// ClearIsolatedCache removes all cached isolated templates and the layout files
+// cached by ExecuteLayout.
 func (ts *TemplateSet) ClearIsolatedCache() {
 	ts.cacheMu.Lock()
 	defer ts.cacheMu.Unlock()
 	ts.isolatedCache = make(map[string]*template.Template)
+	ts.fileLayouts = nil
+}
+
+// InvalidateIsolated removes the cached template of a single file, so the next
+// ExecuteIsolated call reads it again. The filename is the one given to
+// ExecuteIsolated, the path given to ExecuteIsolatedFS or the layout file given
+// to ExecuteLayout.
+func (ts *TemplateSet) InvalidateIsolated(filename string) {
+	ts.cacheMu.Lock()
+	defer ts.cacheMu.Unlock()
+	delete(ts.isolatedCache, filename)
+	delete(ts.isolatedCache, fmt.Sprintf("embed:%s", filename))
+	delete(ts.fileLayouts, filename)
 }
 
 // ExecuteIsolated renders a template directly, without using the configured layout.
@@ -1058,15 +4309,17 @@ func (ts *TemplateSet) ExecuteIsolated(w io.Writer, filename string, data interf
 	name = strings.TrimSuffix(name, filepath.Ext(name))
 
 	var htmlContent string
-	if matches := htmlRegex.FindStringSubmatch(string(content)); len(matches) > 1 {
+	if matches := matchTemplateBlock(string(content)); len(matches) > 1 {
 		htmlContent = matches[2]
 	} else {
 		htmlContent = string(content)
 	}
 
 	isolatedTmpl := template.New(name + "_isolated")
-	isolatedTmpl.Funcs(defaultFuncs)   // Add default functions
-	isolatedTmpl.Funcs(ts.customFuncs) // Add custom functions
+	isolatedTmpl.Delims(ts.leftDelim, ts.rightDelim)           // Use the delimiters of the set
+	isolatedTmpl.Funcs(defaultFuncs)                           // Add default functions
+	isolatedTmpl.Funcs(template.FuncMap{"asset": ts.assetURL}) // Add the asset function
+	isolatedTmpl.Funcs(ts.customFuncs)                         // Add custom functions
 
 	parsedTmpl, err := isolatedTmpl.Parse(htmlContent)
 	if err != nil {
@@ -1,14 +1,26 @@
 package skingo
 
 import (
+	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
+	"html/template"
+	"io"
 	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"testing"
 	"testing/fstest"
+	"time"
+
+	"golang.org/x/net/html"
 )
 
 const testLayout = `<!DOCTYPE html>
@@ -360,99 +372,4350 @@ func TestExecuteConcurrent(t *testing.T) {
 	wg.Wait()
 }
 
-func BenchmarkExecuteSimple(b *testing.B) {
+func TestReadableScopesUseTemplateNames(t *testing.T) {
 	testFS := newTestFS(map[string]string{
 		"templates/layouts/layout.html": testLayout,
-		"templates/page.html":           `<template><main><h1>{{ .Title }}</h1></main></template>`,
+		"templates/page.html": `<template>
+{{ comp "my-button" }}{{ comp "my_button" }}
+</template>`,
+		"templates/my-button.html": `<template><button>A</button></template>
+<style>button { color: red; }</style>`,
+		"templates/my_button.html": `<template><button>B</button></template>
+<style>button { color: blue; }</style>`,
 	})
 
 	ts := NewTemplateSet("layout")
+	ts.ReadableScopes(true)
 	if err := ts.ParseFS(testFS, "templates"); err != nil {
-		b.Fatalf("ParseFS returned error: %v", err)
+		t.Fatalf("ParseFS returned error: %v", err)
 	}
 
-	for i := 0; i < b.N; i++ {
-		var out strings.Builder
-		if err := ts.Execute(&out, "page", map[string]string{"Title": "Hello"}); err != nil {
-			b.Fatalf("Execute returned error: %v", err)
-		}
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if !strings.Contains(html, `<button class="s-my-button">A</button>`) {
+		t.Fatalf("expected readable scope class, got:\n%s", html)
+	}
+	if !strings.Contains(html, `<button class="s-my-button-2">B</button>`) {
+		t.Fatalf("expected suffixed scope class on collision, got:\n%s", html)
 	}
 }
 
-func BenchmarkExecuteNestedComponents(b *testing.B) {
+func TestDynamicCSSRendersComponentData(t *testing.T) {
 	testFS := newTestFS(map[string]string{
 		"templates/layouts/layout.html": testLayout,
-		"templates/page.html":           `<template>{{ comp "card" (dict "label" "Save") }}</template>`,
-		"templates/card.html":           `<template><section>{{ comp "button" .label "green" }}</section></template>`,
+		"templates/page.html":           `<template>{{ comp "badge" (dict "color" "teal") }}</template>`,
+		"templates/badge.html": `<template><span class="badge">New</span></template>
+<style>.badge { color: {{ .color }}; }</style>`,
+	})
+
+	ts := NewTemplateSet("layout")
+	ts.DynamicCSS(true)
+	if err := ts.ParseFS(testFS, "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if !strings.Contains(html, "color: teal;") {
+		t.Fatalf("expected CSS rendered with component data, got:\n%s", html)
+	}
+	if strings.Contains(html, "{{") {
+		t.Fatalf("expected no raw template actions in output, got:\n%s", html)
+	}
+}
+
+func TestExecuteFragmentSkipsEmittedStyles(t *testing.T) {
+	testFS := newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template>{{ comp "button" "Save" }}</template>`,
+		"templates/row.html":            `<template><p>{{ comp "button" "Edit" }}</p></template>`,
+		"templates/button.html": `<template><button class="btn">{{ param 0 }}</button></template>
+<style>.btn { color: red; }</style>`,
+	})
+
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(testFS, "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	emitted := EmittedStyles{}
+	var page strings.Builder
+	if err := ts.ExecuteTracked(&page, "page", nil, emitted); err != nil {
+		t.Fatalf("ExecuteTracked returned error: %v", err)
+	}
+	if !strings.Contains(page.String(), "color: red") {
+		t.Fatalf("expected button CSS in page, got:\n%s", page.String())
+	}
+
+	var fragment strings.Builder
+	if err := ts.ExecuteFragment(&fragment, "row", nil, emitted); err != nil {
+		t.Fatalf("ExecuteFragment returned error: %v", err)
+	}
+	if strings.Contains(fragment.String(), "<style>") {
+		t.Fatalf("expected already emitted CSS to be skipped, got:\n%s", fragment.String())
+	}
+	if !strings.Contains(fragment.String(), ">Edit</button>") {
+		t.Fatalf("expected fragment content, got:\n%s", fragment.String())
+	}
+
+	fragment.Reset()
+	if err := ts.ExecuteFragment(&fragment, "row", nil, nil); err != nil {
+		t.Fatalf("ExecuteFragment returned error: %v", err)
+	}
+	if !strings.HasPrefix(fragment.String(), "<style>") || !strings.Contains(fragment.String(), "color: red") {
+		t.Fatalf("expected fragment CSS without emitted set, got:\n%s", fragment.String())
+	}
+}
+
+func TestExecuteStandaloneInlinesAssetsWithoutLayout(t *testing.T) {
+	testFS := newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/welcome.html": `<template>
+<!DOCTYPE html>
+<html>
+<head><title>Welcome</title></head>
+<body><h1>Hello {{ .Name }}</h1></body>
+</html>
+</template>
+<style>h1 { color: navy; }</style>`,
+		"templates/note.html": `<template><p class="note">Saved</p></template>
+<style>.note { color: green; }</style>
+<script>console.log("note");</script>`,
+	})
+
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(testFS, "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	var page strings.Builder
+	if err := ts.ExecuteStandalone(&page, "welcome", map[string]string{"Name": "Ana"}); err != nil {
+		t.Fatalf("ExecuteStandalone returned error: %v", err)
+	}
+	html := page.String()
+	if !strings.HasPrefix(html, "<!DOCTYPE html>") || strings.Contains(html, "<title>test</title>") {
+		t.Fatalf("expected standalone document without layout, got:\n%s", html)
+	}
+	if !strings.Contains(html, "color: navy;") || strings.Index(html, "<style>") > strings.Index(html, "</head>") {
+		t.Fatalf("expected CSS inlined in head, got:\n%s", html)
+	}
+
+	var fragment strings.Builder
+	if err := ts.ExecuteStandalone(&fragment, "note", nil); err != nil {
+		t.Fatalf("ExecuteStandalone returned error: %v", err)
+	}
+	if !strings.HasPrefix(fragment.String(), "<style>") || !strings.Contains(fragment.String(), `<script>console.log("note");`) {
+		t.Fatalf("expected assets around component, got:\n%s", fragment.String())
+	}
+}
+
+func TestExecuteEmailInlinesScopedCSS(t *testing.T) {
+	testFS := newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/email.html": `<template>
+<html>
+<head><title>Email</title></head>
+<body>
+<h1>Welcome</h1>
+<p style="margin: 0">Thanks for joining.</p>
+<a href="/start">Start</a>
+</body>
+</html>
+</template>
+<style>
+h1 { color: navy; font-size: 24px; }
+body > p { color: gray; margin: 8px; }
+a:hover { color: red; }
+</style>`,
+	})
+
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(testFS, "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	var out strings.Builder
+	if err := ts.ExecuteEmail(&out, "email", nil); err != nil {
+		t.Fatalf("ExecuteEmail returned error: %v", err)
+	}
+	html := out.String()
+
+	if !strings.Contains(html, `<h1 style="color: navy; font-size: 24px">Welcome</h1>`) {
+		t.Fatalf("expected h1 styles inlined, got:\n%s", html)
+	}
+	if !strings.Contains(html, `<p style="color: gray; margin: 0">`) {
+		t.Fatalf("expected existing inline style to win, got:\n%s", html)
+	}
+	if !strings.Contains(html, "a:hover { color: red; }") || strings.Contains(html, "<a href=\"/start\" style") {
+		t.Fatalf("expected unsupported selector kept in style block, got:\n%s", html)
+	}
+}
+
+func TestExecuteEmailKeepsSemicolonsInsideValues(t *testing.T) {
+	testFS := newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/email.html": `<template>
+<html>
+<body>
+<div class="logo">Logo</div>
+<p style="font-family: 'A;B', serif">Text</p>
+</body>
+</html>
+</template>
+<style>
+.logo { background: url(data:image/svg+xml;base64,PHN2Zz4=) no-repeat; width: 10px; }
+p { color: gray; }
+</style>`,
+	})
+
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(testFS, "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	var out strings.Builder
+	if err := ts.ExecuteEmail(&out, "email", nil); err != nil {
+		t.Fatalf("ExecuteEmail returned error: %v", err)
+	}
+	html := out.String()
+
+	if !strings.Contains(html, `style="background: url(data:image/svg+xml;base64,PHN2Zz4=) no-repeat; width: 10px"`) {
+		t.Fatalf("expected the data URI inlined whole, got:\n%s", html)
+	}
+	if !strings.Contains(html, `style="color: gray; font-family: 'A;B', serif"`) {
+		t.Fatalf("expected the quoted value kept whole, got:\n%s", html)
+	}
+}
+
+func TestRenderComponentMirrorsCompArguments(t *testing.T) {
+	testFS := newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/card.html":           `<template><article>{{ .title }}: {{ comp "button" .label "green" }}</article></template>`,
 		"templates/button.html":         `<template><button class="{{ paramOr 1 "blue" }}">{{ param 0 }}</button></template>`,
 	})
 
 	ts := NewTemplateSet("layout")
 	if err := ts.ParseFS(testFS, "templates"); err != nil {
-		b.Fatalf("ParseFS returned error: %v", err)
+		t.Fatalf("ParseFS returned error: %v", err)
 	}
 
-	for i := 0; i < b.N; i++ {
-		var out strings.Builder
-		if err := ts.Execute(&out, "page", nil); err != nil {
-			b.Fatalf("Execute returned error: %v", err)
-		}
+	html, err := ts.RenderComponent("card", map[string]interface{}{"title": "Order", "label": "Pay"})
+	if err != nil {
+		t.Fatalf("RenderComponent returned error: %v", err)
+	}
+	if got, want := html, `<article>Order: <button class="green">Pay</button></article>`; got != want {
+		t.Fatalf("unexpected component output: got %q want %q", got, want)
+	}
+
+	html, err = ts.RenderComponent("button.html", "Cancel")
+	if err != nil {
+		t.Fatalf("RenderComponent returned error: %v", err)
+	}
+	if got, want := html, `<button class="blue">Cancel</button>`; got != want {
+		t.Fatalf("unexpected positional output: got %q want %q", got, want)
+	}
+
+	if _, err := ts.RenderComponent("missing"); err == nil || !strings.Contains(err.Error(), "template missing not found") {
+		t.Fatalf("expected missing template error, got %v", err)
 	}
 }
 
-func BenchmarkExecuteIsolatedCacheHit(b *testing.B) {
-	dir := b.TempDir()
-	path := filepath.Join(dir, "fragment.html")
-	if err := os.WriteFile(path, []byte(`<template><p>{{ .Text }}</p></template>`), 0o644); err != nil {
-		b.Fatalf("writing test file: %v", err)
+func TestCustomFuncsTakePrecedenceOverInternalFuncs(t *testing.T) {
+	testFS := newTestFS(map[string]string{
+		"templates/layouts/layout.html": `<!DOCTYPE html>
+<html>
+<head><title>{{ dict "layout" }}</title></head>
+<body>{{ .Yield }}</body>
+</html>`,
+		"templates/page.html": `<template><p>{{ dict "page" }}</p></template>`,
+	})
+
+	ts := NewTemplateSet("layout")
+	ts.AddFuncs(template.FuncMap{
+		"dict": func(value string) string { return "custom " + value },
+	})
+	if err := ts.ParseFS(testFS, "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if !strings.Contains(html, "<title>custom layout</title>") {
+		t.Fatalf("expected custom dict in layout, got:\n%s", html)
 	}
+	if !strings.Contains(html, "<p>custom page</p>") {
+		t.Fatalf("expected custom dict in template, got:\n%s", html)
+	}
+}
+
+func TestSetMaxOutputBytesAbortsLargeRenders(t *testing.T) {
+	testFS := newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><ul>{{ range .Items }}<li>{{ . }}</li>{{ end }}</ul></template>`,
+		"templates/list.html":           `<template>{{ comp "page" . }}</template>`,
+	})
 
 	ts := NewTemplateSet("layout")
-	var warmup strings.Builder
-	if err := ts.ExecuteIsolated(&warmup, path, map[string]string{"Text": "Hello"}); err != nil {
-		b.Fatalf("warmup ExecuteIsolated returned error: %v", err)
+	if err := ts.ParseFS(testFS, "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
 	}
+	ts.SetMaxOutputBytes(512)
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		var out strings.Builder
-		if err := ts.ExecuteIsolated(&out, path, map[string]string{"Text": "Hello"}); err != nil {
-			b.Fatalf("ExecuteIsolated returned error: %v", err)
+	small := map[string]interface{}{"Items": []string{"a", "b"}}
+	if _, err := ts.ExecuteString("page", small); err != nil {
+		t.Fatalf("expected small render to succeed, got %v", err)
+	}
+
+	items := make([]string, 1000)
+	for i := range items {
+		items[i] = "item"
+	}
+	large := map[string]interface{}{"Items": items}
+	for _, name := range []string{"page", "list"} {
+		_, err := ts.ExecuteString(name, large)
+		if !errors.Is(err, ErrOutputLimit) {
+			t.Fatalf("expected ErrOutputLimit rendering %s, got %v", name, err)
 		}
 	}
-}
 
-func BenchmarkExecuteIsolatedCacheMiss(b *testing.B) {
-	dir := b.TempDir()
-	path := filepath.Join(dir, "fragment.html")
-	if err := os.WriteFile(path, []byte(`<template><p>{{ .Text }}</p></template>`), 0o644); err != nil {
-		b.Fatalf("writing test file: %v", err)
+	// The final page write is limited too
+	ts.SetMaxOutputBytes(int64(len(testLayout)))
+	if _, err := ts.ExecuteString("page", small); !errors.Is(err, ErrOutputLimit) {
+		t.Fatalf("expected ErrOutputLimit on layout write, got %v", err)
 	}
+}
 
+func TestSetMaxOutputBytesLimitsInlineAssets(t *testing.T) {
 	ts := NewTemplateSet("layout")
-	for i := 0; i < b.N; i++ {
-		ts.ClearIsolatedCache()
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/card.html": `<template><p>Hi</p></template>
+<style>p { color: red; font-weight: bold; margin: 0 auto; }</style>
+<script>console.log("card");</script>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	renders := map[string]func(w io.Writer) error{
+		"ExecuteFragment":   func(w io.Writer) error { return ts.ExecuteFragment(w, "card", nil, nil) },
+		"ExecuteStandalone": func(w io.Writer) error { return ts.ExecuteStandalone(w, "card", nil) },
+		"ExecuteEmail":      func(w io.Writer) error { return ts.ExecuteEmail(w, "card", nil) },
+		"RenderSession":     func(w io.Writer) error { return ts.NewRenderSession().RenderFragment(w, "card", nil) },
+	}
+	for name, render := range renders {
+		ts.SetMaxOutputBytes(0)
+		var full strings.Builder
+		if err := render(&full); err != nil {
+			t.Fatalf("%s returned error: %v", name, err)
+		}
+
+		// The content alone fits, but not with its CSS and JS
+		limit := int64(full.Len() - 1)
+		ts.SetMaxOutputBytes(limit)
 		var out strings.Builder
-		if err := ts.ExecuteIsolated(&out, path, map[string]string{"Text": "Hello"}); err != nil {
-			b.Fatalf("ExecuteIsolated returned error: %v", err)
+		if err := render(&out); !errors.Is(err, ErrOutputLimit) {
+			t.Fatalf("expected ErrOutputLimit from %s, got %v", name, err)
+		}
+		if int64(out.Len()) > limit {
+			t.Fatalf("expected %s to write at most %d bytes, wrote %d", name, limit, out.Len())
 		}
 	}
 }
 
-func BenchmarkParseFSManyTemplates(b *testing.B) {
-	files := map[string]string{
+func TestSetObserverReceivesRenderEvents(t *testing.T) {
+	testFS := newTestFS(map[string]string{
 		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template>{{ comp "button" "Save" }}</template>`,
+		"templates/button.html":         `<template><button>{{ param 0 }}</button></template>`,
+	})
+
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(testFS, "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
 	}
-	for i := 0; i < 100; i++ {
-		files[fmt.Sprintf("templates/page-%03d.html", i)] = fmt.Sprintf(`<template><p>Page %d</p></template>`, i)
+
+	var events []RenderEvent
+	ts.SetObserver(func(event RenderEvent) {
+		events = append(events, event)
+	})
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if err := ts.Execute(&strings.Builder{}, "missing", nil); err == nil {
+		t.Fatal("expected missing template error")
 	}
-	testFS := newTestFS(files)
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		ts := NewTemplateSet("layout")
-		if err := ts.ParseFS(testFS, "templates"); err != nil {
-			b.Fatalf("ParseFS returned error: %v", err)
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+	event := events[0]
+	if event.Template != "page" || event.Layout != "layout" || event.Err != nil {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+	if event.Components != 2 || event.Bytes != int64(len(html)) || event.Duration < 0 {
+		t.Fatalf("unexpected event measurements: %+v", event)
+	}
+	if events[1].Err == nil {
+		t.Fatalf("expected error in second event: %+v", events[1])
+	}
+
+	ts.SetObserver(nil)
+	if _, err := ts.ExecuteString("page", nil); err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expected no events after removing observer, got %d", len(events))
+	}
+}
+
+func TestSetLoggerReportsParseAndRenderProblems(t *testing.T) {
+	testFS := newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template>{{ comp .Name }}</template>`,
+		"templates/loop.html":           `<template>{{ comp "loop" }}</template>`,
+	})
+
+	var logs strings.Builder
+	ts := NewTemplateSet("layout")
+	ts.SetLogger(slog.New(slog.NewTextHandler(&logs, nil)))
+	if err := ts.ParseFS(testFS, "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	if _, err := ts.ExecuteString("page", map[string]string{"Name": "typo"}); err == nil {
+		t.Fatal("expected missing component error")
+	}
+	if !strings.Contains(logs.String(), "component not found") || !strings.Contains(logs.String(), "template=typo") {
+		t.Fatalf("expected missing component log, got:\n%s", logs.String())
+	}
+
+	_, err := ts.ExecuteString("loop", nil)
+	if err == nil || !strings.Contains(err.Error(), "maximum nesting depth") {
+		t.Fatalf("expected recursion error, got %v", err)
+	}
+	if !strings.Contains(logs.String(), "component recursion limit exceeded") {
+		t.Fatalf("expected recursion log, got:\n%s", logs.String())
+	}
+
+	broken := newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/broken.html":         `<template>{{ if }}</template>`,
+	})
+	logs.Reset()
+	ts = NewTemplateSet("layout")
+	ts.SetLogger(slog.New(slog.NewTextHandler(&logs, nil)))
+	if err := ts.ParseFS(broken, "templates"); err == nil {
+		t.Fatal("expected parse error")
+	}
+	if !strings.Contains(logs.String(), "error parsing template") || !strings.Contains(logs.String(), "file=templates/broken.html") {
+		t.Fatalf("expected parse error log, got:\n%s", logs.String())
+	}
+}
+
+func TestCompDataShapes(t *testing.T) {
+	type user struct {
+		Name string
+		Age  int
+	}
+
+	testFS := newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/named.html":          `<template><p>{{ .name }}</p></template>`,
+		"templates/positional.html":     `<template><p>{{ index . "0" }}|{{ index . "1" }}|{{ param 1 }}</p></template>`,
+		"templates/single.html":         `<template><p>{{ index . "0" }}</p></template>`,
+		"templates/profile.html":        `<template typed><p>{{ .Name }} ({{ .Age }})</p></template>`,
+		"templates/label.html":          `<template typed><p>{{ . }}</p></template>`,
+		"templates/page.html": `<template>
+{{ comp "named" (dict "name" "Named") }}
+{{ comp "positional" "A" "B" }}
+{{ comp "single" .User }}
+{{ comp "profile" .User }}
+{{ comp "label" "Plain" }}
+</template>`,
+	})
+
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(testFS, "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", map[string]interface{}{"User": user{Name: "Ana", Age: 30}})
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+
+	for _, want := range []string{
+		"<p>Named</p>",
+		"<p>A|B|B</p>",
+		"<p>{Ana 30}</p>",
+		"<p>Ana (30)</p>",
+		"<p>Plain</p>",
+	} {
+		if !strings.Contains(html, want) {
+			t.Fatalf("expected %q in output, got:\n%s", want, html)
+		}
+	}
+}
+
+func TestScopeClassExposedToComponentHTMLAndJS(t *testing.T) {
+	testFS := newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template>{{ comp "menu" (dict "label" "Open") }}</template>`,
+		"templates/menu.html": `<template><nav class="menu" data-scope="{{ .ScopeClass }}">{{ .label }}</nav></template>
+<style>.menu { display: flex; }</style>
+<script>document.querySelectorAll(".{{ .ScopeClass }}").forEach(init);</script>`,
+	})
+
+	ts := NewTemplateSet("layout")
+	ts.ReadableScopes(true)
+	if err := ts.ParseFS(testFS, "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if !strings.Contains(html, `<nav class="s-menu menu" data-scope="s-menu">Open</nav>`) {
+		t.Fatalf("expected scope class in component HTML, got:\n%s", html)
+	}
+	if !strings.Contains(html, `document.querySelectorAll(".s-menu")`) {
+		t.Fatalf("expected scope class in component JS, got:\n%s", html)
+	}
+
+	args := map[string]interface{}{"label": "Close"}
+	if _, err := ts.RenderComponent("menu", args); err != nil {
+		t.Fatalf("RenderComponent returned error: %v", err)
+	}
+	if _, exists := args["ScopeClass"]; exists {
+		t.Fatalf("expected caller map to be left untouched, got %v", args)
+	}
+
+	// A ScopeClass passed by the caller is kept
+	html, err = ts.RenderComponent("menu", map[string]interface{}{"label": "Own", "ScopeClass": "mine"})
+	if err != nil {
+		t.Fatalf("RenderComponent returned error: %v", err)
+	}
+	if !strings.Contains(html, `data-scope="mine"`) {
+		t.Fatalf("expected the caller ScopeClass to be kept, got %s", html)
+	}
+}
+
+func TestExecuteOrdersAssetsDeterministically(t *testing.T) {
+	files := map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template>{{ comp "zeta" }}{{ comp "alpha" }}{{ comp "mid" }}</template>`,
+	}
+	for _, name := range []string{"zeta", "alpha", "mid"} {
+		files["templates/"+name+".html"] = fmt.Sprintf(`<template><p class="%[1]s">%[1]s</p></template>
+<style>.%[1]s { content: "%[1]s"; }</style>
+<script>console.log("%[1]s");</script>`, name)
+	}
+
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(files), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	first, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		html, err := ts.ExecuteString("page", nil)
+		if err != nil {
+			t.Fatalf("ExecuteString returned error: %v", err)
+		}
+		if html != first {
+			t.Fatalf("expected identical output across renders, got:\n%s\nand:\n%s", first, html)
+		}
+	}
+
+	alpha := strings.Index(first, `content: "alpha"`)
+	mid := strings.Index(first, `content: "mid"`)
+	zeta := strings.Index(first, `content: "zeta"`)
+	if !(alpha < mid && mid < zeta) {
+		t.Fatalf("expected CSS sorted by template name, got:\n%s", first)
+	}
+	if !(strings.Index(first, `console.log("alpha")`) < strings.Index(first, `console.log("zeta")`)) {
+		t.Fatalf("expected JS sorted by template name, got:\n%s", first)
+	}
+}
+
+func TestSetAssetOrder(t *testing.T) {
+	files := map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html": `<template><main>{{ comp "alpha" }}{{ comp "zeta" }}</main></template>
+<style>main { content: "page"; }</style>`,
+		"templates/zeta.html":  `<template><p>zeta</p></template><style>p { content: "zeta"; }</style>`,
+		"overrides/alpha.html": `<template><p>alpha</p></template><style>p { content: "alpha"; }</style>`,
+	}
+
+	tests := []struct {
+		order AssetOrder
+		want  []string
+	}{
+		{OrderAlphabetical, []string{"alpha", "page", "zeta"}},
+		{OrderParse, []string{"page", "zeta", "alpha"}},
+		{OrderUsage, []string{"page", "alpha", "zeta"}},
+	}
+
+	for _, tt := range tests {
+		ts := NewTemplateSet("layout")
+		ts.SetAssetOrder(tt.order)
+		if err := ts.ParseFS(newTestFS(files), "templates", "overrides"); err != nil {
+			t.Fatalf("ParseFS returned error: %v", err)
+		}
+
+		html, err := ts.ExecuteString("page", nil)
+		if err != nil {
+			t.Fatalf("ExecuteString returned error: %v", err)
+		}
+
+		last := -1
+		for _, name := range tt.want {
+			index := strings.Index(html, `content: "`+name+`"`)
+			if index <= last {
+				t.Fatalf("order %d: expected CSS in order %v, got:\n%s", tt.order, tt.want, html)
+			}
+			last = index
+		}
+	}
+}
+
+func TestCompAttrsMergedOntoRootElement(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html": `<template><main>{{ comp "card" (dict "attrs" (dict "id" "x" "aria-label" "A \"quoted\" card" "hidden" true "open" false "onclick" "alert(1)")) }}` +
+			`{{ comp "badge" (dict "attrs" (dict "data-count" 3)) }}{{ comp "badge" }}</main></template>`,
+		"templates/card.html":  `<template><article class="card" id="default">Card</article></template><style>.card { color: red; }</style>`,
+		"templates/badge.html": `<template><span>Badge</span></template>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+
+	card := ts.templates["card"].scopeClass
+	if want := `<article aria-label="A &#34;quoted&#34; card" hidden id="x" class="` + card + ` card">Card</article>`; !strings.Contains(html, want) {
+		t.Fatalf("expected attrs merged onto the card root, got:\n%s", html)
+	}
+	if strings.Contains(html, "onclick") || strings.Contains(html, " open") {
+		t.Fatalf("expected event handlers and false attrs to be skipped, got:\n%s", html)
+	}
+	if !strings.Contains(html, `<span data-count="3">Badge</span><span>Badge</span>`) {
+		t.Fatalf("expected attrs on the badge root only when passed, got:\n%s", html)
+	}
+}
+
+func TestCompAttrsUnsafeValuesSkipped(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html": `<template><main>{{ comp "link" (dict "attrs" (dict "href" "javascript:alert(1)" "style" "background:url(x)")) }}` +
+			`{{ comp "link" (dict "attrs" (dict "href" " JavaScript:alert(1)")) }}` +
+			`{{ comp "link" (dict "attrs" (dict "href" "/docs?a=b:c" "title" "Docs")) }}` +
+			`{{ comp "link" (dict "attrs" (dict "href" "https://example.com")) }}</main></template>`,
+		"templates/link.html": `<template><a href="/" title='Home'>Link</a></template>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+
+	if strings.Contains(html, "javascript") || strings.Contains(html, "JavaScript") || strings.Contains(html, "style=") {
+		t.Fatalf("expected unsafe attrs to be skipped, got:\n%s", html)
+	}
+	for _, want := range []string{
+		`<a href="/" title='Home'>Link</a><a href="/" title='Home'>Link</a>`,
+		`<a href="/docs?a=b:c" title="Docs">Link</a>`,
+		`<a href="https://example.com" title='Home'>Link</a>`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Fatalf("expected %s, got:\n%s", want, html)
+		}
+	}
+}
+
+func TestPageDataAttrsLeaveRootUnchanged(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main id="page" class="page">Page</main></template><style>main { color: red; }</style>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	want, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	got, err := ts.ExecuteString("page", map[string]interface{}{
+		"attrs": map[string]interface{}{"id": "roster", "hidden": true},
+	})
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if got != want {
+		t.Fatalf("expected the attrs data key to leave the page unchanged, got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestCompClassMergedWithScopeClass(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html": `<template><main>{{ comp "card" (dict "class" "mt-4 shadow") }}` +
+			`{{ comp "badge" (dict "class" "ml-2" "attrs" (dict "class" "extra" "id" "b")) }}` +
+			`{{ comp "button" (dict "class" "primary") }}</main></template>`,
+		"templates/card.html":   `<template><article class="card">Card</article></template><style>.card { color: red; }</style>`,
+		"templates/badge.html":  `<template><span>Badge</span></template>`,
+		"templates/button.html": `<template><button class="btn {{ .class }}">Go</button></template>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+
+	card := ts.templates["card"].scopeClass
+	if want := `<article class="` + card + ` card mt-4 shadow">Card</article>`; !strings.Contains(html, want) {
+		t.Fatalf("expected caller classes after the scope class, got:\n%s", html)
+	}
+	if want := `<span class="ml-2 extra" id="b">Badge</span>`; !strings.Contains(html, want) {
+		t.Fatalf("expected a class attribute on a root without one, got:\n%s", html)
+	}
+	if want := `<button class="btn primary">Go</button>`; !strings.Contains(html, want) {
+		t.Fatalf("expected components handling the class themselves to be left untouched, got:\n%s", html)
+	}
+
+	// The class key of the data given to Execute is not a caller class
+	for _, name := range []string{"card", "badge"} {
+		want, err := ts.ExecuteString(name, nil)
+		if err != nil {
+			t.Fatalf("ExecuteString returned error: %v", err)
+		}
+		got, err := ts.ExecuteString(name, map[string]interface{}{"class": "3B"})
+		if err != nil {
+			t.Fatalf("ExecuteString returned error: %v", err)
+		}
+		if got != want {
+			t.Fatalf("expected the class data key to leave the page unchanged, got:\n%s\nwant:\n%s", got, want)
+		}
+	}
+}
+
+func TestScopePrefix(t *testing.T) {
+	files := map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template>{{ comp "button" }}</template>`,
+		"templates/button.html": `<template><button>Go</button></template>
+<style>button { color: red; }</style>`,
+	}
+
+	ts := NewTemplateSet("layout")
+	ts.ScopePrefix("app")
+	if err := ts.ParseFS(newTestFS(files), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	scope := ts.templates["button"].scopeClass
+	if len(scope) != len("app-button-a1b2") || !strings.HasPrefix(scope, "app-button-") {
+		t.Fatalf("expected a prefixed scope class with a short hash, got %q", scope)
+	}
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if !strings.Contains(html, `<button class="`+scope+`">Go</button>`) || !strings.Contains(html, "button."+scope) {
+		t.Fatalf("expected the prefixed scope class in HTML and CSS, got:\n%s", html)
+	}
+
+	readable := NewTemplateSet("layout")
+	readable.ScopePrefix("app-")
+	readable.ReadableScopes(true)
+	if err := readable.ParseFS(newTestFS(files), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+	if got := readable.templates["button"].scopeClass; got != "app-button" {
+		t.Fatalf("expected readable prefixed scope class app-button, got %q", got)
+	}
+}
+
+func TestExecuteHTTPCompressesWithGzip(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main>{{ .Title }}</main></template>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "br, gzip;q=0.8")
+	rec := httptest.NewRecorder()
+	if err := ts.ExecuteHTTP(rec, req, "page", map[string]string{"Title": "Compressed"}); err != nil {
+		t.Fatalf("ExecuteHTTP returned error: %v", err)
+	}
+	if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("expected gzip Content-Encoding, got %q", got)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "text/html; charset=utf-8" {
+		t.Fatalf("expected HTML Content-Type, got %q", got)
+	}
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("gzip.NewReader returned error: %v", err)
+	}
+	body, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("reading gzip body returned error: %v", err)
+	}
+	if !strings.Contains(string(body), "<main>Compressed</main>") {
+		t.Fatalf("expected rendered page in the gzip body, got:\n%s", body)
+	}
+
+	// Requests that do not accept gzip receive the plain page
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip;q=0, *")
+	rec = httptest.NewRecorder()
+	if err := ts.ExecuteHTTP(rec, req, "page", map[string]string{"Title": "Plain"}); err != nil {
+		t.Fatalf("ExecuteHTTP returned error: %v", err)
+	}
+	if rec.Header().Get("Content-Encoding") != "" || !strings.Contains(rec.Body.String(), "<main>Plain</main>") {
+		t.Fatalf("expected an uncompressed page, got headers %v and body:\n%s", rec.Header(), rec.Body.String())
+	}
+
+	// Failed renders leave the response untouched
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+	if err := ts.ExecuteHTTP(rec, req, "missing", nil); err == nil {
+		t.Fatal("expected error for missing template")
+	}
+	if rec.Header().Get("Content-Encoding") != "" || rec.Body.Len() != 0 {
+		t.Fatalf("expected nothing written on error, got headers %v and body %q", rec.Header(), rec.Body.String())
+	}
+}
+
+func TestCacheComponent(t *testing.T) {
+	calls := 0
+	ts := NewTemplateSet("layout")
+	ts.AddFuncs(template.FuncMap{
+		"loadMenu": func() string {
+			calls++
+			return fmt.Sprintf("menu %d", calls)
+		},
+	})
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main>{{ comp "nav" "main" }}{{ comp "nav" "main" }}{{ comp "nav" "footer" }}</main></template>`,
+		"templates/nav.html":            `<template><nav>{{ param 0 }}: {{ loadMenu }} {{ comp "link" }}</nav></template><style>nav { color: red; }</style>`,
+		"templates/link.html":           `<template><a>link</a></template><style>a { color: blue; }</style>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+	ts.CacheComponent("nav.html", time.Minute, nil)
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if calls != 2 || strings.Count(html, "main: menu 1") != 2 || !strings.Contains(html, "footer: menu 2") {
+		t.Fatalf("expected one render per key, got %d calls and:\n%s", calls, html)
+	}
+
+	// A cached render still includes the CSS of the component and its children
+	html, err = ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if calls != 2 {
+		t.Fatalf("expected cached renders, got %d calls", calls)
+	}
+	if !strings.Contains(html, "color: red") || !strings.Contains(html, "color: blue") {
+		t.Fatalf("expected CSS of cached components, got:\n%s", html)
+	}
+
+	// Expired entries are rendered again
+	for _, entry := range ts.compCaches["nav"].entries {
+		entry.expires = time.Now().Add(-time.Second)
+	}
+	if html, err = ts.ExecuteString("page", nil); err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if calls != 4 || !strings.Contains(html, "main: menu 3") {
+		t.Fatalf("expected expired entries to be rendered again, got %d calls and:\n%s", calls, html)
+	}
+
+	ts.ClearComponentCache()
+	if _, err = ts.ExecuteString("page", nil); err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if calls != 6 {
+		t.Fatalf("expected ClearComponentCache to discard entries, got %d calls", calls)
+	}
+}
+
+func TestStatsSummarizesParsedTemplates(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main>{{ comp "card" }}</main></template>`,
+		"templates/card.html":           `<template><div>Card</div></template><style>div { color: red; }</style><script>console.log("card");</script>`,
+		"templates/button.html":         `<template><button>Go</button></template><style>button { color: blue; }</style>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	stats := ts.Stats()
+	if stats.Components != 3 || stats.Layouts != 1 {
+		t.Fatalf("expected 3 components and 1 layout, got %+v", stats)
+	}
+	if got := strings.Join(stats.WithCSS, ","); got != "button,card" {
+		t.Fatalf("expected button and card with CSS, got %q", got)
+	}
+	if got := strings.Join(stats.WithJS, ","); got != "card" {
+		t.Fatalf("expected card with JS, got %q", got)
+	}
+	if want := len(ts.templates["card"].CSS) + len(ts.templates["button"].CSS); stats.CSSBytes != want {
+		t.Fatalf("expected %d CSS bytes, got %d", want, stats.CSSBytes)
+	}
+}
+
+func TestAssetProcessors(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html": `<template><main>Page</main></template>
+<style>main { color: red; }</style>
+<script>console.log("page");</script>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	ts.SetCSSProcessor(func(css string) (string, error) {
+		return "/* processed */\n" + css, nil
+	})
+	ts.SetJSProcessor(func(js string) (string, error) {
+		return strings.ReplaceAll(js, "console.log", "console.info"), nil
+	})
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if !strings.Contains(html, "/* processed */") || !strings.Contains(html, `console.info("page")`) {
+		t.Fatalf("expected processed CSS and JS, got:\n%s", html)
+	}
+
+	processErr := errors.New("bad css")
+	ts.SetCSSProcessor(func(css string) (string, error) {
+		return "", processErr
+	})
+	if _, err := ts.ExecuteString("page", nil); !errors.Is(err, processErr) {
+		t.Fatalf("expected processor error to fail the render, got %v", err)
+	}
+}
+
+func TestExternalStylesServedByAssetHandler(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	ts.ExternalStyles("/assets")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html": `<template><main>Page</main></template>
+<style>main { color: red; }</style>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if strings.Contains(html, "<style>") {
+		t.Fatalf("expected no inline style, got:\n%s", html)
+	}
+	start := strings.Index(html, `<link rel="stylesheet" href="/assets/`)
+	if start == -1 {
+		t.Fatalf("expected a stylesheet link, got:\n%s", html)
+	}
+	href := html[start+len(`<link rel="stylesheet" href="`):]
+	href = href[:strings.Index(href, `"`)]
+
+	handler := http.StripPrefix("/assets/", ts.AssetHandler())
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, href, nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "color: red") {
+		t.Fatalf("expected the stylesheet from %s, got %d:\n%s", href, rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Content-Type"); got != "text/css; charset=utf-8" {
+		t.Fatalf("expected CSS Content-Type, got %q", got)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/assets/missing.css", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown assets, got %d", rec.Code)
+	}
+}
+
+func TestScriptDependenciesComeFirst(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main>{{ comp "alert" }}{{ comp "button" }}</main></template>`,
+		"templates/alert.html":          `<template><p>Alert</p></template><script data-requires="button">console.log("alert");</script>`,
+		"templates/button.html":         `<template><button>Go</button></template><script data-requires="tooltip, icons">console.log("button");</script>`,
+		"templates/tooltip.html":        `<template><span>Tip</span></template><script data-requires="icons">console.log("tooltip");</script>`,
+		"templates/icons.html":          `<template><i></i></template><script>console.log("icons");</script>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+
+	last := -1
+	for _, name := range []string{"icons", "tooltip", "button", "alert"} {
+		index := strings.Index(html, `console.log("`+name+`")`)
+		if index <= last {
+			t.Fatalf("expected dependencies before the scripts that require them, got:\n%s", html)
+		}
+		last = index
+	}
+	if strings.Count(html, `console.log("button")`) != 1 {
+		t.Fatalf("expected each script once, got:\n%s", html)
+	}
+
+	cycle := NewTemplateSet("layout")
+	err = cycle.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/a.html":              `<template><p>A</p></template><script data-requires="b">a();</script>`,
+		"templates/b.html":              `<template><p>B</p></template><script data-requires="a">b();</script>`,
+	}), "templates")
+	if err == nil || !strings.Contains(err.Error(), "cycle: a -> b -> a") {
+		t.Fatalf("expected a dependency cycle error, got %v", err)
+	}
+}
+
+func TestDeferScriptsWaitsForDOM(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main>Page</main></template><script>console.log("page");</script>`,
+		"templates/empty.html":          `<template><main>Empty</main></template>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if strings.Contains(html, "DOMContentLoaded") {
+		t.Fatalf("expected scripts to run immediately by default, got:\n%s", html)
+	}
+
+	ts.DeferScripts(true)
+	html, err = ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	listener := strings.Index(html, `document.addEventListener("DOMContentLoaded", run)`)
+	script := strings.Index(html, `console.log("page")`)
+	if listener == -1 || script < listener {
+		t.Fatalf("expected the script wrapped in a DOMContentLoaded listener, got:\n%s", html)
+	}
+
+	if html, err = ts.ExecuteString("empty", nil); err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if strings.Contains(html, "DOMContentLoaded") {
+		t.Fatalf("expected no wrapper without scripts, got:\n%s", html)
+	}
+}
+
+func TestSetRenderTimeoutAbortsSlowRenders(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	ts.AddFuncs(template.FuncMap{
+		"slow": func() string {
+			time.Sleep(200 * time.Millisecond)
+			return "slow"
+		},
+	})
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/slow.html":           `<template><main>{{ slow }}</main></template>`,
+		"templates/fast.html":           `<template><main>fast</main></template>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+	ts.SetRenderTimeout(20 * time.Millisecond)
+
+	var b strings.Builder
+	start := time.Now()
+	err := ts.Execute(&b, "slow", nil)
+	if !errors.Is(err, ErrRenderTimeout) {
+		t.Fatalf("expected ErrRenderTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= 200*time.Millisecond {
+		t.Fatalf("expected Execute to return at the timeout, took %s", elapsed)
+	}
+
+	// The next render waits for the aborted one and the timed out writer is left untouched
+	html, err := ts.ExecuteString("fast", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if !strings.Contains(html, "<main>fast</main>") {
+		t.Fatalf("expected fast page, got:\n%s", html)
+	}
+	if b.Len() != 0 {
+		t.Fatalf("expected nothing written after the timeout, got:\n%s", b.String())
+	}
+}
+
+func TestExecuteAutoDetectsHTMXRequests(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html": `<template><main>Page</main></template>
+<style>main { color: red; }</style>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		full    bool
+	}{
+		{"regular", nil, true},
+		{"htmx", map[string]string{"HX-Request": "true"}, false},
+		{"boosted", map[string]string{"HX-Request": "true", "HX-Boosted": "true"}, true},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		for key, value := range tt.headers {
+			req.Header.Set(key, value)
+		}
+		rec := httptest.NewRecorder()
+		if err := ts.ExecuteAuto(rec, req, "page", nil); err != nil {
+			t.Fatalf("%s: ExecuteAuto returned error: %v", tt.name, err)
+		}
+
+		body := rec.Body.String()
+		if full := strings.Contains(body, "<html>"); full != tt.full {
+			t.Fatalf("%s: expected full page %v, got:\n%s", tt.name, tt.full, body)
+		}
+		if !strings.Contains(body, "<main") || !strings.Contains(body, "color: red") {
+			t.Fatalf("%s: expected the page and its CSS, got:\n%s", tt.name, body)
+		}
+		if got := rec.Header().Get("Vary"); !strings.Contains(got, "HX-Request") {
+			t.Fatalf("%s: expected Vary to include HX-Request, got %q", tt.name, got)
+		}
+	}
+}
+
+func TestSetBasePathPrefixesAssets(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	ts.SetBasePath("/app/")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": `<html><head><link rel="stylesheet" href="{{ asset "/css/app.css" }}"></head><body>{{ .Yield }}</body></html>`,
+		"templates/page.html":           `<template><main><img src="{{ asset "img/logo.png" }}"><script src="{{ asset "https://cdn.example.com/lib.js" }}"></script></main></template>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	for _, want := range []string{`href="/app/css/app.css"`, `src="/app/img/logo.png"`, `src="https://cdn.example.com/lib.js"`} {
+		if !strings.Contains(html, want) {
+			t.Fatalf("expected %s, got:\n%s", want, html)
+		}
+	}
+}
+
+func TestFreezeRejectsChanges(t *testing.T) {
+	files := newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main>Page</main></template>`,
+	})
+
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(files, "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+	ts.Freeze()
+
+	if err := ts.ParseFS(files, "templates"); !errors.Is(err, ErrFrozen) {
+		t.Fatalf("expected ParseFS to return ErrFrozen, got %v", err)
+	}
+	if err := ts.ParseDirs(t.TempDir()); !errors.Is(err, ErrFrozen) {
+		t.Fatalf("expected ParseDirs to return ErrFrozen, got %v", err)
+	}
+	if err := ts.AddFuncs(template.FuncMap{"upper": strings.ToUpper}); !errors.Is(err, ErrFrozen) {
+		t.Fatalf("expected AddFuncs to return ErrFrozen, got %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if !strings.Contains(html, "<main>Page</main>") {
+		t.Fatalf("expected a frozen set to keep rendering, got:\n%s", html)
+	}
+}
+
+func TestParseSourcesCombinesFilesystems(t *testing.T) {
+	library := newTestFS(map[string]string{
+		"components/button.html": `<template><button>{{ param 0 }}</button></template><style>button { color: red; }</style>`,
+	})
+	app := newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main>{{ comp "button" "Save" }}</main></template>`,
+	})
+
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseSources(Source{FS: library, Roots: []string{"components"}}, Source{FS: app, Roots: []string{"templates"}}); err != nil {
+		t.Fatalf("ParseSources returned error: %v", err)
+	}
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if !strings.Contains(html, ">Save</button>") || !strings.Contains(html, "color: red") {
+		t.Fatalf("expected the library component in the app page, got:\n%s", html)
+	}
+
+	// The same name in two sources is a collision, even with the same path
+	other := newTestFS(map[string]string{
+		"components/button.html": `<template><button>Other</button></template>`,
+	})
+	err = NewTemplateSet("layout").ParseSources(
+		Source{FS: library, Roots: []string{"components"}},
+		Source{FS: other, Roots: []string{"components"}},
+		Source{FS: app, Roots: []string{"templates"}},
+	)
+	if err == nil || !strings.Contains(err.Error(), `duplicate template name "button"`) {
+		t.Fatalf("expected a duplicate name error, got %v", err)
+	}
+}
+
+func TestAllowOverrideReplacesEarlierTemplates(t *testing.T) {
+	kit := newTestFS(map[string]string{
+		"kit/button.html": `<template><button>Kit</button></template><style>button { color: red; }</style>`,
+		"kit/card.html":   `<template><div>{{ comp "button" }}</div></template>`,
+	})
+	app := newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/button.html":         `<template><button>App</button></template><style>button { color: blue; }</style>`,
+		"templates/page.html":           `<template><main>{{ comp "card" }}</main></template>`,
+	})
+	sources := []Source{{FS: kit, Roots: []string{"kit"}}, {FS: app, Roots: []string{"templates"}}}
+
+	if err := NewTemplateSet("layout").ParseSources(sources...); err == nil {
+		t.Fatal("expected duplicate names to fail without AllowOverride")
+	}
+
+	ts := NewTemplateSet("layout")
+	ts.AllowOverride(true)
+	if err := ts.ParseSources(sources...); err != nil {
+		t.Fatalf("ParseSources returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if !strings.Contains(html, ">App</button>") || !strings.Contains(html, "color: blue") || strings.Contains(html, "color: red") {
+		t.Fatalf("expected the app button to replace the kit button, got:\n%s", html)
+	}
+
+	overrides := ts.Stats().Overrides
+	want := TemplateOverride{Name: "button", Replaced: "source 1: kit/button.html", Source: "source 2: templates/button.html"}
+	if len(overrides) != 1 || overrides[0] != want {
+		t.Fatalf("expected override %+v, got %+v", want, overrides)
+	}
+}
+
+func TestCompDataIsEscapedInsideComponent(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main>{{ comp "x" (dict "name" .Name "href" .Href) }}{{ comp "y" .Name }}</main></template>`,
+		"templates/x.html":              `<template><a href="{{ .href }}" title="{{ .name }}">{{ .name }}</a></template>`,
+		"templates/y.html":              `<template><p>{{ param 0 }}</p></template>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", map[string]string{
+		"Name": `<script>alert("x")</script>`,
+		"Href": `javascript:alert(1)`,
+	})
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if strings.Contains(html, "<script>alert") {
+		t.Fatalf("expected component data to be escaped, got:\n%s", html)
+	}
+	for _, want := range []string{
+		`<a href="#ZgotmplZ" title="&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt;">&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt;</a>`,
+		`<p>&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt;</p>`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Fatalf("expected %s, got:\n%s", want, html)
+		}
+	}
+}
+
+func TestLayoutSourceShowsInjectedTags(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if got := ts.LayoutSource(); got != "" {
+		t.Fatalf("expected empty source before parsing, got %q", got)
+	}
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main>Page</main></template>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	source := ts.LayoutSource()
+	style := strings.Index(source, "<style>{{ .CSS }}</style>")
+	script := strings.Index(source, "<script>{{ .JS }}</script>")
+	if style == -1 || style > strings.Index(source, "</head>") || script == -1 || script > strings.Index(source, "</body>") {
+		t.Fatalf("expected injected style and script tags, got:\n%s", source)
+	}
+}
+
+func TestVoidElementRootIsScopedAsSingleElement(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main>{{ comp "avatar" (dict "src" "/a.png") }}{{ comp "field" }}{{ comp "rule" }}</main></template>`,
+		"templates/avatar.html": `<template><img class="avatar" src="{{ .src }}"></template>
+<style>.avatar { border-radius: 50%; } img { width: 32px; }</style>`,
+		"templates/field.html": `<template><input type="text" /></template>
+<style>input { border: 0; }</style>`,
+		"templates/rule.html": `<template><hr></template>
+<style>hr { margin: 0; }</style>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+
+	avatar := ts.templates["avatar"].scopeClass
+	field := ts.templates["field"].scopeClass
+	rule := ts.templates["rule"].scopeClass
+	for _, want := range []string{
+		`<main><img class="` + avatar + ` avatar" src="/a.png">`,
+		`<input type="text" class="` + field + `" />`,
+		`<hr class="` + rule + `"></main>`,
+		`.` + avatar + `.avatar {`,
+		`img.` + avatar + ` {`,
+		`input.` + field + ` {`,
+		`hr.` + rule + ` {`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Fatalf("expected %s, got:\n%s", want, html)
+		}
+	}
+	if strings.Contains(html, "<div class=") {
+		t.Fatalf("expected void roots not to be wrapped, got:\n%s", html)
+	}
+}
+
+func TestRootTagWithActionsInAttributes(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main>{{ comp "badge" (dict "N" 2 "Sep" ">") }}{{ comp "tag" (dict "Sep" ">" "class" "big") }}</main></template>`,
+		"templates/badge.html": `<template><div data-x="{{ if gt .N 0 }}a{{ end }}" data-sep="{{ if eq .Sep ">" }}gt{{ end }}"><span>{{ .N }}</span></div></template>
+<style>div { color: red; }</style>`,
+		"templates/tag.html": `<template><p data-sep="{{ if eq .Sep ">" }}gt{{ end }}" class="tag">#</p></template>
+<style>.tag { color: blue; }</style>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+
+	badge := ts.templates["badge"].scopeClass
+	tag := ts.templates["tag"].scopeClass
+	for _, want := range []string{
+		`<div data-x="a" data-sep="gt" class="` + badge + `"><span>2</span></div>`,
+		`<p data-sep="gt" class="` + tag + ` tag big">#</p>`,
+		`.` + tag + `.tag {`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Fatalf("expected %s, got:\n%s", want, html)
+		}
+	}
+}
+
+func TestScopeClassTargetsRootElementOnly(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main>{{ comp "panel" }}{{ comp "chip" (dict "kind" "new") }}</main></template>`,
+		"templates/panel.html": `<template><section><h2 class="title">Panel</h2><p class='body'>Text</p></section></template>
+<style>section { padding: 1rem; } .title { margin: 0; }</style>`,
+		"templates/chip.html": `<template><span class={{ .kind }}>chip</span></template>
+<style>span { color: red; }</style>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+
+	panel := ts.templates["panel"].scopeClass
+	chip := ts.templates["chip"].scopeClass
+	for _, want := range []string{
+		`<section class="` + panel + `"><h2 class="title">Panel</h2><p class='body'>Text</p></section>`,
+		`<span class="` + chip + ` new">chip</span>`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Fatalf("expected %s, got:\n%s", want, html)
+		}
+	}
+}
+
+func TestRequireData(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/profile.html":        `<template><h1>{{ .Name }}</h1><p>{{ .Email }}</p></template>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+	ts.RequireData("profile", "Name", "Email")
+
+	type user struct {
+		Name  string
+		Email string
+	}
+
+	for _, data := range []interface{}{
+		map[string]interface{}{"Name": "Ana", "Email": "ana@example.com"},
+		map[string]string{"Name": "Ana", "Email": "ana@example.com"},
+		user{Name: "Ana", Email: "ana@example.com"},
+		&user{Name: "Ana", Email: "ana@example.com"},
+	} {
+		if _, err := ts.ExecuteString("profile", data); err != nil {
+			t.Fatalf("ExecuteString(%T) returned error: %v", data, err)
+		}
+	}
+
+	for _, data := range []interface{}{
+		map[string]interface{}{"Name": "Ana"},
+		struct{ Name string }{Name: "Ana"},
+		nil,
+	} {
+		var b strings.Builder
+		err := ts.Execute(&b, "profile", data)
+		if err == nil || !strings.Contains(err.Error(), "missing required data") || !strings.Contains(err.Error(), "Email") {
+			t.Fatalf("expected a missing Email error for %T, got: %v", data, err)
+		}
+		if b.Len() != 0 {
+			t.Fatalf("expected nothing to be written, got:\n%s", b.String())
+		}
+	}
+}
+
+func TestExecuteLayoutUsesLayoutFile(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html": `<template><p class="page">{{ .Title }}</p></template>
+<style>.page { color: red; }</style>`,
+		"templates/footer.html": `<template><footer>Printed</footer></template>
+<style>footer { font-size: 10px; }</style>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	dir := t.TempDir()
+	printLayout := writeTestFile(t, dir, "print.html", `<!DOCTYPE html>
+<html>
+<head><title>Print</title></head>
+<body class="print">{{ .Yield }}{{ comp "footer" }}</body>
+</html>`)
+
+	var out strings.Builder
+	if err := ts.ExecuteLayout(&out, printLayout, "page", map[string]string{"Title": "Report"}); err != nil {
+		t.Fatalf("ExecuteLayout returned error: %v", err)
+	}
+	html := out.String()
+
+	for _, want := range []string{
+		`<title>Print</title>`,
+		`<body class="print"><p class="`,
+		`Report</p>`,
+		`<footer`,
+		`.page {`,
+		`footer.`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Fatalf("expected %s, got:\n%s", want, html)
+		}
+	}
+
+	// The layout file is cached until the cache is cleared
+	writeTestFile(t, dir, "print.html", `<html><head></head><body>changed {{ .Yield }}</body></html>`)
+	out.Reset()
+	if err := ts.ExecuteLayout(&out, printLayout, "page", map[string]string{"Title": "Report"}); err != nil {
+		t.Fatalf("ExecuteLayout returned error: %v", err)
+	}
+	if strings.Contains(out.String(), "changed") {
+		t.Fatalf("expected the cached layout, got:\n%s", out.String())
+	}
+
+	ts.ClearIsolatedCache()
+	out.Reset()
+	if err := ts.ExecuteLayout(&out, printLayout, "page", map[string]string{"Title": "Report"}); err != nil {
+		t.Fatalf("ExecuteLayout returned error: %v", err)
+	}
+	if !strings.Contains(out.String(), "changed") {
+		t.Fatalf("expected the layout to be read again, got:\n%s", out.String())
+	}
+
+	// The usual layout is unaffected
+	html, err := ts.ExecuteString("page", map[string]string{"Title": "Report"})
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if strings.Contains(html, "Print") || strings.Contains(html, "footer") {
+		t.Fatalf("expected the configured layout, got:\n%s", html)
+	}
+
+	if err := ts.ExecuteLayout(&out, filepath.Join(dir, "missing.html"), "page", nil); err == nil {
+		t.Fatal("expected an error for a missing layout file")
+	}
+}
+
+func TestExecuteInlineWithoutLayout(t *testing.T) {
+	ts := NewTemplateSet("")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/widget.html": `<template><div class="widget">{{ comp "icon" }}</div></template>
+<style>.widget { display: flex; }</style>
+<script>console.log("widget");</script>`,
+		"templates/icon.html": `<template><i>*</i></template>
+<style>i { color: red; }</style>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	var out strings.Builder
+	if err := ts.ExecuteInline(&out, "widget", nil); err != nil {
+		t.Fatalf("ExecuteInline returned error: %v", err)
+	}
+	html := out.String()
+
+	if !strings.HasPrefix(html, "<style>") || !strings.HasSuffix(html, "</script>") || !strings.Contains(html, `console.log("widget");`) {
+		t.Fatalf("expected the content between its CSS and JS, got:\n%s", html)
+	}
+	for _, want := range []string{`.widget {`, `i.`, `<i class="`} {
+		if !strings.Contains(html, want) {
+			t.Fatalf("expected %s, got:\n%s", want, html)
+		}
+	}
+
+	if err := ts.Execute(&out, "widget", nil); err == nil {
+		t.Fatal("expected Execute to fail without a layout")
+	}
+}
+
+func TestRegisterProviderLoadsComponentData(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main>{{ comp "recentPosts" 2 }}{{ comp "greeting" }}</main></template>`,
+		"templates/recentPosts.html":    `<template><ul>{{ range . }}<li>{{ . }}</li>{{ end }}</ul></template>`,
+		"templates/greeting.html":       `<template><p>Hello {{ .name }}</p></template>`,
+		"templates/broken.html":         `<template><main>{{ comp "failing" }}</main></template>`,
+		"templates/failing.html":        `<template><p>never</p></template>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	posts := []string{"First", "Second", "Third"}
+	ts.RegisterProvider("recentPosts", func(ctx context.Context, args []interface{}) (interface{}, error) {
+		return posts[:args[0].(int)], nil
+	})
+	ts.RegisterProvider("greeting", func(ctx context.Context, args []interface{}) (interface{}, error) {
+		return map[string]interface{}{"name": "Ana"}, nil
+	})
+	ts.RegisterProvider("failing", func(ctx context.Context, args []interface{}) (interface{}, error) {
+		return nil, errors.New("database unavailable")
+	})
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	for _, want := range []string{`<ul><li>First</li><li>Second</li></ul>`, `<p>Hello Ana</p>`} {
+		if !strings.Contains(html, want) {
+			t.Fatalf("expected %s, got:\n%s", want, html)
+		}
+	}
+
+	if _, err := ts.ExecuteString("broken", nil); err == nil || !strings.Contains(err.Error(), "database unavailable") {
+		t.Fatalf("expected the provider error, got: %v", err)
+	}
+}
+
+func TestDebugAttributes(t *testing.T) {
+	files := map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main>{{ comp "button" }}{{ comp "pair" }}{{ comp "plain" }}</main></template>`,
+		"templates/button.html": `<template><button class="btn">OK</button></template>
+<style>.btn { color: red; }</style>`,
+		"templates/pair.html": `<template><b>A</b><i>B</i></template>
+<style>b { color: blue; }</style>`,
+		"templates/plain.html": `<template><b>C</b><i>D</i></template>`,
+	}
+
+	ts := NewTemplateSet("layout")
+	ts.DebugAttributes(true)
+	if err := ts.ParseFS(newTestFS(files), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	for _, want := range []string{
+		`<main data-component="page">`,
+		`<button data-component="button" class="`,
+		`<div data-component="pair" class="`,
+		`<b>C</b><i>D</i>`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Fatalf("expected %s, got:\n%s", want, html)
+		}
+	}
+
+	ts = NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(files), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+	html, err = ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if strings.Contains(html, "data-component") {
+		t.Fatalf("expected no debug attributes by default, got:\n%s", html)
+	}
+}
+
+func TestScopedCSSHandlesLayers(t *testing.T) {
+	css := `@layer base, components;
+@layer components {
+	.card { padding: 1rem; }
+	h2 { margin: 0; }
+}
+@layer {
+	p { color: gray; }
+}
+@media (min-width: 600px) {
+	@layer components { .card { padding: 2rem; } }
+}
+.card::after { content: "}"; }`
+
+	scoped := scopedCSS(css, "s-1", "div", []string{"card"}, ElementTypeContainer, " ")
+	for _, want := range []string{
+		"@layer base, components;\n",
+		"@layer components {\n.s-1.card { padding: 1rem; }\n.s-1 h2 { margin: 0; }\n}\n",
+		"@layer {\n.s-1 p { color: gray; }\n}\n",
+		"@media (min-width: 600px) {\n@layer components {\n.s-1.card { padding: 2rem; }\n}\n}\n",
+		`.s-1.card::after { content: "}"; }`,
+	} {
+		if !strings.Contains(scoped, want) {
+			t.Fatalf("expected %q, got:\n%s", want, scoped)
+		}
+	}
+
+	contained := containedScopedCSS(css, "s-2", " ")
+	for _, want := range []string{
+		"@layer base, components;\n",
+		"@layer components {\n.s-2 .card { padding: 1rem; }\n.s-2 h2 { margin: 0; }\n}\n",
+		"@layer {\n.s-2 p { color: gray; }\n}\n",
+	} {
+		if !strings.Contains(contained, want) {
+			t.Fatalf("expected %q, got:\n%s", want, contained)
+		}
+	}
+}
+
+func TestCompJoinRendersItemsWithSeparator(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><nav>{{ compJoin "crumb" .Crumbs " > " }}</nav><p>{{ compJoin "crumb" .None ", " }}</p></template>`,
+		"templates/crumb.html": `<template><a href="/{{ param 0 }}">{{ param 0 }}</a></template>
+<style>a { color: blue; }</style>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", map[string]interface{}{
+		"Crumbs": []string{"home", "docs", "api"},
+		"None":   []string{},
+	})
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+
+	scope := ts.templates["crumb"].scopeClass
+	link := func(name string) string {
+		return `<a href="/` + name + `" class="` + scope + `">` + name + `</a>`
+	}
+	for _, want := range []string{
+		`<nav>` + link("home") + ` &gt; ` + link("docs") + ` &gt; ` + link("api") + `</nav>`,
+		`<p></p>`,
+		`a.` + scope + ` {`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Fatalf("expected %s, got:\n%s", want, html)
+		}
+	}
+
+	if _, err := ts.ExecuteString("page", map[string]interface{}{"Crumbs": "home"}); err == nil {
+		t.Fatal("expected an error for items that are not a slice")
+	}
+}
+
+func TestParentParamReadsCallerArguments(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main>{{ comp "menu" "dark" }}|{{ parentParam 0 }}|</main></template>`,
+		"templates/menu.html":           `<template><ul>{{ comp "menuItem" "Home" }}[{{ parentParam 0 }}]</ul></template>`,
+		"templates/menuItem.html":       `<template><li class="{{ parentParam 0 }}">{{ param 0 }}{{ parentParam 5 }}</li></template>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if want := `<main><ul><li class="dark">Home</li>[]</ul>||</main>`; !strings.Contains(html, want) {
+		t.Fatalf("expected %s, got:\n%s", want, html)
+	}
+}
+
+func TestRenderPartsReturnsAssetsSeparately(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/cart.html": `<template><section>{{ .Items }} items {{ comp "total" }}</section></template>
+<style>section { padding: 1rem; }</style>
+<script>console.log("cart");</script>`,
+		"templates/total.html": `<template><b>Total</b></template>
+<style>b { color: green; }</style>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, css, js, err := ts.RenderParts("cart", map[string]int{"Items": 3})
+	if err != nil {
+		t.Fatalf("RenderParts returned error: %v", err)
+	}
+
+	section := ts.templates["cart"].scopeClass
+	total := ts.templates["total"].scopeClass
+	if want := `<section class="` + section + `">3 items <b class="` + total + `">Total</b></section>`; string(html) != want {
+		t.Fatalf("unexpected html: got %q want %q", html, want)
+	}
+	for _, want := range []string{`section.` + section + ` {`, `b.` + total + ` {`} {
+		if !strings.Contains(string(css), want) {
+			t.Fatalf("expected %s in the CSS, got:\n%s", want, css)
+		}
+	}
+	if strings.Contains(string(css), "<style>") || !strings.Contains(string(js), `console.log("cart");`) {
+		t.Fatalf("unexpected assets, css:\n%s\njs:\n%s", css, js)
+	}
+
+	if _, _, _, err := ts.RenderParts("missing", nil); err == nil {
+		t.Fatal("expected an error for a missing template")
+	}
+}
+
+func TestCriticalCSSIsInlinedWithExternalStyles(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	ts.ExternalStyles("/assets")
+	ts.MarkCritical("nav")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main>{{ comp "nav" }}{{ comp "hero" }}{{ comp "footer" }}</main></template>`,
+		"templates/nav.html": `<template><nav>Nav</nav></template>
+<style>nav { color: black; }</style>`,
+		"templates/hero.html": `<template><h1>Hero</h1></template>
+<style critical>h1 { font-size: 3rem; }</style>`,
+		"templates/footer.html": `<template><footer>Footer</footer></template>
+<style>footer { color: gray; }</style>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+
+	style := html[strings.Index(html, "<style>"):strings.Index(html, "</style>")]
+	if !strings.Contains(style, "color: black") || !strings.Contains(style, "font-size: 3rem") || strings.Contains(style, "gray") {
+		t.Fatalf("expected only the critical CSS inline, got:\n%s", html)
+	}
+	start := strings.Index(html, `<link rel="stylesheet" href="/assets/`)
+	if start == -1 || !strings.Contains(html, `media="print" onload="this.media='all'"`) || !strings.Contains(html, "<noscript><link") {
+		t.Fatalf("expected a deferred stylesheet link, got:\n%s", html)
+	}
+	href := html[start+len(`<link rel="stylesheet" href="`):]
+	href = href[:strings.Index(href, `"`)]
+
+	rec := httptest.NewRecorder()
+	http.StripPrefix("/assets/", ts.AssetHandler()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, href, nil))
+	if body := rec.Body.String(); !strings.Contains(body, "gray") || strings.Contains(body, "3rem") || strings.Contains(body, "black") {
+		t.Fatalf("expected only the remaining CSS in the stylesheet, got:\n%s", body)
+	}
+
+	// Without external styles, all the CSS is inlined
+	ts.ExternalStyles("")
+	html, err = ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if strings.Contains(html, "<link") || strings.Count(html, "<style>") != 1 || !strings.Contains(html, "gray") || !strings.Contains(html, "3rem") {
+		t.Fatalf("expected a single inline style, got:\n%s", html)
+	}
+}
+
+func TestCompKeepsTrustedHTMLArguments(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main>{{ comp "panel" (dict "body" .Body "text" .Text) }}{{ comp "slot" .Body }}{{ comp "nested" (dict "body" .Body) }}</main></template>`,
+		"templates/panel.html":          `<template><div>{{ .body }}|{{ .text }}</div></template>`,
+		"templates/slot.html":           `<template><aside>{{ param 0 }}</aside></template>`,
+		"templates/nested.html":         `<template><section>{{ comp "panel" (dict "body" .body "text" "-") }}</section></template>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", map[string]interface{}{
+		"Body": template.HTML("<em>safe</em>"),
+		"Text": "<em>unsafe</em>",
+	})
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	for _, want := range []string{
+		`<div><em>safe</em>|&lt;em&gt;unsafe&lt;/em&gt;</div>`,
+		`<aside><em>safe</em></aside>`,
+		`<section><div><em>safe</em>|-</div></section>`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Fatalf("expected %s, got:\n%s", want, html)
+		}
+	}
+}
+
+func TestExposeArgsAddsArgumentSlice(t *testing.T) {
+	files := map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main>{{ comp "button" "Save" "green" }}{{ comp "badge" "new" }}</main></template>`,
+		"templates/button.html":         `<template><button class="{{ index .Args 1 }}">{{ index .Args 0 }}|{{ param 0 }}|{{ len .Args }}</button></template>`,
+		"templates/badge.html":          `<template><b>{{ range .Args }}[{{ . }}]{{ end }}</b></template>`,
+	}
+
+	ts := NewTemplateSet("layout")
+	ts.ExposeArgs(true)
+	if err := ts.ParseFS(newTestFS(files), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if want := `<main><button class="green">Save|Save|2</button><b>[new]</b></main>`; !strings.Contains(html, want) {
+		t.Fatalf("expected %s, got:\n%s", want, html)
+	}
+
+	ts.ExposeArgs(false)
+	if _, err := ts.ExecuteString("page", nil); err == nil {
+		t.Fatal("expected index of a missing Args key to fail when disabled")
+	}
+}
+
+func TestParseRejectsUnclosedTags(t *testing.T) {
+	for _, tc := range []struct {
+		content string
+		want    string
+	}{
+		{"<template><p>Hi</p>\n<style>p { color: red; }</style>", "unclosed <template> tag opened on line 1"},
+		{"<template><p>Hi</p></template>\n<style>p { color: red; }", "unclosed <style> tag opened on line 2"},
+		{"<template><p>Hi</p></template>\n<style>p { color: red; }</style>\n\n<script>console.log(1)", "unclosed <script> tag opened on line 4"},
+	} {
+		ts := NewTemplateSet("layout")
+		err := ts.ParseFS(newTestFS(map[string]string{
+			"templates/layouts/layout.html": testLayout,
+			"templates/broken.html":         tc.content,
+		}), "templates")
+		if err == nil || !strings.Contains(err.Error(), "templates/broken.html") || !strings.Contains(err.Error(), tc.want) {
+			t.Fatalf("expected %q for templates/broken.html, got: %v", tc.want, err)
+		}
+	}
+
+	dir := t.TempDir()
+	writeTestFile(t, dir, "layouts/layout.html", testLayout)
+	broken := writeTestFile(t, dir, "broken.html", `<template><p>Hi</p>`)
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseDirs(dir); err == nil || !strings.Contains(err.Error(), broken) || !strings.Contains(err.Error(), "unclosed <template>") {
+		t.Fatalf("expected an unclosed tag error for %s, got: %v", broken, err)
+	}
+}
+
+func TestNestedTemplateElementsAreKept(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main>{{ comp "todo" }}</main></template>`,
+		"templates/todo.html": `<template>
+<div class="todo">
+	<ul></ul>
+	<template id="row"><li class="item">{{ .ScopeClass }}</li></template>
+	<template-row>custom</template-row>
+</div>
+</template>
+<style>.item { color: red; }</style>
+<script>document.querySelector("#row");</script>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+
+	scope := ts.templates["todo"].scopeClass
+	for _, want := range []string{
+		`<template id="row"><li class="item">` + scope + `</li></template>`,
+		`<template-row>custom</template-row>
+</div></main>`,
+		`.` + scope + ` .item {`,
+		`document.querySelector("#row");`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Fatalf("expected %s, got:\n%s", want, html)
+		}
+	}
+}
+
+func TestIncludeRendersRawMarkup(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main>{{ include "snippet" . }}{{ include "snippet" }}</main></template>`,
+		"templates/snippet.html": `<template><p>Hello {{ .Name }}</p><hr></template>
+<style>p { color: red; }</style>
+<script>console.log("snippet");</script>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", map[string]string{"Name": "Ana"})
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if want := `<main><p>Hello Ana</p><hr><p>Hello </p><hr></main>`; !strings.Contains(html, want) {
+		t.Fatalf("expected %s, got:\n%s", want, html)
+	}
+	if strings.Contains(html, "color: red") || strings.Contains(html, "snippet\");") {
+		t.Fatalf("expected the included template assets to be left out, got:\n%s", html)
+	}
+}
+
+func TestSetURLRewriter(t *testing.T) {
+	files := map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html": `<template><div class="hero">Hi</div></template>
+<style>
+.hero { background: url(img/hero.png); }
+.icon { background: url( "img/icon.svg" ); }
+.logo { background: url('img/logo.png'); }
+.dot { background: url(data:image/png;base64,AAAA); }
+</style>`,
+	}
+
+	ts := NewTemplateSet("layout")
+	ts.SetURLRewriter(func(url string) string { return "https://cdn.example.com/" + url })
+	if err := ts.ParseFS(newTestFS(files), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	for _, want := range []string{
+		`url(https://cdn.example.com/img/hero.png)`,
+		`url("https://cdn.example.com/img/icon.svg")`,
+		`url('https://cdn.example.com/img/logo.png')`,
+		`url(data:image/png;base64,AAAA)`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Fatalf("expected %s, got:\n%s", want, html)
+		}
+	}
+}
+
+func TestReparseWhileRendering(t *testing.T) {
+	version := func(v string) fs.FS {
+		return newTestFS(map[string]string{
+			"templates/layouts/layout.html": testLayout,
+			"templates/page.html":           `<template><main>page ` + v + ` {{ comp "card" }}</main></template>`,
+			"templates/card.html":           `<template><div>card ` + v + `</div></template>`,
+		})
+	}
+
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(version("v1"), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				html, err := ts.ExecuteString("page", nil)
+				if err != nil {
+					errs <- err
+					return
+				}
+				v1 := strings.Contains(html, "page v1") && strings.Contains(html, "card v1")
+				v2 := strings.Contains(html, "page v2") && strings.Contains(html, "card v2")
+				if !v1 && !v2 {
+					errs <- fmt.Errorf("inconsistent render:\n%s", html)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		if err := ts.ParseFS(version([]string{"v1", "v2"}[i%2]), "templates"); err != nil {
+			t.Fatalf("ParseFS returned error: %v", err)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// A failed parse keeps the previous templates
+	broken := newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main>{{ if }}</main></template>`,
+	})
+	if err := ts.ParseFS(broken, "templates"); err == nil {
+		t.Fatal("expected an error for the broken template")
+	}
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if !strings.Contains(html, "page v2") {
+		t.Fatalf("expected the previous templates, got:\n%s", html)
+	}
+}
+
+func TestCachePage(t *testing.T) {
+	calls := 0
+	ts := NewTemplateSet("layout")
+	ts.AddFuncs(template.FuncMap{
+		"counter": func() int {
+			calls++
+			return calls
+		},
+	})
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/landing.html":        `<template><main>{{ .lang }} {{ counter }}</main></template><style>main { color: red; }</style>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+	ts.CachePage("landing", func(data interface{}) string {
+		return data.(map[string]interface{})["lang"].(string)
+	}, time.Minute)
+
+	render := func(lang string) string {
+		html, err := ts.ExecuteString("landing", map[string]interface{}{"lang": lang})
+		if err != nil {
+			t.Fatalf("ExecuteString returned error: %v", err)
+		}
+		return html
+	}
+
+	first := render("en")
+	if second := render("en"); second != first || calls != 1 {
+		t.Fatalf("expected a cached page, got %d calls and:\n%s", calls, second)
+	}
+	if html := render("pt"); !strings.Contains(html, "pt 2") || !strings.Contains(html, "color: red") {
+		t.Fatalf("expected a separate entry per key, got:\n%s", html)
+	}
+
+	// Concurrent hits and misses are safe
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ts.ExecuteString("landing", map[string]interface{}{"lang": []string{"en", "es"}[i%2]})
+		}(i)
+	}
+	wg.Wait()
+
+	// Expired entries are rendered again
+	for _, entry := range ts.pageCaches["landing"].entries {
+		entry.expires = time.Now().Add(-time.Second)
+	}
+	calls = 10
+	if html := render("en"); !strings.Contains(html, "en 11") {
+		t.Fatalf("expected an expired page to be rendered again, got:\n%s", html)
+	}
+
+	ts.CachePage("landing", nil, 0)
+	if html := render("en"); !strings.Contains(html, "en 12") {
+		t.Fatalf("expected the cache to be disabled, got:\n%s", html)
+	}
+}
+
+func TestCachePageRendersOncePerKey(t *testing.T) {
+	calls := 0
+	ts := NewTemplateSet("layout")
+	ts.AddFuncs(template.FuncMap{
+		"slow": func() int {
+			time.Sleep(20 * time.Millisecond)
+			calls++
+			return calls
+		},
+	})
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/landing.html":        `<template><main>{{ slow }}</main></template>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+	// The name may be given with its extension
+	ts.CachePage("landing.html", nil, time.Minute)
+
+	var wg sync.WaitGroup
+	outputs := make([]string, 8)
+	for i := range outputs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			html, err := ts.ExecuteString("landing", nil)
+			if err != nil {
+				t.Errorf("ExecuteString returned error: %v", err)
+			}
+			outputs[i] = html
+		}(i)
+	}
+	wg.Wait()
+
+	if calls != 1 {
+		t.Fatalf("expected concurrent misses to wait for a single render, got %d renders", calls)
+	}
+	for _, html := range outputs {
+		if !strings.Contains(html, "<main>1</main>") {
+			t.Fatalf("expected every caller to get the cached page, got:\n%s", html)
+		}
+	}
+}
+
+func TestConditionalComments(t *testing.T) {
+	files := map[string]string{
+		"templates/layouts/layout.html": `<html><head><!--[if mso]><xml><o:OfficeDocumentSettings></o:OfficeDocumentSettings></xml><![endif]--></head><body>{{ .Yield }}</body></html>`,
+		"templates/mail.html": `<template><!--[if mso]><table><tr><td><![endif]--><div class="box">{{ .name }}</div><!--[if mso]></td></tr></table><![endif]--><!--[if !mso]><!--><p>web</p><!--<![endif]--><!-- {{ .name }} --></template>
+<style>.box { color: red; }</style>`,
+	}
+
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(files), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	wants := []string{
+		`<head><!--[if mso]><xml><o:OfficeDocumentSettings></o:OfficeDocumentSettings></xml><![endif]-->`,
+		`<!--[if mso]><table><tr><td><![endif]-->`,
+		`<!--[if mso]></td></tr></table><![endif]-->`,
+		`<!--[if !mso]><!--><p>web</p><!--<![endif]-->`,
+		`<!-- {{ .name }} -->`,
+	}
+	html, err := ts.ExecuteString("mail", map[string]interface{}{"name": "Ana"})
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	for _, want := range wants {
+		if !strings.Contains(html, want) {
+			t.Fatalf("expected %s, got:\n%s", want, html)
+		}
+	}
+
+	var out strings.Builder
+	if err := ts.ExecuteEmail(&out, "mail", map[string]interface{}{"name": "Ana"}); err != nil {
+		t.Fatalf("ExecuteEmail returned error: %v", err)
+	}
+	for _, want := range wants[1:] {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("expected %s, got:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestOriginalCSS(t *testing.T) {
+	files := map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/card.html": `<template><div class="card"><h2>Title</h2></div></template>
+<style>h2 { color: red; }</style>`,
+		"templates/plain.html": `<template><p>Plain</p></template>`,
+	}
+
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(files), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	css, ok := ts.OriginalCSS("card")
+	if !ok || css != "h2 { color: red; }" {
+		t.Fatalf("expected the original CSS, got %q (%v)", css, ok)
+	}
+	if scoped := ts.templates["card"].CSS; !strings.Contains(scoped, ts.templates["card"].scopeClass) {
+		t.Fatalf("expected the scoped CSS to be kept, got %q", scoped)
+	}
+	if css, ok := ts.OriginalCSS("plain"); !ok || css != "" {
+		t.Fatalf("expected empty CSS for a template without styles, got %q (%v)", css, ok)
+	}
+	if _, ok := ts.OriginalCSS("missing"); ok {
+		t.Fatal("expected false for a missing template")
+	}
+}
+
+func TestAttachTo(t *testing.T) {
+	files := map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/card.html": `<template><div class="card"><h2>{{ paramOr 0 "Untitled" }}</h2>{{ comp "badge" }}</div></template>
+<style>h2 { color: red; }</style>`,
+		"templates/badge.html": `<template><span>new</span></template>`,
+	}
+
+	ts := NewTemplateSet("layout")
+	app := template.New("app")
+	if err := ts.AttachTo(app); err == nil {
+		t.Fatal("expected an error before parsing")
+	}
+	if err := ts.ParseFS(newTestFS(files), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+	if err := ts.AttachTo(app); err != nil {
+		t.Fatalf("AttachTo returned error: %v", err)
+	}
+	if _, err := app.Parse(`<main>{{ comp "card" .Title }}{{ template "badge" }}{{ add 1 2 }}</main>`); err != nil {
+		t.Fatalf("Parse returned error: %v", err)
+	}
+
+	var out strings.Builder
+	if err := app.Execute(&out, map[string]interface{}{"Title": "<Hello>"}); err != nil {
+		t.Fatalf("Execute returned error: %v", err)
+	}
+	html := out.String()
+	for _, want := range []string{
+		`<h2>&lt;Hello&gt;</h2>`,
+		`class="` + ts.templates["card"].scopeClass + ` card"`,
+		`<span>new</span></div><span>new</span>`,
+		`</span>3</main>`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Fatalf("expected %s, got:\n%s", want, html)
+		}
+	}
+	if strings.Contains(html, "<style>") {
+		t.Fatalf("expected no injected CSS, got:\n%s", html)
+	}
+}
+
+func TestNewTemplateSetWithOptions(t *testing.T) {
+	files := map[string]string{
+		"templates/layouts/layout.html": `<html><head>[[/* comment */]]</head><body>[[ .Yield ]]</body></html>`,
+		"templates/page.html": `<template><div id="app"><p>{{ message }}</p><span>[[ .name ]]</span>[[ comp "badge" ]]</div></template>
+<style>p { color: red; }</style>
+<script>document.querySelector(".[[ .ScopeClass ]]").dataset.vue = "{{ x }}";</script>`,
+		"templates/badge.gohtml": `<template><b>new</b></template>`,
+	}
+
+	ts := NewTemplateSetWithOptions("layout",
+		WithDelims("[[", "]]"),
+		WithExtensions(".gohtml", ".tmpl", ".html"),
+		WithScopeStrategy(ScopeReadable),
+	)
+	if err := ts.ParseFS(newTestFS(files), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", map[string]interface{}{"name": "Ana"})
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	for _, want := range []string{
+		`<div id="app" class="s-page"><p>{{ message }}</p><span>Ana</span><b>new</b></div>`,
+		`document.querySelector(".s-page").dataset.vue = "{{ x }}";`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Fatalf("expected %s, got:\n%s", want, html)
+		}
+	}
+
+	ts = NewTemplateSetWithOptions("layout", WithExtensions(".gohtml", ".html"), WithDevMode(true))
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/badge.gohtml":        `<template><b>new</b></template>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+	if html, err = ts.ExecuteString("badge", nil); err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if want := `<b data-component="badge">new</b>`; !strings.Contains(html, want) {
+		t.Fatalf("expected %s, got:\n%s", want, html)
+	}
+}
+
+func TestStrictScopes(t *testing.T) {
+	files := map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/parent.html": `<template><div class="parent"><p>parent</p>{{ comp "child" }}</div></template>
+<style>p { color: red; } .parent { margin: 0; }</style>`,
+		"templates/child.html": `<template><section><p>child</p></section></template>
+<style>section { padding: 0; }</style>`,
+		"templates/list.html": `<template><h2>Title</h2><ul><li>item</li></ul></template>
+<style>h2, ul li { color: blue; }</style>`,
+	}
+
+	ts := NewTemplateSet("layout")
+	ts.StrictScopes(true)
+	if err := ts.ParseFS(newTestFS(files), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	parent := ts.templates["parent"].scopeClass
+	list := ts.templates["list"].scopeClass
+	html, err := ts.ExecuteString("parent", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	for _, want := range []string{
+		"." + parent + " > p { color: red; }",
+		"." + parent + ".parent { margin: 0; }",
+	} {
+		if !strings.Contains(html, want) {
+			t.Fatalf("expected %s, got:\n%s", want, html)
+		}
+	}
+	// The paragraph of the child is not a direct child of the parent root
+	if strings.Contains(html, "."+parent+" p") {
+		t.Fatalf("expected the parent styles not to reach the child, got:\n%s", html)
+	}
+
+	if css := ts.templates["list"].CSS; !strings.Contains(css, "."+list+" > h2, ."+list+" > ul li {") {
+		t.Fatalf("expected strict contained selectors, got:\n%s", css)
+	}
+}
+
+func TestIsolationModeShadowDOM(t *testing.T) {
+	files := map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main>{{ comp "card" (dict "title" "Hi" "class" "wide") }}{{ comp "plain" }}</main></template>`,
+		"templates/card.html": `<template><div class="card"><h2>{{ .title }}</h2></div></template>
+<style>h2 { color: {{ .color }}; } .card { margin: 0; }</style>`,
+		"templates/plain.html": `<template><p>plain</p></template>`,
+	}
+
+	ts := NewTemplateSet("layout")
+	ts.DynamicCSS(true)
+	ts.IsolationMode(ShadowDOM)
+	if err := ts.ParseFS(newTestFS(files), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	for _, want := range []string{
+		`<sk-card class="wide"><template shadowrootmode="open"><style>h2 { color: ; } .card { margin: 0; }</style><div class="card"><h2>Hi</h2></div></template></sk-card>`,
+		`<p>plain</p>`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Fatalf("expected %s, got:\n%s", want, html)
+		}
+	}
+	if strings.Contains(html, ts.templates["card"].scopeClass) {
+		t.Fatalf("expected no scope classes, got:\n%s", html)
+	}
+}
+
+func TestEnableMarkdown(t *testing.T) {
+	files := map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/post.html":           `<template><article>{{ markdown .Body }}</article></template>`,
+	}
+
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(files), "templates"); err == nil {
+		t.Fatal("expected an error for markdown before EnableMarkdown")
+	}
+
+	ts = NewTemplateSet("layout")
+	if err := ts.EnableMarkdown(func(markdown string) string {
+		return "<p>" + template.HTMLEscapeString(strings.TrimPrefix(markdown, "# ")) + "</p>"
+	}); err != nil {
+		t.Fatalf("EnableMarkdown returned error: %v", err)
+	}
+	if err := ts.ParseFS(newTestFS(files), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("post", map[string]interface{}{"Body": "# Hello <b>"})
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if want := `<article><p>Hello &lt;b&gt;</p></article>`; !strings.Contains(html, want) {
+		t.Fatalf("expected %s, got:\n%s", want, html)
+	}
+
+	ts.Freeze()
+	if err := ts.EnableMarkdown(strings.ToUpper); !errors.Is(err, ErrFrozen) {
+		t.Fatalf("expected ErrFrozen, got %v", err)
+	}
+}
+
+func TestParseReportsUnknownComponents(t *testing.T) {
+	files := map[string]string{
+		"templates/layouts/layout.html": `<html><head></head><body>{{ comp "navbar" }}{{ .Yield }}</body></html>`,
+		"templates/page.html":           `<template><main>{{ comp "card" }}{{ comp "crad" "x" }}{{ compJoin "tag" .Tags ", " }}{{ comp .Widget }}</main></template>`,
+		"templates/card.html":           `<template><div>card</div></template>`,
+		"templates/tag.html":            `<template><b>tag</b></template>`,
+		"templates/panel.html":          `<template><section><Card>{{ comp "typo" }}</Card></section></template>`,
+	}
+
+	ts := NewTemplateSet("layout")
+	err := ts.ParseFS(newTestFS(files), "templates")
+	if err == nil {
+		t.Fatal("expected an error for the unknown components")
+	}
+	for _, want := range []string{
+		`comp references unknown template "navbar" in templates/layouts/layout.html`,
+		`comp references unknown template "crad" in templates/page.html`,
+		`comp references unknown template "typo" in templates/panel.html`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected %s, got:\n%v", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), `"card"`) || strings.Contains(err.Error(), `"tag"`) {
+		t.Fatalf("expected only unknown components to be reported, got:\n%v", err)
+	}
+
+	files["templates/navbar.html"] = `<template><nav>nav</nav></template>`
+	files["templates/crad.html"] = `<template><div>crad</div></template>`
+	files["templates/typo.html"] = `<template><i>typo</i></template>`
+	if err := NewTemplateSet("layout").ParseFS(newTestFS(files), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+}
+
+func TestAlwaysInclude(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	ts.AlwaysInclude("theme.html")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main>Page</main></template>`,
+		"templates/theme.html": `<template><div></div></template>
+<style>:root { --brand: teal; }</style>
+<script>window.theme = "loaded";</script>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	for _, want := range []string{"--brand: teal;", `window.theme = "loaded";`, "<main>Page</main>"} {
+		if !strings.Contains(html, want) {
+			t.Fatalf("expected %s, got:\n%s", want, html)
+		}
+	}
+
+	ts.AlwaysInclude("missing")
+	if _, err := ts.ExecuteString("page", nil); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Fatalf("expected an error naming the missing template, got %v", err)
+	}
+}
+
+func TestHeadAssets(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	ts.MarkCritical("nav")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/nav.html":            `<template><nav>Nav</nav></template><style>nav { color: red; }</style>`,
+		"templates/card.html":           `<template><div>Card</div></template><style>div { color: blue; }</style>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	head, err := ts.HeadAssets("card", "nav.html")
+	if err != nil {
+		t.Fatalf("HeadAssets returned error: %v", err)
+	}
+	for _, want := range []string{"<style>", "color: red;", "color: blue;"} {
+		if !strings.Contains(string(head), want) {
+			t.Fatalf("expected %s, got:\n%s", want, head)
+		}
+	}
+
+	ts.ExternalStyles("/assets")
+	head, err = ts.HeadAssets("card", "nav")
+	if err != nil {
+		t.Fatalf("HeadAssets returned error: %v", err)
+	}
+	for _, want := range []string{"<style>", "color: red;", `<link rel="stylesheet" href="/assets/`, "<noscript>"} {
+		if !strings.Contains(string(head), want) {
+			t.Fatalf("expected %s, got:\n%s", want, head)
+		}
+	}
+	if strings.Contains(string(head), "color: blue;") {
+		t.Fatalf("expected the non-critical CSS only in the stylesheet, got:\n%s", head)
+	}
+
+	if _, err := ts.HeadAssets("missing"); err == nil {
+		t.Fatal("expected an error for an unknown template")
+	}
+}
+
+func TestHeadAssetsMatchesExecute(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	ts.AlwaysInclude("theme")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": `<!DOCTYPE html>
+<html>
+<head><title>test</title></head>
+<body>{{ .Yield }}{{ comp "footer" }}</body>
+</html>`,
+		"templates/page.html":   `<template><main>Page</main></template><style>main { margin: 0; }</style>`,
+		"templates/footer.html": `<template><footer>Footer</footer></template><style>footer { color: gray; }</style>`,
+		"templates/theme.html":  `<template><div></div></template><style>:root { --brand: teal; }</style>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	head, err := ts.HeadAssets("page")
+	if err != nil {
+		t.Fatalf("HeadAssets returned error: %v", err)
+	}
+	for _, want := range []string{"margin: 0;", "color: gray;", "--brand: teal;"} {
+		if !strings.Contains(string(head), want) {
+			t.Fatalf("expected %s, got:\n%s", want, head)
+		}
+	}
+	if !strings.Contains(html, strings.TrimSpace(string(head))) {
+		t.Fatalf("expected the CSS of Execute, got:\n%s\nand the page:\n%s", head, html)
+	}
+}
+
+func TestArithmeticFuncsCoerceNumbers(t *testing.T) {
+	ts := NewTemplateSet("")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/math.html": `<template><p>{{ add .A .B }}|{{ sub .A .B }}|{{ mul .A .B }}|{{ mod .A .B }}</p></template>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	tests := []struct {
+		a, b interface{}
+		want string
+	}{
+		{7, 2, "9|5|14|1"},
+		{int64(7), 2, "9|5|14|1"},
+		{uint8(7), int32(2), "9|5|14|1"},
+		{7.0, 2.0, "9|5|14|1"},
+		{1.5, 2, "3.5|-0.5|3|1.5"},
+	}
+	for _, tt := range tests {
+		html, _, _, err := ts.RenderParts("math", map[string]interface{}{"A": tt.a, "B": tt.b})
+		if err != nil {
+			t.Fatalf("%T %T: RenderParts returned error: %v", tt.a, tt.b, err)
+		}
+		if want := "<p>" + tt.want + "</p>"; string(html) != want {
+			t.Fatalf("%T %T: expected %s, got:\n%s", tt.a, tt.b, want, html)
+		}
+	}
+
+	for _, tt := range []struct {
+		a, b interface{}
+		want string
+	}{
+		{"7", 2, "expected a number"},
+		{nil, 2, "expected a number"},
+		{7, 0, "division by zero"},
+		{int64(9223372036854775807), 1, "integer overflow"},
+	} {
+		_, _, _, err := ts.RenderParts("math", map[string]interface{}{"A": tt.a, "B": tt.b})
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Fatalf("%v %v: expected an error containing %q, got %v", tt.a, tt.b, tt.want, err)
+		}
+	}
+}
+
+func TestFloatArithmeticFuncsAcceptAnyNumber(t *testing.T) {
+	ts := NewTemplateSet("")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/total.html": `<template><p>{{ mulFloat .Price .Qty }}|{{ addFloat .Qty 1 }}|{{ div .Price .Qty }}|{{ div .Qty 3 }}</p></template>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, _, _, err := ts.RenderParts("total", map[string]interface{}{"Price": 2.5, "Qty": int64(4)})
+	if err != nil {
+		t.Fatalf("RenderParts returned error: %v", err)
+	}
+	if want := "<p>10|5|0.625|1</p>"; string(html) != want {
+		t.Fatalf("expected %s, got:\n%s", want, html)
+	}
+
+	if _, _, _, err := ts.RenderParts("total", map[string]interface{}{"Price": 2, "Qty": 0}); err == nil || !strings.Contains(err.Error(), "division by zero") {
+		t.Fatalf("expected a division by zero error, got %v", err)
+	}
+}
+
+func TestDebugHandler(t *testing.T) {
+	files := newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main>{{ comp "card" }}</main></template>`,
+		"templates/card.html":           `<template><div>Card</div></template><style>div { color: red; }</style>`,
+	})
+
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(files, "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	ts.DebugHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 without dev mode, got %d", rec.Code)
+	}
+
+	ts = NewTemplateSetWithOptions("layout", WithDevMode(true))
+	if err := ts.ParseFS(files, "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+	rec = httptest.NewRecorder()
+	ts.DebugHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	html := rec.Body.String()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 in dev mode, got %d", rec.Code)
+	}
+	for _, want := range []string{
+		"<td>card</td><td>templates/card.html</td><td>s-card</td><td>27</td>",
+		"<td></td><td>page</td></tr>",
+		"<td>card</td><td></td></tr>",
+	} {
+		if !strings.Contains(html, want) {
+			t.Fatalf("expected %s, got:\n%s", want, html)
+		}
+	}
+}
+
+func TestExecuteContextExposesValues(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	var providerUser interface{}
+	ts.RegisterProvider("badge", func(ctx context.Context, args []interface{}) (interface{}, error) {
+		providerUser = ctx.Value(ContextKey("user"))
+		return nil, nil
+	})
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main>{{ ctxValue "user" }}|{{ ctxValue "trace" }}|{{ ctxValue "missing" }}{{ comp "badge" }}</main></template>`,
+		"templates/badge.html":          `<template><span>badge</span></template>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	ctx := context.WithValue(context.Background(), ContextKey("user"), "ana")
+	ctx = context.WithValue(ctx, "trace", "abc123")
+	var out strings.Builder
+	if err := ts.ExecuteContext(ctx, &out, "page", nil); err != nil {
+		t.Fatalf("ExecuteContext returned error: %v", err)
+	}
+	if want := "<main>ana|abc123|<span>badge</span></main>"; !strings.Contains(out.String(), want) {
+		t.Fatalf("expected %s, got:\n%s", want, out.String())
+	}
+	if providerUser != "ana" {
+		t.Fatalf("expected the provider to receive the render context, got %v", providerUser)
+	}
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if want := "<main>||<span>badge</span></main>"; !strings.Contains(html, want) {
+		t.Fatalf("expected the context to be cleared after the render, got:\n%s", html)
+	}
+}
+
+func TestScopedCSSPassesFontFaceThrough(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main>{{ comp "title" }}</main></template>`,
+		"templates/title.html": `<template><h1 class="title">Title</h1></template>
+<style>
+@font-face { font-family: 'Brand'; src: url("/fonts/brand.woff2") format("woff2"); }
+@keyframes fade { from { opacity: 0; } to { opacity: 1; } }
+.title { font-family: 'Brand', sans-serif; animation: fade 1s; }
+</style>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	for _, want := range []string{
+		`@font-face { font-family: 'Brand'; src: url("/fonts/brand.woff2") format("woff2"); }`,
+		"@keyframes fade { from { opacity: 0; } to { opacity: 1; } }",
+		".title { font-family: 'Brand', sans-serif;",
+	} {
+		if !strings.Contains(html, want) {
+			t.Fatalf("expected %s, got:\n%s", want, html)
+		}
+	}
+	if strings.Contains(html, " @font-face") || strings.Contains(html, " @keyframes") {
+		t.Fatalf("expected the at-rules unscoped, got:\n%s", html)
+	}
+}
+
+func TestGlobalStyleBlocksAreNotScoped(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main>{{ comp "card" }}</main></template>`,
+		"templates/card.html": `<template><div class="card">Card</div></template>
+<style>.card { padding: 1rem; }</style>
+<style global>body { margin: 0; }</style>
+<style scoped="false">:root { --gap: 4px; }</style>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	for _, want := range []string{".card { padding: 1rem; }", `<div class="s-`, "\nbody { margin: 0; }", "\n:root { --gap: 4px; }"} {
+		if !strings.Contains(html, want) {
+			t.Fatalf("expected %s, got:\n%s", want, html)
+		}
+	}
+	if strings.Contains(html, " body {") || strings.Contains(html, " :root {") {
+		t.Fatalf("expected the global blocks unscoped, got:\n%s", html)
+	}
+}
+
+func TestMultipleStyleBlocks(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main>{{ comp "card" }}</main></template>`,
+		"templates/card.html": `<style>.card { padding: 1rem; }</style>
+<template><div class="card"><style>.inline { color: red; }</style><h2>Card</h2></div></template>
+<style>h2 { margin: 0; }</style>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	first := strings.Index(html, ".card { padding: 1rem; }")
+	second := strings.Index(html, " h2 { margin: 0; }")
+	if first == -1 || second < first {
+		t.Fatalf("expected both style blocks scoped in order, got:\n%s", html)
+	}
+	if strings.Count(html, ".inline") != 1 {
+		t.Fatalf("expected the style inside the template to stay in the markup only, got:\n%s", html)
+	}
+
+	original, _ := ts.OriginalCSS("card")
+	if original != ".card { padding: 1rem; }\nh2 { margin: 0; }" {
+		t.Fatalf("expected the original CSS of both blocks, got:\n%s", original)
+	}
+}
+
+func TestMultipleScriptBlocks(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main>{{ comp "chart" }}</main></template>`,
+		"templates/lib.html":            `<template><span></span></template><script>window.lib = {};</script>`,
+		"templates/chart.html": `<template><div>Chart<script>inline();</script></div></template>
+<script>var chart = "first";</script>
+<script data-requires="lib">chart += " second";</script>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	var out strings.Builder
+	if err := ts.ExecuteInline(&out, "page", nil); err != nil {
+		t.Fatalf("ExecuteInline returned error: %v", err)
+	}
+	html := out.String()
+
+	first := strings.Index(html, `var chart = "first";`)
+	second := strings.Index(html, `chart += " second";`)
+	if first == -1 || second < first {
+		t.Fatalf("expected both script blocks in order, got:\n%s", html)
+	}
+	if strings.Count(html, "inline();") != 1 {
+		t.Fatalf("expected the script inside the template to stay in the markup only, got:\n%s", html)
+	}
+	if lib := strings.Index(html, "window.lib = {};"); lib == -1 || lib > first {
+		t.Fatalf("expected the required script first, got:\n%s", html)
+	}
+}
+
+func TestExternalScriptsKept(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main>{{ comp "chart" }}{{ comp "graph" }}</main></template>`,
+		"templates/chart.html": `<template><div>Chart</div></template>
+<script src="/vendor/chart.js" defer></script>
+<script>initChart();</script>`,
+		"templates/graph.html": `<template><div>Graph</div></template><script src='/vendor/chart.js'></script>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+
+	if strings.Count(html, "/vendor/chart.js") != 1 {
+		t.Fatalf("expected a single tag for the external script, got:\n%s", html)
+	}
+	src := strings.Index(html, `<script src="/vendor/chart.js" defer></script>`)
+	if src == -1 || src > strings.Index(html, "initChart();") {
+		t.Fatalf("expected the external script before the combined JS, got:\n%s", html)
+	}
+
+	var out strings.Builder
+	if err := ts.ExecuteFragment(&out, "page", nil, nil); err != nil {
+		t.Fatalf("ExecuteFragment returned error: %v", err)
+	}
+	if !strings.Contains(out.String(), `<script src="/vendor/chart.js" defer></script>`) {
+		t.Fatalf("expected the external script in the fragment, got:\n%s", out.String())
+	}
+}
+
+type testPlugin struct {
+	parsed   []string
+	rendered []*RenderContext
+}
+
+func (p *testPlugin) OnParse(t *Template) {
+	p.parsed = append(p.parsed, t.Name)
+	if t.Name == "card" {
+		t.HTML = strings.Replace(t.HTML, "Card", "Card (B)", 1)
+	}
+}
+
+func (p *testPlugin) OnRender(rc *RenderContext) {
+	p.rendered = append(p.rendered, rc)
+	rc.HTML += `<img src="/pixel.gif" alt="">`
+}
+
+type parseOnlyPlugin struct{ calls int }
+
+func (p *parseOnlyPlugin) OnParse(t *Template) { p.calls++ }
+
+func TestUsePlugins(t *testing.T) {
+	plugin := &testPlugin{}
+	parseOnly := &parseOnlyPlugin{}
+	ts := NewTemplateSet("layout")
+	if err := ts.Use(struct{}{}); err == nil {
+		t.Fatal("expected an error for a plugin without hooks")
+	}
+	if err := ts.Use(plugin, nil, parseOnly); err != nil {
+		t.Fatalf("Use returned error: %v", err)
+	}
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main>{{ comp "card" }}</main></template>`,
+		"templates/card.html":           `<template><div>Card</div></template>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+	if len(plugin.parsed) != 2 || parseOnly.calls != 2 {
+		t.Fatalf("expected both templates to be passed to the parse plugins, got %v and %d calls", plugin.parsed, parseOnly.calls)
+	}
+
+	html, err := ts.ExecuteString("page", map[string]interface{}{"id": 1})
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	for _, want := range []string{"<div>Card (B)</div>", `</main><img src="/pixel.gif" alt="">`} {
+		if !strings.Contains(html, want) {
+			t.Fatalf("expected %s, got:\n%s", want, html)
+		}
+	}
+	if len(plugin.rendered) != 1 {
+		t.Fatalf("expected one render, got %d", len(plugin.rendered))
+	}
+	if rc := plugin.rendered[0]; rc.Template != "page" || rc.Context == nil || strings.Join(rc.Used, ",") != "page,card" {
+		t.Fatalf("unexpected render context: %+v", rc)
+	}
+}
+
+func TestRenderNode(t *testing.T) {
+	ts := NewTemplateSet("")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/list.html": `<template><ul class="list">{{ range .Items }}<li>{{ . }}</li>{{ end }}</ul></template>
+<style>.list { margin: 0; }</style>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	root, err := ts.RenderNode("list", map[string]interface{}{"Items": []string{"a", "b"}})
+	if err != nil {
+		t.Fatalf("RenderNode returned error: %v", err)
+	}
+
+	var list *html.Node
+	items := 0
+	for node := range root.Descendants() {
+		if node.Type != html.ElementNode {
+			continue
+		}
+		switch node.Data {
+		case "ul":
+			list = node
+		case "li":
+			items++
+		}
+	}
+	if list == nil || items != 2 {
+		t.Fatalf("expected a list with two items, got %v and %d items", list, items)
+	}
+	var class string
+	for _, attr := range list.Attr {
+		if attr.Key == "class" {
+			class = attr.Val
+		}
+	}
+	if fields := strings.Fields(class); len(fields) != 2 || !strings.HasPrefix(fields[0], "s-") || fields[1] != "list" {
+		t.Fatalf("expected the scope class and the list class, got %q", class)
+	}
+	if style := root.FirstChild; style == nil || style.Data != "style" {
+		t.Fatalf("expected the fragment to start with its <style> block, got %v", style)
+	}
+
+	if _, err := ts.RenderNode("missing", nil); err == nil {
+		t.Fatal("expected an error for a missing template")
+	}
+}
+
+func TestLayoutInjectionMarkers(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": `<!DOCTYPE html>
+<html>
+<head><!-- skingo:css --><link rel="stylesheet" href="/site.css"></head>
+<body>{{ .Yield }}<!--skingo:js--><script src="/analytics.js"></script></body>
+</html>`,
+		"templates/page.html": `<template><main>Page</main></template>
+<style>main { color: red; }</style>
+<script>console.log("page");</script>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	style := strings.Index(html, "color: red;")
+	if style == -1 || style > strings.Index(html, `href="/site.css"`) {
+		t.Fatalf("expected the CSS before the site stylesheet, got:\n%s", html)
+	}
+	script := strings.Index(html, `console.log("page");`)
+	if script == -1 || script > strings.Index(html, `src="/analytics.js"`) {
+		t.Fatalf("expected the JS before the analytics script, got:\n%s", html)
+	}
+	if strings.Contains(html, "skingo:") {
+		t.Fatalf("expected the markers to be replaced, got:\n%s", html)
+	}
+}
+
+func TestExecuteThemed(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html": `<template><main>Page</main></template>
+<style>main { color: var(--brand); }</style>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	var out strings.Builder
+	if err := ts.ExecuteThemed(&out, "page", nil, map[string]string{"brand": "#0a7", "--radius": "4px"}); err != nil {
+		t.Fatalf("ExecuteThemed returned error: %v", err)
+	}
+	html := out.String()
+	root := strings.Index(html, ":root { --brand: #0a7; --radius: 4px; }")
+	if root == -1 || root > strings.Index(html, "color: var(--brand);") {
+		t.Fatalf("expected the theme variables before the component CSS, got:\n%s", html)
+	}
+
+	plain, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if strings.Contains(plain, ":root") {
+		t.Fatalf("expected no theme in other renders, got:\n%s", plain)
+	}
+
+	out.Reset()
+	if err := ts.ExecuteThemed(&out, "page", nil, map[string]string{"font": `"Inter", 'Open Sans', sans-serif`}); err != nil {
+		t.Fatalf("ExecuteThemed returned error for quoted strings: %v", err)
+	}
+	if !strings.Contains(out.String(), `--font: "Inter", 'Open Sans', sans-serif;`) {
+		t.Fatalf("expected the quoted font family, got:\n%s", out.String())
+	}
+
+	for _, theme := range []map[string]string{
+		{"brand": "red; } body { display: none"},
+		{"bad name": "red"},
+		{"brand": "</style><script>"},
+		{"brand": "red /*"},
+		{"brand": "red */"},
+		{"brand": `"red`},
+		{"brand": `'red' "`},
+		{"brand": "red\rblue"},
+	} {
+		if err := ts.ExecuteThemed(io.Discard, "page", nil, theme); err == nil {
+			t.Fatalf("expected an error for theme %v", theme)
+		}
+	}
+}
+
+func TestStructuredDataIsPlacedInHead(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main>{{ comp "product" }}</main></template>`,
+		"templates/product.html": `<template><div>Product</div></template>
+<script type="application/ld+json">{"@context": "https://schema.org", "@type": "Product"}</script>
+<script>console.log("product");</script>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	data := strings.Index(html, `<script type="application/ld+json">{"@context": "https://schema.org", "@type": "Product"}</script>`)
+	if data == -1 || data > strings.Index(html, "</head>") {
+		t.Fatalf("expected the structured data in the head, got:\n%s", html)
+	}
+	if strings.Count(html, "schema.org") != 1 || !strings.Contains(html, `<script>console.log("product");`) {
+		t.Fatalf("expected the structured data apart from the JS, got:\n%s", html)
+	}
+}
+
+func TestScopedCSS(t *testing.T) {
+	ts := NewTemplateSetWithOptions("layout", WithScopeStrategy(ScopeReadable))
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/card.html": `<template><div class="card"><h2>Title</h2></div></template>
+<style>.card { padding: 1rem; } h2 { color: red; }</style>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	css, ok := ts.ScopedCSS("card.html")
+	if want := ".s-card.card { padding: 1rem; }\n.s-card h2 { color: red; }\n"; !ok || css != want {
+		t.Fatalf("expected %q, got %q (%v)", want, css, ok)
+	}
+	if _, ok := ts.ScopedCSS("missing"); ok {
+		t.Fatal("expected false for a missing template")
+	}
+}
+
+func TestRenderSite(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/home.html": `<template><main>{{ .Title }}</main></template>
+<style>main { color: red; }</style>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	dir := t.TempDir()
+	if err := ts.RenderSite(dir, []PageSpec{
+		{Path: "index.html", Template: "home", Data: map[string]interface{}{"Title": "Home"}},
+		{Path: "blog/first/index.html", Template: "home", Data: map[string]interface{}{"Title": "First"}},
+	}); err != nil {
+		t.Fatalf("RenderSite returned error: %v", err)
+	}
+
+	for path, want := range map[string]string{"index.html": "Home", "blog/first/index.html": "First"} {
+		content, err := os.ReadFile(filepath.Join(dir, path))
+		if err != nil {
+			t.Fatalf("reading %s: %v", path, err)
+		}
+		for _, part := range []string{"<!DOCTYPE html>", "color: red;", want} {
+			if !strings.Contains(string(content), part) {
+				t.Fatalf("expected %s in %s, got:\n%s", part, path, content)
+			}
+		}
+	}
+
+	if err := ts.RenderSite(dir, []PageSpec{{Path: "../outside.html", Template: "home"}}); err == nil {
+		t.Fatal("expected an error for a path outside the output directory")
+	}
+	if err := ts.RenderToFile(filepath.Join(dir, "missing.html"), "missing", nil); err == nil {
+		t.Fatal("expected an error for a missing template")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "missing.html")); !os.IsNotExist(err) {
+		t.Fatalf("expected no file for a failed render, got %v", err)
+	}
+}
+
+func TestRenderSessionEmitsOnlyNewAssets(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/row.html":            `<template><p>{{ comp "button" "Edit" }}</p></template>`,
+		"templates/card.html": `<template><div class="card">{{ comp "button" "Open" }}</div></template>
+<style>.card { color: blue; }</style>`,
+		"templates/button.html": `<template><button class="btn">{{ param 0 }}</button></template>
+<style>.btn { color: red; }</style>
+<script>console.log("button");</script>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	session := ts.NewRenderSession()
+	var first strings.Builder
+	if err := session.RenderFragment(&first, "row", nil); err != nil {
+		t.Fatalf("RenderFragment returned error: %v", err)
+	}
+	for _, part := range []string{"color: red", `console.log("button")`, ">Edit</button>"} {
+		if !strings.Contains(first.String(), part) {
+			t.Fatalf("expected %s in first fragment, got:\n%s", part, first.String())
+		}
+	}
+
+	var second strings.Builder
+	if err := session.RenderFragment(&second, "card", nil); err != nil {
+		t.Fatalf("RenderFragment returned error: %v", err)
+	}
+	out := second.String()
+	if !strings.Contains(out, "color: blue") || strings.Contains(out, "color: red") {
+		t.Fatalf("expected only the card CSS in second fragment, got:\n%s", out)
+	}
+	if strings.Contains(out, "<script>") {
+		t.Fatalf("expected already emitted JS to be skipped, got:\n%s", out)
+	}
+
+	var fresh strings.Builder
+	if err := ts.NewRenderSession().RenderFragment(&fresh, "card", nil); err != nil {
+		t.Fatalf("RenderFragment returned error: %v", err)
+	}
+	if !strings.Contains(fresh.String(), "color: red") || !strings.Contains(fresh.String(), "<script>") {
+		t.Fatalf("expected a new session to include all assets, got:\n%s", fresh.String())
+	}
+}
+
+func TestParamRequired(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/ok.html":             `<template><main>{{ comp "card" "Title" }}</main></template>`,
+		"templates/missing.html":        `<template><main>{{ comp "card" }}</main></template>`,
+		"templates/card.html":           `<template><div>{{ paramRequired 0 }}</div></template>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("ok", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if !strings.Contains(html, "<div>Title</div>") {
+		t.Fatalf("expected the required param, got:\n%s", html)
+	}
+
+	_, err = ts.ExecuteString("missing", nil)
+	if err == nil || !strings.Contains(err.Error(), `component "card": missing required param 0`) {
+		t.Fatalf("expected a missing param error naming the component, got %v", err)
+	}
+}
+
+func TestDisableJS(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	ts.DisableJS(true)
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": `<!DOCTYPE html><html><head></head><body>{{ .Yield }}<!-- skingo:js --></body></html>`,
+		"templates/page.html": `<template><main class="page">{{ comp "button" }}</main></template>
+<style>.page { color: red; }</style>
+<script>console.log("page");</script>`,
+		"templates/button.html": `<template><button>Go</button></template>
+<script>console.log("button");</script>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if strings.Contains(html, "<script") || strings.Contains(html, "console.log") || strings.Contains(html, "skingo:js") {
+		t.Fatalf("expected no JS, got:\n%s", html)
+	}
+	if !strings.Contains(html, "color: red;") {
+		t.Fatalf("expected the CSS to be inlined, got:\n%s", html)
+	}
+
+	var fragment strings.Builder
+	if err := ts.ExecuteFragment(&fragment, "page", nil, nil); err != nil {
+		t.Fatalf("ExecuteFragment returned error: %v", err)
+	}
+	if strings.Contains(fragment.String(), "<script") {
+		t.Fatalf("expected no JS in fragment, got:\n%s", fragment.String())
+	}
+}
+
+func TestInvalidateIsolated(t *testing.T) {
+	dir := t.TempDir()
+	first := writeTestFile(t, dir, "first.html", `<p>first</p>`)
+	second := writeTestFile(t, dir, "second.html", `<p>second</p>`)
+
+	ts := NewTemplateSet("layout")
+	render := func(filename string) string {
+		var out strings.Builder
+		if err := ts.ExecuteIsolated(&out, filename, nil); err != nil {
+			t.Fatalf("ExecuteIsolated returned error: %v", err)
+		}
+		return out.String()
+	}
+	render(first)
+	render(second)
+
+	writeTestFile(t, dir, "first.html", `<p>first changed</p>`)
+	writeTestFile(t, dir, "second.html", `<p>second changed</p>`)
+	ts.InvalidateIsolated(first)
+
+	if got := render(first); !strings.Contains(got, "first changed") {
+		t.Fatalf("expected the invalidated file to be read again, got %s", got)
+	}
+	if got := render(second); strings.Contains(got, "changed") {
+		t.Fatalf("expected the other file to stay cached, got %s", got)
+	}
+}
+
+func TestStyleMediaAttribute(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/nav.html": `<template><nav class="nav">Menu</nav></template>
+<style>.nav { display: flex; }</style>
+<style media="(max-width: 600px)">.nav { display: block; }</style>
+<style global media='print'>body { color: black; }</style>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	css, _ := ts.ScopedCSS("nav")
+	scope := ts.templates["nav"].scopeClass
+	for _, want := range []string{
+		"@media (max-width: 600px) {",
+		"@media (max-width: 600px) {\n." + scope + ".nav { display: block; }\n}",
+		"@media print {\nbody { color: black; }\n}",
+	} {
+		if !strings.Contains(css, want) {
+			t.Fatalf("expected %q in CSS, got:\n%s", want, css)
+		}
+	}
+	if strings.Index(css, "display: flex") > strings.Index(css, "@media (max-width") {
+		t.Fatalf("expected the unconditional CSS first, got:\n%s", css)
+	}
+}
+
+func TestAddNamespacedFuncs(t *testing.T) {
+	var logs strings.Builder
+	ts := NewTemplateSet("layout")
+	ts.SetLogger(slog.New(slog.NewTextHandler(&logs, nil)))
+	if err := ts.AddNamespacedFuncs("my", template.FuncMap{"upper": strings.ToUpper}); err != nil {
+		t.Fatalf("AddNamespacedFuncs returned error: %v", err)
+	}
+	if err := ts.AddNamespacedFuncs("my-ns", template.FuncMap{"upper": strings.ToUpper}); err == nil {
+		t.Fatal("expected an error for an invalid namespace")
+	}
+	if err := ts.AddFuncs(template.FuncMap{
+		"add":  func(a, b int) int { return a + b },
+		"dict": func() string { return "custom" },
+	}); err != nil {
+		t.Fatalf("AddFuncs returned error: %v", err)
+	}
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main>{{ my_upper "hi" }} {{ dict }}</main></template>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if !strings.Contains(html, "HI custom") {
+		t.Fatalf("expected the namespaced and custom functions, got:\n%s", html)
+	}
+	for _, want := range []string{
+		`msg="custom function shadows an internal function" function=dict`,
+		`msg="custom function shadows a default function" function=add`,
+	} {
+		if !strings.Contains(logs.String(), want) {
+			t.Fatalf("expected %s in logs, got:\n%s", want, logs.String())
+		}
+	}
+	if strings.Contains(logs.String(), "my_upper") {
+		t.Fatalf("expected no warning for namespaced functions, got:\n%s", logs.String())
+	}
+}
+
+func TestExecuteWithUsed(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": `<!DOCTYPE html><html><head></head><body>{{ comp "nav" }}{{ .Yield }}</body></html>`,
+		"templates/page.html":           `<template><main>{{ comp "card" }}{{ comp "card" }}</main></template>`,
+		"templates/card.html":           `<template><div>Card</div></template>`,
+		"templates/nav.html":            `<template><nav>Nav</nav></template>`,
+		"templates/unused.html":         `<template><p>Unused</p></template>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	var out strings.Builder
+	used, err := ts.ExecuteWithUsed(&out, "page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteWithUsed returned error: %v", err)
+	}
+	if got, want := strings.Join(used, ","), "card,nav,page"; got != want {
+		t.Fatalf("expected used templates %s, got %s", want, got)
+	}
+	if !strings.Contains(out.String(), "<div>Card</div>") {
+		t.Fatalf("expected the rendered page, got:\n%s", out.String())
+	}
+
+	if _, err := ts.ExecuteWithUsed(&out, "missing", nil); err == nil {
+		t.Fatal("expected an error for a missing template")
+	}
+}
+
+func TestCSSProcessorCache(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html": `<template><main class="page">Page</main></template>
+<style>.page { color: red; }</style>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	calls := 0
+	ts.SetCSSProcessor(func(css string) (string, error) {
+		calls++
+		return strings.ToUpper(css), nil
+	})
+
+	// Without the cache, the processor runs on every render
+	for i := 0; i < 2; i++ {
+		if _, err := ts.ExecuteString("page", nil); err != nil {
+			t.Fatalf("ExecuteString returned error: %v", err)
+		}
+	}
+	if calls != 2 {
+		t.Fatalf("expected the processor to run on each render, ran %d times", calls)
+	}
+
+	ts.CacheProcessedAssets(true)
+	calls = 0
+	for i := 0; i < 3; i++ {
+		html, err := ts.ExecuteString("page", nil)
+		if err != nil {
+			t.Fatalf("ExecuteString returned error: %v", err)
+		}
+		if !strings.Contains(html, "COLOR: RED") {
+			t.Fatalf("expected the processed CSS, got:\n%s", html)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("expected the processor to run once, ran %d times", calls)
+	}
+
+	// Setting a processor clears the cache
+	ts.SetCSSProcessor(func(css string) (string, error) {
+		calls++
+		return strings.ReplaceAll(css, "red", "blue"), nil
+	})
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if !strings.Contains(html, "color: blue") || calls != 2 {
+		t.Fatalf("expected the new processor to run, got %d calls and:\n%s", calls, html)
+	}
+
+	// The theme is processed with the CSS, so each theme has its own output
+	var out strings.Builder
+	if err := ts.ExecuteThemed(&out, "page", nil, map[string]string{"brand": "red"}); err != nil {
+		t.Fatalf("ExecuteThemed returned error: %v", err)
+	}
+	if !strings.Contains(out.String(), "--brand: blue;") || calls != 3 {
+		t.Fatalf("expected the theme to go through the processor, got %d calls and:\n%s", calls, out.String())
+	}
+}
+
+func TestLayoutDataReservedKeys(t *testing.T) {
+	var logs strings.Builder
+	ts := NewTemplateSet("layout")
+	ts.SetLogger(slog.New(slog.NewTextHandler(&logs, nil)))
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": `<!DOCTYPE html><html><head><title>{{ .Data.Title }}</title></head><body>{{ .Yield }}</body></html>`,
+		"templates/page.html":           `<template><h1>{{ .Title }}</h1></template>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", map[string]string{"Title": "Home"})
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if !strings.Contains(html, "<title>Home</title>") || !strings.Contains(html, "<h1>Home</h1>") {
+		t.Fatalf("expected the title in the layout and the page, got:\n%s", html)
+	}
+	if logs.Len() != 0 {
+		t.Fatalf("expected no warnings, got:\n%s", logs.String())
+	}
+
+	if _, err := ts.ExecuteString("page", map[string]string{"Title": "Home", "CSS": "custom"}); err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if !strings.Contains(logs.String(), "data keys shadowed by layout keys") || !strings.Contains(logs.String(), "keys=[CSS]") {
+		t.Fatalf("expected a warning for the reserved key, got:\n%s", logs.String())
+	}
+}
+
+type layoutPage struct {
+	Title string
+	CSS   string
+}
+
+func (p layoutPage) Upper() string {
+	return strings.ToUpper(p.Title)
+}
+
+func TestLayoutDataTopLevelKeys(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html":  `<!DOCTYPE html><html><head><title>{{ .Title }}|{{ .Data.Title }}</title></head><body>{{ .Yield }}</body></html>`,
+		"templates/layouts/methods.html": `<!DOCTYPE html><html><head><title>{{ .Data.Upper }}</title></head><body>{{ .Yield }}</body></html>`,
+		"templates/page.html":            `<template><h1>{{ .Title }}</h1></template>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	for _, test := range []struct {
+		data  interface{}
+		title string
+	}{
+		{map[string]string{"Title": "Home", "CSS": "custom"}, "<title>Home|Home</title>"},
+		{map[string]interface{}{"Title": "Home", "CSS": "custom"}, "<title>Home|Home</title>"},
+		// Struct data is only available under .Data
+		{layoutPage{Title: "Home", CSS: "custom"}, "<title>|Home</title>"},
+		{&layoutPage{Title: "Home", CSS: "custom"}, "<title>|Home</title>"},
+	} {
+		data := test.data
+		html, err := ts.ExecuteString("page", data)
+		if err != nil {
+			t.Fatalf("ExecuteString returned error for %T: %v", data, err)
+		}
+		if !strings.Contains(html, test.title) || !strings.Contains(html, "<h1>Home</h1>") {
+			t.Fatalf("expected %s for %T, got:\n%s", test.title, data, html)
+		}
+		if strings.Contains(html, "custom") {
+			t.Fatalf("expected the reserved CSS key to keep the component CSS for %T, got:\n%s", data, html)
+		}
+	}
+
+	var out strings.Builder
+	if err := ts.ExecuteWithLayout(&out, "methods", "page", layoutPage{Title: "Home"}); err != nil {
+		t.Fatalf("ExecuteWithLayout returned error: %v", err)
+	}
+	if !strings.Contains(out.String(), "<title>HOME</title>") {
+		t.Fatalf("expected the method through .Data, got:\n%s", out.String())
+	}
+}
+
+func TestExecutePreload(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	ts.ExternalStyles("/assets/")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main>{{ comp "title" }}{{ comp "title" }}</main></template>`,
+		"templates/title.html": `<template><h1 class="title">Title</h1></template>
+<style>
+@font-face { font-family: Brand; src: url("/fonts/brand.woff2?v=2") format("woff2"), url(/fonts/brand.woff) format("woff"); }
+.title { font-family: Brand; background: url(/img/bg.png); }
+</style>`,
+		"templates/unused.html": `<template><p class="x">Unused</p></template>
+<style>@font-face { font-family: Other; src: url(/fonts/other.woff2); } .x { color: red; }</style>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	if err := ts.ExecutePreload(rec, httptest.NewRequest(http.MethodGet, "/", nil), "page", nil); err != nil {
+		t.Fatalf("ExecutePreload returned error: %v", err)
+	}
+
+	links := rec.Header().Values("Link")
+	if len(links) != 3 {
+		t.Fatalf("expected 3 Link headers, got %q", links)
+	}
+	if !strings.HasPrefix(links[0], "</assets/") || !strings.HasSuffix(links[0], ".css>; rel=preload; as=style") {
+		t.Fatalf("expected the stylesheet preload first, got %q", links[0])
+	}
+	if links[1] != "</fonts/brand.woff2?v=2>; rel=preload; as=font; crossorigin" || links[2] != "</fonts/brand.woff>; rel=preload; as=font; crossorigin" {
+		t.Fatalf("expected the font preloads, got %q", links[1:])
+	}
+	if !strings.Contains(rec.Body.String(), "<h1 class=") {
+		t.Fatalf("expected the page body, got:\n%s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	if err := ts.ExecutePreload(rec, httptest.NewRequest(http.MethodGet, "/", nil), "missing", nil); err == nil {
+		t.Fatal("expected an error for a missing template")
+	}
+	if rec.Body.Len() != 0 || len(rec.Header().Values("Link")) != 0 {
+		t.Fatalf("expected nothing written for a failed render, got %q", rec.Body.String())
+	}
+}
+
+func TestExecutePreloadResolvesRelativeFonts(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	ts.ExternalStyles("/assets/")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main>{{ comp "title" }}{{ comp "hero" }}</main></template>`,
+		"templates/title.html": `<template><h1 class="title">Title</h1></template>
+<style>@font-face { font-family: Brand; src: url(fonts/brand.woff2), url("../shared/brand.woff"); } .title { font-family: Brand; }</style>`,
+		"templates/hero.html": `<template><div class="hero">Hero</div></template>
+<style critical>@font-face { font-family: Hero; src: url(fonts/hero.woff2); } .hero { font-family: Hero; }</style>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	if err := ts.ExecutePreload(rec, httptest.NewRequest(http.MethodGet, "/", nil), "page", nil); err != nil {
+		t.Fatalf("ExecutePreload returned error: %v", err)
+	}
+
+	links := rec.Header().Values("Link")
+	for _, want := range []string{
+		"</assets/fonts/brand.woff2>; rel=preload; as=font; crossorigin",
+		"</shared/brand.woff>; rel=preload; as=font; crossorigin",
+		"<fonts/hero.woff2>; rel=preload; as=font; crossorigin",
+	} {
+		if !slices.Contains(links, want) {
+			t.Fatalf("expected %q among the Link headers, got %q", want, links)
+		}
+	}
+}
+
+func TestScopeClassesInLayout(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": `<!DOCTYPE html><html><head></head><body>{{ .Yield }}<script>init({{ scopeClasses }});</script></body></html>`,
+		"templates/page.html":           `<template><main>{{ comp "card" }}{{ comp "plain" }}</main></template>`,
+		"templates/card.html": `<template><div class="card">Card</div></template>
+<style>.card { color: red; }</style>`,
+		"templates/plain.html":  `<template><p>Plain</p></template>`,
+		"templates/unused.html": `<template><p class="x">Unused</p></template><style>.x { color: blue; }</style>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	html, err := ts.ExecuteString("page", nil)
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	want := fmt.Sprintf(`init([%q]);`, ts.templates["card"].scopeClass)
+	if !strings.Contains(html, want) {
+		t.Fatalf("expected %s, got:\n%s", want, html)
+	}
+}
+
+func TestDisableWrapping(t *testing.T) {
+	files := map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/table.html":          `<template><table><tbody>{{ comp "rows" . }}</tbody></table></template>`,
+		"templates/rows.html": `<template>{{ range .Rows }}<tr class="row"><td>{{ . }}</td></tr>{{ end }}</template>
+<style>.row:hover { color: red; } td::before { content: "-"; } .row > td { padding: 0; }</style>`,
+	}
+
+	ts := NewTemplateSet("layout")
+	ts.DisableWrapping(true)
+	if err := ts.ParseFS(newTestFS(files), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+	scope := ts.templates["rows"].scopeClass
+
+	html, err := ts.ExecuteString("table", map[string]interface{}{"Rows": []string{"a", "b"}})
+	if err != nil {
+		t.Fatalf("ExecuteString returned error: %v", err)
+	}
+	if strings.Contains(html, "<div") {
+		t.Fatalf("expected no wrapper div, got:\n%s", html)
+	}
+	row := fmt.Sprintf(`<tbody><tr class="%s row"><td>a</td></tr><tr class="%s row"><td>b</td></tr></tbody>`, scope, scope)
+	if !strings.Contains(html, row) {
+		t.Fatalf("expected the scope class on each row, got:\n%s", html)
+	}
+	for _, want := range []string{
+		fmt.Sprintf(".row.%s:hover, .%s .row:hover {", scope, scope),
+		fmt.Sprintf("td.%s::before, .%s td::before {", scope, scope),
+		fmt.Sprintf(".row.%s > td, .%s .row > td {", scope, scope),
+	} {
+		if !strings.Contains(html, want) {
+			t.Fatalf("expected %s in CSS, got:\n%s", want, html)
+		}
+	}
+
+	// The nowrap attribute applies to a single component
+	files["templates/rows.html"] = strings.Replace(files["templates/rows.html"], "<template>", "<template nowrap>", 1)
+	files["templates/other.html"] = `<template>{{ if true }}<p class="x">Other</p>{{ end }}</template><style>.x { color: blue; }</style>`
+	ts = NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(files), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+	if html := ts.templates["rows"].HTML; strings.Contains(html, "<div") {
+		t.Fatalf("expected no wrapper div with nowrap, got:\n%s", html)
+	}
+	if html := ts.templates["other"].HTML; !strings.HasPrefix(html, "<div") {
+		t.Fatalf("expected other components to keep the wrapper, got:\n%s", html)
+	}
+}
+
+func TestRestrictedElementsAreNotWrapped(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/rows.html": `<template><tr><td>a</td></tr><tr class="last"><td>b</td></tr></template>
+<style>td { padding: 0; }</style>`,
+		"templates/items.html": `<template>{{ range . }}<li>{{ . }}</li>{{ end }}</template>
+<style>li { color: red; }</style>`,
+		"templates/paragraphs.html": `<template><p>a</p><p>b</p></template>
+<style>p { margin: 0; }</style>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	rows := ts.templates["rows"]
+	html, err := ts.RenderComponent("rows")
+	if err != nil {
+		t.Fatalf("RenderComponent returned error: %v", err)
+	}
+	want := fmt.Sprintf(`<tr class="%s"><td>a</td></tr><tr class="%s last"><td>b</td></tr>`, rows.scopeClass, rows.scopeClass)
+	if html != want {
+		t.Fatalf("expected both rows scoped without a wrapper, got:\n%s", html)
+	}
+	if want := fmt.Sprintf("td.%s, .%s td {", rows.scopeClass, rows.scopeClass); !strings.Contains(rows.CSS, want) {
+		t.Fatalf("expected %s in CSS, got:\n%s", want, rows.CSS)
+	}
+
+	items := ts.templates["items"]
+	if !strings.Contains(items.HTML, fmt.Sprintf(`<li class="%s">`, items.scopeClass)) || strings.Contains(items.HTML, "<div") {
+		t.Fatalf("expected the list items scoped without a wrapper, got:\n%s", items.HTML)
+	}
+
+	// Sibling elements that are not restricted are still wrapped
+	if html := ts.templates["paragraphs"].HTML; !strings.HasPrefix(html, "<div") {
+		t.Fatalf("expected the paragraphs to be wrapped, got:\n%s", html)
+	}
+}
+
+func TestCustomElementPrefix(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	if err := ts.CustomElementPrefix("x"); err != nil {
+		t.Fatalf("CustomElementPrefix returned error: %v", err)
+	}
+	if err := ts.CustomElementPrefix("1x-"); err == nil {
+		t.Fatal("expected an error for an invalid prefix")
+	}
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/card.html": `<template><h2>Title</h2><p>Body</p></template>
+<style>p { color: red; }</style>`,
+		"templates/single.html": `<template><section class="single">Single</section></template>
+<style>.single { color: blue; }</style>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	card := ts.templates["card"]
+	html, err := ts.RenderComponent("card")
+	if err != nil {
+		t.Fatalf("RenderComponent returned error: %v", err)
+	}
+	if want := fmt.Sprintf(`<x-card class="%s"><h2>Title</h2><p>Body</p></x-card>`, card.scopeClass); html != want {
+		t.Fatalf("expected %s, got %s", want, html)
+	}
+	if want := fmt.Sprintf("x-card.%s p {", card.scopeClass); !strings.Contains(card.CSS, want) {
+		t.Fatalf("expected %s in CSS, got:\n%s", want, card.CSS)
+	}
+
+	// Components with a root element are not wrapped
+	if html, _ := ts.RenderComponent("single"); strings.Contains(html, "x-single") {
+		t.Fatalf("expected no custom element for a single root, got %s", html)
+	}
+}
+
+func TestCustomElementPrefixKeepsClassesStartingWithScope(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	ts.ReadableScopes(true)
+	if err := ts.CustomElementPrefix("x"); err != nil {
+		t.Fatalf("CustomElementPrefix returned error: %v", err)
+	}
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/card.html": `<template><h2 class="s-card-title">Title</h2><p>Body</p></template>
+<style>.s-card-title { color: red; } p { color: blue; }</style>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	card := ts.templates["card"]
+	if card.scopeClass != "s-card" {
+		t.Fatalf("expected the readable scope class s-card, got %s", card.scopeClass)
+	}
+	if strings.Contains(card.CSS, "x-card.s-card-title") {
+		t.Fatalf("expected the class starting with the scope class to be left alone, got:\n%s", card.CSS)
+	}
+	if !strings.Contains(card.CSS, "x-card.s-card p {") {
+		t.Fatalf("expected the scope class qualified with the element, got:\n%s", card.CSS)
+	}
+}
+
+func TestScopedCSSPseudoClassesOnChildren(t *testing.T) {
+	for _, test := range []struct {
+		selector string
+		want     string
+	}{
+		{"a:hover", ".s-1 a:hover"},
+		{"input:focus", ".s-1 input:focus"},
+		{".x:nth-child(2)", ".s-1 .x:nth-child(2)"},
+		{"li:not(.active)", ".s-1 li:not(.active)"},
+		{".btn:hover, a:focus-visible", ".s-1 .btn:hover, .s-1 a:focus-visible"},
+		{":hover", "nav.s-1:hover"},
+		{".menu:hover", ".s-1.menu:hover"},
+		{".menu::before", ".s-1.menu::before"},
+		{"nav:hover", "nav.s-1:hover"},
+		{"nav:not(.open .link)", "nav.s-1:not(.open .link)"},
+		{".menu:hover a", ".s-1 .menu:hover a"},
+	} {
+		got := scopedCSS(test.selector+" { color: red; }", "s-1", "nav", []string{"menu"}, ElementTypeContainer, " ")
+		if want := test.want + " { color: red; }\n"; got != want {
+			t.Errorf("scoping %s: expected %q, got %q", test.selector, want, got)
+		}
+	}
+}
+
+func TestLintGlobalSelectors(t *testing.T) {
+	testFS := newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/card.html": `<template><div class="card">{{ .Title }}</div></template>
+<style>
+body { margin: 0; }
+*, *::before { box-sizing: border-box; }
+* + * { margin-top: 1em; }
+@media (min-width: 600px) { :root { --gap: 2rem; } }
+.card { padding: 1rem; }
+</style>
+<style global>html { font-size: 16px; }</style>`,
+		"templates/page.html": `<template><main>{{ comp "card" (dict "Title" "x") }}</main></template>
+<style>main > * { margin: 0; }</style>`,
+	})
+
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(testFS, "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	var selectors []string
+	for _, w := range ts.Lint() {
+		if w.Template != "card" {
+			t.Errorf("unexpected warning for %s: %s", w.Template, w.Message)
+		}
+		if !strings.Contains(w.Message, "<style global>") {
+			t.Errorf("expected the warning to suggest <style global>, got %q", w.Message)
+		}
+		selectors = append(selectors, w.Selector)
+	}
+	if got, want := strings.Join(selectors, "|"), "body|*|*::before|:root"; got != want {
+		t.Errorf("expected selectors %q, got %q", want, got)
+	}
+}
+
+func TestComponentTags(t *testing.T) {
+	testFS := newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/user-card.html":      `<template><div class="card"><h2>{{ .title }}</h2>{{ if .featured }}<b>*</b>{{ end }}{{ .Children }}</div></template>`,
+		"templates/badge.html":          `<template><span class="badge">{{ .label }}</span></template>`,
+		"templates/page.html": `<template><main>
+<UserCard title="{{ .Title }}" featured />
+<UserCard title='Hi {{ .Name }}!'>
+	<p>{{ .Name }}</p>
+	<Badge label="new"></Badge>
+</UserCard>
+{{ range .Items }}<Badge label="{{ . | printf "%s!" }}"/>{{ end }}
+</main></template>`,
+	})
+
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(testFS, "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	var buf strings.Builder
+	data := map[string]interface{}{"Title": "Cards", "Name": "Ana", "Items": []string{"a", "b"}}
+	if err := ts.ExecuteFragment(&buf, "page", data, nil); err != nil {
+		t.Fatalf("ExecuteFragment returned error: %v", err)
+	}
+	out := buf.String()
+
+	for _, want := range []string{
+		"<h2>Cards</h2><b>*</b></div>",
+		"<h2>Hi Ana!</h2>",
+		"<p>Ana</p>",
+		`>new</span>`,
+		`>a!</span>`,
+		`>b!</span>`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "<UserCard") || strings.Contains(out, "<Badge") {
+		t.Errorf("expected the component tags to be rewritten, got:\n%s", out)
+	}
+}
+
+func TestComponentTagsErrors(t *testing.T) {
+	for source, want := range map[string]string{
+		`<template><Card title="x"></template>`:   "unclosed <Card> tag",
+		`<template><div></Card></div></template>`: "unexpected </Card> tag",
+	} {
+		testFS := newTestFS(map[string]string{
+			"templates/layouts/layout.html": testLayout,
+			"templates/card.html":           `<template><div>{{ .title }}</div></template>`,
+			"templates/page.html":           source,
+		})
+
+		ts := NewTemplateSet("layout")
+		err := ts.ParseFS(testFS, "templates")
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("parsing %s: expected error containing %q, got %v", source, want, err)
+		}
+	}
+}
+
+func TestComponentTagsLeaveHTMLTags(t *testing.T) {
+	testFS := newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/card.html":           `<template><div class="card">{{ .title }}</div></template>`,
+		"templates/page.html": `<template><main>
+<P>Hello<BR>World</P>
+<DIV>x</DIV>
+<Missing />
+<!-- <Card /> -->
+<pre><code><Card title="code" /></code></pre>
+<Card title="real" />
+</main></template>`,
+	})
+
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(testFS, "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	var buf strings.Builder
+	if err := ts.ExecuteFragment(&buf, "page", nil, nil); err != nil {
+		t.Fatalf("ExecuteFragment returned error: %v", err)
+	}
+	out := buf.String()
+
+	for _, want := range []string{
+		"<P>Hello<BR>World</P>",
+		"<DIV>x</DIV>",
+		"<Missing />",
+		`<pre><code><Card title="code" /></code></pre>`,
+		">real</div>",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "comp") {
+		t.Errorf("expected no comp call to leak into the page, got:\n%s", out)
+	}
+}
+
+func TestSlotFallback(t *testing.T) {
+	testFS := newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/button.html":         `<template><button type="submit">{{ slot }}Submit{{ end }}</button></template>`,
+		"templates/page.html": `<template><form>
+<Button />
+<Button>Save {{ .Name }}</Button>
+<Button>{{ if .Hidden }}Hidden{{ end }}</Button>
+{{ comp "button" (dict "Children" "Send") }}
+</form></template>`,
+	})
+
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(testFS, "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	var buf strings.Builder
+	if err := ts.ExecuteFragment(&buf, "page", map[string]interface{}{"Name": "draft", "Hidden": false}, nil); err != nil {
+		t.Fatalf("ExecuteFragment returned error: %v", err)
+	}
+	out := buf.String()
+
+	if got := strings.Count(out, `<button type="submit">Submit</button>`); got != 2 {
+		t.Errorf("expected the fallback for the empty slots, found %d in:\n%s", got, out)
+	}
+	for _, want := range []string{`<button type="submit">Save draft</button>`, `<button type="submit">Send</button>`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, out)
+		}
+	}
+}
+
+func TestExecuteParallelLoadsRegionsConcurrently(t *testing.T) {
+	testFS := newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/sales.html":          `<template><section>sales {{ .total }}</section></template>`,
+		"templates/orders.html":         `<template><section>orders {{ .total }}</section></template>`,
+		"templates/page.html":           `<template><main>{{ comp "orders" }}{{ comp "sales" }}{{ comp "sales" }}</main></template>`,
+	})
+
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(testFS, "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	// Each provider waits for the other one, which only returns when both run at once
+	var started sync.WaitGroup
+	started.Add(2)
+	var mu sync.Mutex
+	calls := map[string]int{}
+	provider := func(name string, total int) DataProvider {
+		return func(ctx context.Context, args []interface{}) (interface{}, error) {
+			mu.Lock()
+			calls[name]++
+			mu.Unlock()
+
+			started.Done()
+			done := make(chan struct{})
+			go func() { started.Wait(); close(done) }()
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				return nil, fmt.Errorf("%s loaded alone", name)
+			}
+			return map[string]interface{}{"total": total}, nil
+		}
+	}
+	ts.RegisterProvider("sales", provider("sales", 10))
+	ts.RegisterProvider("orders", provider("orders", 3))
+
+	var buf strings.Builder
+	if err := ts.ExecuteParallel(context.Background(), &buf, "page", nil, "sales", "orders"); err != nil {
+		t.Fatalf("ExecuteParallel returned error: %v", err)
+	}
+	out := buf.String()
+
+	if strings.Index(out, "orders 3") == -1 || strings.Index(out, "orders 3") > strings.Index(out, "sales 10") {
+		t.Errorf("expected the regions in page order, got:\n%s", out)
+	}
+	if strings.Count(out, "sales 10") != 2 {
+		t.Errorf("expected both sales regions to render, got:\n%s", out)
+	}
+	if calls["sales"] != 1 || calls["orders"] != 1 {
+		t.Errorf("expected each provider to run once, got %v", calls)
+	}
+}
+
+func TestExecuteParallelRendersRegionsConcurrently(t *testing.T) {
+	// The label of each region waits for the label of the other one, so both
+	// component stacks hold a frame at once before param is read
+	var rendering sync.WaitGroup
+	rendering.Add(2)
+	ts := NewTemplateSet("layout")
+	ts.AddFuncs(template.FuncMap{
+		"together": func() (string, error) {
+			rendering.Done()
+			done := make(chan struct{})
+			go func() { rendering.Wait(); close(done) }()
+			select {
+			case <-done:
+				return "", nil
+			case <-time.After(time.Second):
+				return "", errors.New("region rendered alone")
+			}
+		},
+	})
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/sales.html":          `<template><section>{{ comp "label" .title }}</section></template><style>section { color: red; }</style>`,
+		"templates/orders.html":         `<template><aside>{{ comp "label" .title }}</aside></template><style>aside { color: blue; }</style>`,
+		"templates/label.html":          `<template><b>{{ together }}{{ param 0 }}</b></template><style>b { font-weight: 700; }</style>`,
+		"templates/page.html":           `<template><main>{{ comp "orders" }}{{ comp "sales" }}</main></template>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+	ts.RegisterProvider("sales", func(ctx context.Context, args []interface{}) (interface{}, error) {
+		return map[string]interface{}{"title": "Sales"}, nil
+	})
+	ts.RegisterProvider("orders", func(ctx context.Context, args []interface{}) (interface{}, error) {
+		return map[string]interface{}{"title": "Orders"}, nil
+	})
+
+	var out strings.Builder
+	if err := ts.ExecuteParallel(context.Background(), &out, "page", nil, "sales", "orders"); err != nil {
+		t.Fatalf("ExecuteParallel returned error: %v", err)
+	}
+	html := out.String()
+	for _, want := range []string{">Sales</b></section>", ">Orders</b></aside>", "color: red;", "color: blue;", "font-weight: 700;"} {
+		if !strings.Contains(html, want) {
+			t.Fatalf("expected %s, got:\n%s", want, html)
+		}
+	}
+}
+
+func TestExecuteParallelMatchesExecuteContext(t *testing.T) {
+	ts := NewTemplateSet("layout")
+	ts.SetAssetOrder(OrderUsage)
+	if err := ts.ParseFS(newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/sales.html":          `<template><section>{{ comp "badge" .total }}</section></template><style>section { color: red; }</style>`,
+		"templates/orders.html":         `<template><aside>{{ .total }}</aside></template><style>aside { color: blue; }</style><script>console.log("orders");</script>`,
+		"templates/badge.html":          `<template><b>{{ param 0 }}</b></template><style>b { font-weight: 700; }</style>`,
+		"templates/page.html":           `<template><main>{{ comp "orders" }}<p>Page</p>{{ comp "sales" }}</main></template><style>p { margin: 0; }</style>`,
+	}), "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+	ts.RegisterProvider("sales", func(ctx context.Context, args []interface{}) (interface{}, error) {
+		return map[string]interface{}{"total": 10}, nil
+	})
+	ts.RegisterProvider("orders", func(ctx context.Context, args []interface{}) (interface{}, error) {
+		return map[string]interface{}{"total": 3}, nil
+	})
+
+	var sequential, parallel strings.Builder
+	if err := ts.ExecuteContext(context.Background(), &sequential, "page", nil); err != nil {
+		t.Fatalf("ExecuteContext returned error: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		parallel.Reset()
+		if err := ts.ExecuteParallel(context.Background(), &parallel, "page", nil, "sales", "orders"); err != nil {
+			t.Fatalf("ExecuteParallel returned error: %v", err)
+		}
+		if parallel.String() != sequential.String() {
+			t.Fatalf("expected the output of ExecuteContext:\n%s\ngot:\n%s", sequential.String(), parallel.String())
+		}
+	}
+}
+
+func TestExecuteParallelJoinsErrors(t *testing.T) {
+	testFS := newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/a.html":              `<template><p>a</p></template>`,
+		"templates/b.html":              `<template><p>b</p></template>`,
+		"templates/c.html":              `<template><p>c</p></template>`,
+		"templates/d.html":              `<template><p>{{ paramRequired 0 }}</p></template>`,
+		"templates/page.html":           `<template><main>{{ comp "a" }}{{ comp "b" }}{{ comp "c" }}</main></template>`,
+	})
+
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(testFS, "templates"); err != nil {
+		t.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	var failures sync.WaitGroup
+	failures.Add(2)
+	errA, errB := errors.New("a is down"), errors.New("b is down")
+	ts.RegisterProvider("a", func(ctx context.Context, args []interface{}) (interface{}, error) {
+		failures.Done()
+		return nil, errA
+	})
+	ts.RegisterProvider("b", func(ctx context.Context, args []interface{}) (interface{}, error) {
+		failures.Done()
+		return nil, errB
+	})
+	ts.RegisterProvider("c", func(ctx context.Context, args []interface{}) (interface{}, error) {
+		failures.Wait()
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	var buf strings.Builder
+	err := ts.ExecuteParallel(context.Background(), &buf, "page", nil, "a", "b", "c")
+	if !errors.Is(err, errA) || !errors.Is(err, errB) || errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the errors of a and b, got %v", err)
+	}
+	if msg := err.Error(); strings.Index(msg, "component a") > strings.Index(msg, "component b") {
+		t.Errorf("expected the errors in region order, got %q", msg)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected nothing to be rendered, got %q", buf.String())
+	}
+
+	if err := ts.ExecuteParallel(context.Background(), &buf, "page", nil, "page"); err == nil || !strings.Contains(err.Error(), "no data provider") {
+		t.Errorf("expected an error for a region without provider, got %v", err)
+	}
+
+	// A region whose render fails fails the page too
+	ts.RegisterProvider("d", func(ctx context.Context, args []interface{}) (interface{}, error) {
+		return nil, nil
+	})
+	if err := ts.ExecuteParallel(context.Background(), &buf, "page", nil, "d"); err == nil || !strings.Contains(err.Error(), "missing required param") {
+		t.Errorf("expected the render error of the region, got %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected nothing to be rendered, got %q", buf.String())
+	}
+}
+
+func BenchmarkExecuteSimple(b *testing.B) {
+	testFS := newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main><h1>{{ .Title }}</h1></main></template>`,
+	})
+
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(testFS, "templates"); err != nil {
+		b.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	for i := 0; i < b.N; i++ {
+		var out strings.Builder
+		if err := ts.Execute(&out, "page", map[string]string{"Title": "Hello"}); err != nil {
+			b.Fatalf("Execute returned error: %v", err)
+		}
+	}
+}
+
+func BenchmarkExecuteNestedComponents(b *testing.B) {
+	testFS := newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template>{{ comp "card" (dict "label" "Save") }}</template>`,
+		"templates/card.html":           `<template><section>{{ comp "button" .label "green" }}</section></template>`,
+		"templates/button.html":         `<template><button class="{{ paramOr 1 "blue" }}">{{ param 0 }}</button></template>`,
+	})
+
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(testFS, "templates"); err != nil {
+		b.Fatalf("ParseFS returned error: %v", err)
+	}
+
+	for i := 0; i < b.N; i++ {
+		var out strings.Builder
+		if err := ts.Execute(&out, "page", nil); err != nil {
+			b.Fatalf("Execute returned error: %v", err)
+		}
+	}
+}
+
+func BenchmarkExecuteIsolatedCacheHit(b *testing.B) {
+	dir := b.TempDir()
+	path := filepath.Join(dir, "fragment.html")
+	if err := os.WriteFile(path, []byte(`<template><p>{{ .Text }}</p></template>`), 0o644); err != nil {
+		b.Fatalf("writing test file: %v", err)
+	}
+
+	ts := NewTemplateSet("layout")
+	var warmup strings.Builder
+	if err := ts.ExecuteIsolated(&warmup, path, map[string]string{"Text": "Hello"}); err != nil {
+		b.Fatalf("warmup ExecuteIsolated returned error: %v", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var out strings.Builder
+		if err := ts.ExecuteIsolated(&out, path, map[string]string{"Text": "Hello"}); err != nil {
+			b.Fatalf("ExecuteIsolated returned error: %v", err)
+		}
+	}
+}
+
+func BenchmarkExecuteIsolatedCacheMiss(b *testing.B) {
+	dir := b.TempDir()
+	path := filepath.Join(dir, "fragment.html")
+	if err := os.WriteFile(path, []byte(`<template><p>{{ .Text }}</p></template>`), 0o644); err != nil {
+		b.Fatalf("writing test file: %v", err)
+	}
+
+	ts := NewTemplateSet("layout")
+	for i := 0; i < b.N; i++ {
+		ts.ClearIsolatedCache()
+		var out strings.Builder
+		if err := ts.ExecuteIsolated(&out, path, map[string]string{"Text": "Hello"}); err != nil {
+			b.Fatalf("ExecuteIsolated returned error: %v", err)
+		}
+	}
+}
+
+func BenchmarkParseFSManyTemplates(b *testing.B) {
+	files := map[string]string{
+		"templates/layouts/layout.html": testLayout,
+	}
+	for i := 0; i < 100; i++ {
+		files[fmt.Sprintf("templates/page-%03d.html", i)] = fmt.Sprintf(`<template><p>Page %d</p></template>`, i)
+	}
+	testFS := newTestFS(files)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ts := NewTemplateSet("layout")
+		if err := ts.ParseFS(testFS, "templates"); err != nil {
+			b.Fatalf("ParseFS returned error: %v", err)
+		}
+	}
+}
+
+func BenchmarkProcessLargeComponent(b *testing.B) {
+	var markup, css strings.Builder
+	for i := 0; i < 500; i++ {
+		fmt.Fprintf(&markup, `<div class="row row-%d">{{ if .Show }}<span title="{{ .Title }}">{{ .Text }}</span>{{ end }}</div>`, i)
+		fmt.Fprintf(&css, ".row-%d span { color: {{ .Color }}; margin: %dpx; }\n", i, i)
+	}
+	content := []byte(`<template><section class="list">` + markup.String() + `</section></template>
+<style>` + css.String() + `</style>
+<script>console.log("{{ .ScopeClass }}");</script>`)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ts := NewTemplateSet("layout")
+		ts.DynamicCSS(true)
+		if err := ts.processTemplate("list", content, "list.html", false); err != nil {
+			b.Fatalf("processTemplate returned error: %v", err)
+		}
+	}
+}
+
+func BenchmarkExecuteCSSProcessor(b *testing.B) {
+	testFS := newTestFS(map[string]string{
+		"templates/layouts/layout.html": testLayout,
+		"templates/page.html":           `<template><main>{{ comp "card" }}{{ comp "button" }}</main></template>`,
+		"templates/card.html": `<template><section class="card">Card</section></template>
+<style>.card { padding: 1rem; border: 1px solid #ccc; }</style>`,
+		"templates/button.html": `<template><button class="btn">Go</button></template>
+<style>.btn { color: white; background: #0a7; }</style>`,
+	})
+
+	ts := NewTemplateSet("layout")
+	if err := ts.ParseFS(testFS, "templates"); err != nil {
+		b.Fatalf("ParseFS returned error: %v", err)
+	}
+	ts.SetCSSProcessor(func(css string) (string, error) {
+		return strings.Join(strings.Fields(css), " "), nil
+	})
+	ts.CacheProcessedAssets(true)
+
+	for i := 0; i < b.N; i++ {
+		var out strings.Builder
+		if err := ts.ExecuteThemed(&out, "page", nil, map[string]string{"brand": "#0a7"}); err != nil {
+			b.Fatalf("ExecuteThemed returned error: %v", err)
 		}
 	}
 }
@@ -0,0 +1,223 @@
+package skingo
+
+import (
+	"fmt"
+	"html/template"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var (
+	// Opening, closing or self-closing tag with a capitalized name
+	pascalTagRegex = regexp.MustCompile(`<(/?)([A-Z][A-Za-z0-9]*)((?:\s+[A-Za-z_:@][^\s=/>]*(?:\s*=\s*(?:"(?:{{.*?}}|[^"])*"|'(?:{{.*?}}|[^'])*'|{{.*?}}|[^\s"'=<>/{]+))?)*)\s*(/?)>`)
+	tagAttrRegex   = regexp.MustCompile(`([A-Za-z_:@][^\s=/>]*)(?:\s*=\s*("(?:{{.*?}}|[^"])*"|'(?:{{.*?}}|[^'])*'|{{.*?}}|[^\s"'=<>/{]+))?`)
+	tagActionRegex = regexp.MustCompile(`(?s){{-?\s*(.*?)\s*-?}}`)
+	slotRegex      = regexp.MustCompile(`{{(-?)\s*slot\s*(-?)}}`)
+	// Start of a comment or of an element whose content is not rewritten
+	rawStartRegex = regexp.MustCompile(`(?i)<!--|<(script|style|textarea|title|pre)\b`)
+)
+
+// tagRewriter rewrites the component tags of a template into comp calls
+type tagRewriter struct {
+	name   string                 // Name of the template being rewritten
+	blocks map[string]string      // Children of the paired tags, by block name
+	known  func(name string) bool // Reports whether a component template exists
+}
+
+// rewriteComponentTags rewrites the tags with a PascalCase name in content,
+// such as <Card title="{{ .Title }}" />, into calls of the component named
+// after the tag in kebab case, with the attributes as a dict. The children of
+// a paired tag are returned as blocks, rendered with the dot of the caller and
+// given to the component as .Children.
+//
+// Tags that do not name a known template, such as uppercase HTML (<P>, <BR>),
+// are left as they are, as are the tags inside comments and inside script,
+// style, textarea, title and pre elements.
+func rewriteComponentTags(content, name string, known func(name string) bool) (string, map[string]string, error) {
+	rw := &tagRewriter{name: name, known: known}
+	out, _, err := rw.rewrite(content, "")
+	if err != nil {
+		return "", nil, err
+	}
+	return out, rw.blocks, nil
+}
+
+// rewrite rewrites s up to the closing tag of the named component, or to the
+// end when closing is empty, and returns the rest of s after the closing tag.
+func (rw *tagRewriter) rewrite(s, closing string) (string, string, error) {
+	var b strings.Builder
+	for {
+		loc := pascalTagRegex.FindStringSubmatchIndex(s)
+		if raw := rawStartRegex.FindStringSubmatchIndex(s); raw != nil && (loc == nil || raw[0] < loc[0]) {
+			end := rawEnd(s, raw)
+			b.WriteString(s[:end])
+			s = s[end:]
+			continue
+		}
+		if loc == nil {
+			if closing != "" {
+				return "", "", fmt.Errorf("unclosed <%s> tag", closing)
+			}
+			b.WriteString(s)
+			return b.String(), "", nil
+		}
+
+		tag := s[loc[4]:loc[5]]
+		b.WriteString(s[:loc[0]])
+		if isComponentTag(tag) || !rw.isComponent(tag) {
+			// Component file tags and HTML tags are left to the HTML
+			b.WriteString(s[loc[0]:loc[1]])
+			s = s[loc[1]:]
+			continue
+		}
+
+		if loc[3] > loc[2] {
+			if tag != closing {
+				return "", "", fmt.Errorf("unexpected </%s> tag", tag)
+			}
+			return b.String(), s[loc[1]:], nil
+		}
+
+		attrs := s[loc[6]:loc[7]]
+		selfClosing := loc[9] > loc[8]
+		s = s[loc[1]:]
+
+		var children string
+		if !selfClosing {
+			var err error
+			if children, s, err = rw.rewrite(s, tag); err != nil {
+				return "", "", err
+			}
+		}
+		b.WriteString(rw.call(tag, attrs, children))
+	}
+}
+
+// isComponent reports whether tag is a PascalCase name, with a lowercase
+// letter after the first one, of a known template
+func (rw *tagRewriter) isComponent(tag string) bool {
+	if strings.IndexFunc(tag[1:], unicode.IsLower) == -1 {
+		return false
+	}
+	return rw.known == nil || rw.known(kebabCase(tag))
+}
+
+// rawEnd returns the index right after the comment or the element whose start
+// is located by loc, as returned by rawStartRegex, or the end of s when it is
+// not closed.
+func rawEnd(s string, loc []int) int {
+	if loc[2] == -1 {
+		if end := strings.Index(s[loc[1]:], "-->"); end != -1 {
+			return loc[1] + end + len("-->")
+		}
+		return len(s)
+	}
+
+	name := strings.ToLower(s[loc[2]:loc[3]])
+	end := strings.Index(strings.ToLower(s[loc[1]:]), "</"+name)
+	if end == -1 {
+		return len(s)
+	}
+	end += loc[1]
+	if close := strings.IndexByte(s[end:], '>'); close != -1 {
+		return end + close + 1
+	}
+	return len(s)
+}
+
+// call returns the comp call of a component tag
+func (rw *tagRewriter) call(tag, attrs, children string) string {
+	var b strings.Builder
+	b.WriteString(`{{ comp "` + kebabCase(tag) + `" (dict`)
+	for _, attr := range tagAttrRegex.FindAllStringSubmatch(attrs, -1) {
+		b.WriteString(" " + strconv.Quote(attr[1]) + " " + attrValue(attr[2]))
+	}
+
+	if strings.TrimSpace(children) != "" {
+		if rw.blocks == nil {
+			rw.blocks = make(map[string]string)
+		}
+		block := fmt.Sprintf("%s.children.%d", rw.name, len(rw.blocks)+1)
+		rw.blocks[block] = children
+		b.WriteString(` "Children" (_children "` + block + `" .)`)
+	}
+
+	b.WriteString(") }}")
+	return b.String()
+}
+
+// rewriteSlots rewrites the {{ slot }}fallback{{ end }} blocks of content,
+// which render the children of the component, or the fallback when the caller
+// passed none or they render empty, into a with action on .Children.
+func rewriteSlots(content string) string {
+	return slotRegex.ReplaceAllString(content, "{{$1 with .Children }}{{ . }}{{ else $2}}")
+}
+
+// renderChildren renders the children block of a paired component tag with
+// the dot of the caller
+func (ts *TemplateSet) renderChildren(block string, data interface{}) (template.HTML, error) {
+	var buf strings.Builder
+	if err := ts.masterTmpl.ExecuteTemplate(ts.limit(&buf), block, data); err != nil {
+		return "", err
+	}
+	return template.HTML(buf.String()), nil
+}
+
+// attrValue returns the template expression of an attribute value: a string
+// for literal text, the pipeline of a single action, the print of both for
+// mixed values, and true for attributes without a value.
+func attrValue(value string) string {
+	if value == "" {
+		return "true"
+	}
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		value = value[1 : len(value)-1]
+	}
+
+	var parts []string
+	last := 0
+	for _, loc := range tagActionRegex.FindAllStringSubmatchIndex(value, -1) {
+		if loc[0] > last {
+			parts = append(parts, strconv.Quote(value[last:loc[0]]))
+		}
+		parts = append(parts, "("+value[loc[2]:loc[3]]+")")
+		last = loc[1]
+	}
+	if last < len(value) || len(parts) == 0 {
+		parts = append(parts, strconv.Quote(value[last:]))
+	}
+
+	if len(parts) == 1 {
+		return parts[0]
+	}
+	return "(print " + strings.Join(parts, " ") + ")"
+}
+
+// isComponentTag reports whether tag names one of the parts of a component file
+func isComponentTag(tag string) bool {
+	for _, t := range componentTags {
+		if strings.EqualFold(tag, t.name) {
+			return true
+		}
+	}
+	return false
+}
+
+// kebabCase converts a PascalCase tag name to the name of its template, so
+// UserCard becomes user-card and HTMLView becomes html-view
+func kebabCase(tag string) string {
+	runes := []rune(tag)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			if i > 0 && (!unicode.IsUpper(runes[i-1]) || i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+				b.WriteByte('-')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}